@@ -4,13 +4,22 @@ package blockmgr
 import (
 	"github.com/haiwen/seafile-server/fileserver/objstore"
 	"io"
+	"net/http"
 )
 
 var store *objstore.ObjectStore
 
 // Init initializes block manager and creates underlying object store.
-func Init(seafileConfPath string, seafileDataDir string) {
-	store = objstore.New(seafileConfPath, seafileDataDir, "blocks")
+// It fails if the object store can't be used.
+func Init(seafileConfPath string, seafileDataDir string) error {
+	var err error
+	store, err = objstore.New(seafileConfPath, seafileDataDir, "blocks")
+	return err
+}
+
+// Close releases the resources of the underlying object store.
+func Close() error {
+	return store.Close()
 }
 
 // Read reads block from storage backend.
@@ -33,6 +42,23 @@ func Write(repoID string, blockID string, r io.Reader) error {
 	return nil
 }
 
+// WriteSized writes block of size bytes to storage backend.
+// A negative size means it's unknown.
+func WriteSized(repoID string, blockID string, r io.Reader, size int64) error {
+	err := store.WriteSized(repoID, blockID, r, size, false)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Serve writes block as the response to an HTTP request, answering
+// conditional and range requests, and returns the number of bytes sent.
+func Serve(w http.ResponseWriter, r *http.Request, repoID string, blockID string) (int64, error) {
+	return store.ServeObject(w, r, repoID, blockID)
+}
+
 // Exists checks block if exists.
 func Exists(repoID string, blockID string) bool {
 	ret, _ := store.Exists(repoID, blockID)
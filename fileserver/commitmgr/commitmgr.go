@@ -43,8 +43,16 @@ type Commit struct {
 var store *objstore.ObjectStore
 
 // Init initializes commit manager and creates underlying object store.
-func Init(seafileConfPath string, seafileDataDir string) {
-	store = objstore.New(seafileConfPath, seafileDataDir, "commits")
+// It fails if the object store can't be used.
+func Init(seafileConfPath string, seafileDataDir string) error {
+	var err error
+	store, err = objstore.New(seafileConfPath, seafileDataDir, "commits")
+	return err
+}
+
+// Close releases the resources of the underlying object store.
+func Close() error {
+	return store.Close()
 }
 
 // NewCommit initializes a Commit object.
@@ -4,7 +4,6 @@ import (
 	"archive/zip"
 	"bytes"
 	"context"
-	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -34,6 +33,7 @@ import (
 	"github.com/haiwen/seafile-server/fileserver/commitmgr"
 	"github.com/haiwen/seafile-server/fileserver/diff"
 	"github.com/haiwen/seafile-server/fileserver/fsmgr"
+	"github.com/haiwen/seafile-server/fileserver/objstore"
 	"github.com/haiwen/seafile-server/fileserver/repomgr"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/text/unicode/norm"
@@ -622,27 +622,21 @@ func doBlock(rsp http.ResponseWriter, r *http.Request, repo *repomgr.Repo, fileI
 	rsp.Header().Set("Access-Control-Allow-Origin", "*")
 	setCommonHeaders(rsp, r, "downloadblks", blkID)
 
-	size, err := blockmgr.Stat(repo.StoreID, blkID)
-	if err != nil {
-		msg := "Failed to stat block"
-		return &appError{nil, msg, http.StatusBadRequest}
-	}
-	if size == 0 {
-		rsp.WriteHeader(http.StatusOK)
-		return nil
+	sent, err := blockmgr.Serve(rsp, r, repo.StoreID, blkID)
+	if errors.Is(err, objstore.ErrObjectNotExist) {
+		msg := "Block not found"
+		return &appError{nil, msg, http.StatusNotFound}
 	}
-
-	fileSize := fmt.Sprintf("%d", size)
-	rsp.Header().Set("Content-Length", fileSize)
-
-	err = blockmgr.Read(repo.StoreID, blkID, rsp)
 	if err != nil {
 		if !isNetworkErr(err) {
 			log.Printf("failed to read block %s: %v", blkID, err)
 		}
 	}
 
-	sendStatisticMsg(repo.StoreID, user, "web-file-download", uint64(size))
+	// Only the bytes sent are counted, none for 304 Not Modified.
+	if sent > 0 {
+		sendStatisticMsg(repo.StoreID, user, "web-file-download", uint64(sent))
+	}
 
 	return nil
 }
@@ -1480,8 +1474,8 @@ func postMultiFiles(rsp http.ResponseWriter, r *http.Request, repoID, parentDir,
 			id, size, err := indexBlocks(r.Context(), repo.StoreID, repo.Version, filePath, nil, cryptKey)
 			if err != nil {
 				if !errors.Is(err, context.Canceled) {
-					err := fmt.Errorf("failed to index blocks: %v", err)
-					return &appError{err, "", http.StatusInternalServerError}
+					err := fmt.Errorf("failed to index blocks: %w", err)
+					return storageError(err)
 				}
 				return &appError{nil, "", http.StatusInternalServerError}
 			}
@@ -1493,8 +1487,8 @@ func postMultiFiles(rsp http.ResponseWriter, r *http.Request, repoID, parentDir,
 			id, size, err := indexBlocks(r.Context(), repo.StoreID, repo.Version, "", handler, cryptKey)
 			if err != nil {
 				if !errors.Is(err, context.Canceled) {
-					err := fmt.Errorf("failed to index blocks: %v", err)
-					return &appError{err, "", http.StatusInternalServerError}
+					err := fmt.Errorf("failed to index blocks: %w", err)
+					return storageError(err)
 				}
 				return &appError{nil, "", http.StatusInternalServerError}
 			}
@@ -2099,7 +2093,7 @@ func indexBlocks(ctx context.Context, repoID string, version int, filePath strin
 
 	fileID, err := writeSeafile(repoID, version, size, blkIDs)
 	if err != nil {
-		err := fmt.Errorf("failed to write seafile: %v", err)
+		err := fmt.Errorf("failed to write seafile: %w", err)
 		return "", -1, err
 	}
 
@@ -2115,7 +2109,7 @@ func writeSeafile(repoID string, version int, fileSize int64, blkIDs []string) (
 
 	err = fsmgr.SaveSeafile(repoID, seafile)
 	if err != nil {
-		err := fmt.Errorf("failed to save seafile %s/%s", repoID, seafile.FileID)
+		err := fmt.Errorf("failed to save seafile %s/%s: %w", repoID, seafile.FileID, err)
 		return "", err
 	}
 
@@ -2217,7 +2211,7 @@ func chunkFile(job chunkingData) (string, error) {
 
 	blkID, err := writeChunk(repoID, buf, int64(n), cryptKey)
 	if err != nil {
-		err := fmt.Errorf("failed to write chunk: %v", err)
+		err := fmt.Errorf("failed to write chunk: %w", err)
 		return "", err
 	}
 
@@ -2232,27 +2226,25 @@ func writeChunk(repoID string, input []byte, blkSize int64, cryptKey *seafileCry
 			err := fmt.Errorf("failed to encrypt block: %v", err)
 			return "", err
 		}
-		checkSum := sha1.Sum(encoded)
-		blkID = hex.EncodeToString(checkSum[:])
+		blkID = objstore.ComputeID(encoded)
 		if blockmgr.Exists(repoID, blkID) {
 			return blkID, nil
 		}
 		reader := bytes.NewReader(encoded)
-		err = blockmgr.Write(repoID, blkID, reader)
+		err = blockmgr.WriteSized(repoID, blkID, reader, int64(len(encoded)))
 		if err != nil {
-			err := fmt.Errorf("failed to write block: %v", err)
+			err := fmt.Errorf("failed to write block: %w", err)
 			return "", err
 		}
 	} else {
-		checkSum := sha1.Sum(input)
-		blkID = hex.EncodeToString(checkSum[:])
+		blkID = objstore.ComputeID(input)
 		if blockmgr.Exists(repoID, blkID) {
 			return blkID, nil
 		}
 		reader := bytes.NewReader(input)
-		err := blockmgr.Write(repoID, blkID, reader)
+		err := blockmgr.WriteSized(repoID, blkID, reader, int64(len(input)))
 		if err != nil {
-			err := fmt.Errorf("failed to write block: %v", err)
+			err := fmt.Errorf("failed to write block: %w", err)
 			return "", err
 		}
 	}
@@ -2817,7 +2809,7 @@ func putFile(rsp http.ResponseWriter, r *http.Request, repoID, parentDir, user,
 		if err != nil {
 			if !errors.Is(err, context.Canceled) {
 				err := fmt.Errorf("failed to index blocks: %w", err)
-				return &appError{err, "", http.StatusInternalServerError}
+				return storageError(err)
 			}
 			return &appError{nil, "", http.StatusInternalServerError}
 		}
@@ -2829,7 +2821,7 @@ func putFile(rsp http.ResponseWriter, r *http.Request, repoID, parentDir, user,
 		if err != nil {
 			if !errors.Is(err, context.Canceled) {
 				err := fmt.Errorf("failed to index blocks: %w", err)
-				return &appError{err, "", http.StatusInternalServerError}
+				return storageError(err)
 			}
 			return &appError{nil, "", http.StatusInternalServerError}
 		}
@@ -3131,8 +3123,8 @@ func indexExistedFileBlocks(repoID string, version int, blkIDs []string, fileSiz
 
 	fileID, err := writeSeafile(repoID, version, fileSize, blkIDs)
 	if err != nil {
-		err := fmt.Errorf("failed to write seafile: %v", err)
-		return "", &appError{err, "", http.StatusInternalServerError}
+		err := fmt.Errorf("failed to write seafile: %w", err)
+		return "", storageError(err)
 	}
 
 	return fileID, nil
@@ -3240,14 +3232,13 @@ func indexRawBlocks(repoID string, blockIDs []string, fileHeaders []*multipart.F
 			err := fmt.Errorf("failed to read block: %v", err)
 			return err
 		}
-		checkSum := sha1.Sum(buf.Bytes())
-		blkID := hex.EncodeToString(checkSum[:])
+		blkID := objstore.ComputeID(buf.Bytes())
 		if blkID != blockIDs[i] {
 			err := fmt.Errorf("block id %s:%s doesn't match content", blkID, blockIDs[i])
 			return err
 		}
 
-		err = blockmgr.Write(repoID, blkID, &buf)
+		err = blockmgr.WriteSized(repoID, blkID, &buf, int64(buf.Len()))
 		if err != nil {
 			err := fmt.Errorf("failed to write block: %s/%s: %v", repoID, blkID, err)
 			return err
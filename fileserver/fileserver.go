@@ -3,6 +3,8 @@ package main
 
 import (
 	"database/sql"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"io"
@@ -20,6 +22,7 @@ import (
 	"github.com/haiwen/seafile-server/fileserver/blockmgr"
 	"github.com/haiwen/seafile-server/fileserver/commitmgr"
 	"github.com/haiwen/seafile-server/fileserver/fsmgr"
+	"github.com/haiwen/seafile-server/fileserver/objstore"
 	"github.com/haiwen/seafile-server/fileserver/repomgr"
 	"github.com/haiwen/seafile-server/fileserver/searpc"
 	"github.com/haiwen/seafile-server/fileserver/share"
@@ -417,6 +420,19 @@ func removePidfile(pid_file_path string) error {
 	return nil
 }
 
+// closeObjectStores releases the resources of the object stores on shutdown.
+func closeObjectStores() {
+	if err := fsmgr.Close(); err != nil {
+		log.Printf("Failed to close fs object store: %v", err)
+	}
+	if err := blockmgr.Close(); err != nil {
+		log.Printf("Failed to close block object store: %v", err)
+	}
+	if err := commitmgr.Close(); err != nil {
+		log.Printf("Failed to close commit object store: %v", err)
+	}
+}
+
 func main() {
 	flag.Parse()
 
@@ -490,11 +506,17 @@ func main() {
 
 	repomgr.Init(seafileDB)
 
-	fsmgr.Init(centralDir, dataDir)
+	if err := fsmgr.Init(centralDir, dataDir); err != nil {
+		log.Fatalf("Failed to initialize fs manager: %v", err)
+	}
 
-	blockmgr.Init(centralDir, dataDir)
+	if err := blockmgr.Init(centralDir, dataDir); err != nil {
+		log.Fatalf("Failed to initialize block manager: %v", err)
+	}
 
-	commitmgr.Init(centralDir, dataDir)
+	if err := commitmgr.Init(centralDir, dataDir); err != nil {
+		log.Fatalf("Failed to initialize commit manager: %v", err)
+	}
 
 	share.Init(ccnetDB, seafileDB, groupTableName, cloudMode)
 
@@ -528,6 +550,7 @@ func handleSignals() {
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 	<-signalChan
+	closeObjectStores()
 	removePidfile(pidFilePath)
 	os.Exit(0)
 }
@@ -620,6 +643,8 @@ func newHTTPRouter() *mux.Router {
 	r.Handle("/debug/pprof/block", &profileHandler{pprof.Handler("block")})
 	r.Handle("/debug/pprof/goroutine", &profileHandler{pprof.Handler("goroutine")})
 	r.Handle("/debug/pprof/threadcreate", &profileHandler{pprof.Handler("threadcreate")})
+	// Counters of the object stores, among other expvars.
+	r.Handle("/debug/vars", &profileHandler{expvar.Handler()})
 	return r
 }
 
@@ -637,13 +662,23 @@ type appHandler func(http.ResponseWriter, *http.Request) *appError
 
 func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if e := fn(w, r); e != nil {
-		if e.Error != nil && e.Code == http.StatusInternalServerError {
+		if e.Error != nil && (e.Code == http.StatusInternalServerError || e.Code == http.StatusInsufficientStorage) {
 			log.Printf("path %s internal server error: %v\n", r.URL.Path, e.Error)
 		}
 		http.Error(w, e.Message, e.Code)
 	}
 }
 
+// storageError is the appError of a failed write to the object store. A full
+// store is answered with 507 Insufficient Storage, so clients can tell it
+// apart from a transient failure.
+func storageError(err error) *appError {
+	if errors.Is(err, objstore.ErrNoSpace) {
+		return &appError{err, "Insufficient storage.\n", http.StatusInsufficientStorage}
+	}
+	return &appError{err, "", http.StatusInternalServerError}
+}
+
 func RecoverWrapper(f func()) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -218,8 +218,16 @@ const (
 )
 
 // Init initializes fs manager and creates underlying object store.
-func Init(seafileConfPath string, seafileDataDir string) {
-	store = objstore.New(seafileConfPath, seafileDataDir, "fs")
+// It fails if the object store can't be used.
+func Init(seafileConfPath string, seafileDataDir string) error {
+	var err error
+	store, err = objstore.New(seafileConfPath, seafileDataDir, "fs")
+	return err
+}
+
+// Close releases the resources of the underlying object store.
+func Close() error {
+	return store.Close()
 }
 
 // NewDirent initializes a SeafDirent object
@@ -448,7 +456,7 @@ func SaveSeafile(repoID string, seafile *Seafile) error {
 
 	err = WriteRaw(repoID, fileID, &buf)
 	if err != nil {
-		errors := fmt.Errorf("failed to write seafile object to storage : %v", err)
+		errors := fmt.Errorf("failed to write seafile object to storage : %w", err)
 		return errors
 	}
 
@@ -0,0 +1,232 @@
+// Implementation of moving rarely read objects to a cold archive backend.
+package objstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// archiveBackend keeps objects in its hot backend until they're archived,
+// which moves them to its archive backend, e.g. a bucket of a cold storage
+// class which is cheaper but slower. Archived objects stay readable: a read
+// missing the hot backend restores the object from the archive into the
+// hot backend, so objects read again are served from there next time.
+// Writes always go to the hot backend.
+//
+// It's configured with the options of the two backends prefixed by hot and
+// archive:
+//
+//	[block_backend]
+//	type = archive
+//	hot.type = fs
+//	archive.type = s3
+//	archive.bucket = seafile-archive
+type archiveBackend struct {
+	hot  storageBackend
+	cold storageBackend
+}
+
+func init() {
+	RegisterBackend("archive", func(conf map[string]string) (storageBackend, error) {
+		backend, err := newArchiveBackend(conf)
+		if err != nil {
+			return nil, err
+		}
+		return backend, nil
+	})
+}
+
+func newArchiveBackend(conf map[string]string) (*archiveBackend, error) {
+	backends, err := createSubBackends(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	backend := new(archiveBackend)
+	for _, sub := range []struct {
+		name    string
+		backend *storageBackend
+	}{{"hot", &backend.hot}, {"archive", &backend.cold}} {
+		b, ok := backends[sub.name]
+		if !ok {
+			return nil, fmt.Errorf("backend %q of archive backend is not configured", sub.name)
+		}
+		*sub.backend = b
+	}
+
+	return backend, nil
+}
+
+func (b *archiveBackend) unwrap() []storageBackend {
+	return []storageBackend{b.hot, b.cold}
+}
+
+func (b *archiveBackend) read(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	err := b.hot.read(ctx, repoID, objID, w)
+	if !errors.Is(err, ErrObjectNotExist) {
+		return err
+	}
+	return readPromoting(ctx, b.cold, b.hot, repoID, objID, w)
+}
+
+func (b *archiveBackend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	return b.hot.write(ctx, repoID, objID, r, sync)
+}
+
+func (b *archiveBackend) exists(repoID string, objID string) (bool, error) {
+	ret, err := b.hot.exists(repoID, objID)
+	if err != nil || ret {
+		return ret, err
+	}
+	return b.cold.exists(repoID, objID)
+}
+
+func (b *archiveBackend) stat(repoID string, objID string) (int64, error) {
+	size, err := b.hot.stat(repoID, objID)
+	if !errors.Is(err, ErrObjectNotExist) {
+		return size, err
+	}
+	return b.cold.stat(repoID, objID)
+}
+
+// delete removes the object from both backends. A backend without the
+// repo isn't an error, as none of its objects may be archived yet.
+func (b *archiveBackend) delete(repoID string, objID string) error {
+	for _, backend := range []storageBackend{b.hot, b.cold} {
+		err := backend.delete(repoID, objID)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// list lists the hot backend, then the archived objects which aren't also
+// in the hot backend since they were restored.
+func (b *archiveBackend) list(repoID string, fn func(objID string) error) error {
+	if err := b.hot.list(repoID, fn); err != nil {
+		return err
+	}
+	return b.cold.list(repoID, func(objID string) error {
+		if ret, _ := b.hot.exists(repoID, objID); ret {
+			return nil
+		}
+		return fn(objID)
+	})
+}
+
+// archive copies an object from the hot backend to the archive, and only
+// removes it from the hot backend once the archive holds it durably. An
+// object that's already archived is left alone.
+func (b *archiveBackend) archive(ctx context.Context, repoID string, objID string) error {
+	exists, err := b.hot.exists(repoID, objID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		archived, err := b.cold.exists(repoID, objID)
+		if err != nil {
+			return err
+		}
+		if !archived {
+			return ErrObjectNotExist
+		}
+		return nil
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(b.hot.read(ctx, repoID, objID, pw))
+	}()
+	err = b.cold.write(ctx, repoID, objID, pr, true)
+	pr.CloseWithError(err)
+	<-done
+	if err != nil {
+		return err
+	}
+	return b.hot.delete(repoID, objID)
+}
+
+// archiveBackendOf returns the archive backend in the tree rooted at b, or
+// nil if there's none.
+func archiveBackendOf(b storageBackend) *archiveBackend {
+	found := findBackend(b, func(b storageBackend) bool {
+		_, ok := b.(*archiveBackend)
+		return ok
+	})
+	if found == nil {
+		return nil
+	}
+	return found.(*archiveBackend)
+}
+
+// Archive moves an object from the hot backend of an archive backend to
+// its archive. The object stays readable, and is restored into the hot
+// backend when it's read. Archiving an archived object does nothing. It
+// returns ErrNotSupported if the store has no archive backend, and
+// ErrObjectNotExist if the object is missing.
+func (s *ObjectStore) Archive(repoID string, objID string) error {
+	if s.IsReadOnly() {
+		return ErrReadOnly
+	}
+	b := archiveBackendOf(s.backend)
+	if b == nil {
+		return ErrNotSupported
+	}
+	return b.archive(context.Background(), repoID, objID)
+}
+
+// ArchiveColderThan archives every object of a repo in the hot backend
+// which was written more than age ago, and returns how many were archived.
+// Restored objects are written anew into the hot backend, so they're only
+// archived again once they're not read for age. The sweep stops at the
+// first object which fails to be archived.
+func (s *ObjectStore) ArchiveColderThan(repoID string, age time.Duration) (archived int, err error) {
+	if s.IsReadOnly() {
+		return 0, ErrReadOnly
+	}
+	b := archiveBackendOf(s.backend)
+	if b == nil {
+		return 0, ErrNotSupported
+	}
+
+	// Collect the objects first, so the hot backend isn't changed while
+	// it's listed.
+	cutoff := time.Now().Add(-age)
+	var cold []string
+	err = b.hot.list(repoID, func(objID string) error {
+		t, err := modTimeBackend(b.hot, repoID, objID)
+		if errors.Is(err, ErrObjectNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if t.Before(cutoff) {
+			cold = append(cold, objID)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	ctx := context.Background()
+	for _, objID := range cold {
+		err := b.archive(ctx, repoID, objID)
+		if errors.Is(err, ErrObjectNotExist) {
+			continue
+		}
+		if err != nil {
+			return archived, fmt.Errorf("failed to archive object %s of repo %s: %w", objID, repoID, err)
+		}
+		archived++
+	}
+	return archived, nil
+}
@@ -0,0 +1,221 @@
+// Implementation of asynchronous writes of objects.
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"gopkg.in/ini.v1"
+)
+
+// defaultAsyncWriteWorkers is the number of goroutines writing queued
+// objects if async_write_workers isn't set.
+const defaultAsyncWriteWorkers = 4
+
+// asyncWriteBackend queues writes made with sync=false and writes them to
+// the wrapped backend from a few workers, so bulk imports don't flood the
+// disk with concurrent writes. A full queue blocks writers until a worker
+// takes a write from it, bounding the memory held by queued objects.
+//
+// Queued objects are served from memory until they're written. Sync waits
+// until the queue is empty and returns the first error of the writes made
+// since the previous Sync.
+type asyncWriteBackend struct {
+	storageBackend
+	queue chan *asyncWrite
+
+	lock sync.Mutex
+	// idle is signaled when the last queued write is done.
+	idle     *sync.Cond
+	inflight int
+	pending  map[string]*asyncWrite
+	err      error
+}
+
+type asyncWrite struct {
+	repoID string
+	objID  string
+	data   []byte
+}
+
+// asyncWriteFromConfig wraps backend with a write queue of
+// async_write_queue objects if it's set in the store section:
+//
+//	[store]
+//	async_write_queue = 1000
+//	async_write_workers = 4
+func asyncWriteFromConfig(config *ini.File, backend storageBackend) (storageBackend, error) {
+	queueStr := configValue(config, "store", "async_write_queue")
+	if queueStr == "" {
+		return backend, nil
+	}
+	queueLen, err := strconv.Atoi(queueStr)
+	if err != nil || queueLen < 0 {
+		return nil, fmt.Errorf("invalid async_write_queue of store: %s", queueStr)
+	}
+	if queueLen == 0 {
+		return backend, nil
+	}
+
+	workers := defaultAsyncWriteWorkers
+	if workersStr := configValue(config, "store", "async_write_workers"); workersStr != "" {
+		workers, err = strconv.Atoi(workersStr)
+		if err != nil || workers <= 0 {
+			return nil, fmt.Errorf("invalid async_write_workers of store: %s", workersStr)
+		}
+	}
+	return newAsyncWriteBackend(backend, queueLen, workers), nil
+}
+
+func newAsyncWriteBackend(backend storageBackend, queueLen int, workers int) *asyncWriteBackend {
+	b := new(asyncWriteBackend)
+	b.storageBackend = backend
+	b.queue = make(chan *asyncWrite, queueLen)
+	b.idle = sync.NewCond(&b.lock)
+	b.pending = make(map[string]*asyncWrite)
+	for i := 0; i < workers; i++ {
+		go b.work()
+	}
+	return b
+}
+
+func (b *asyncWriteBackend) unwrap() []storageBackend {
+	return []storageBackend{b.storageBackend}
+}
+
+func (b *asyncWriteBackend) work() {
+	for job := range b.queue {
+		err := b.storageBackend.write(context.Background(), job.repoID, job.objID, bytes.NewReader(job.data), false)
+
+		b.lock.Lock()
+		key := cacheKey(job.repoID, job.objID)
+		if b.pending[key] == job {
+			delete(b.pending, key)
+		}
+		if err != nil && b.err == nil {
+			b.err = fmt.Errorf("failed to write object %s of repo %s: %w", job.objID, job.repoID, err)
+		}
+		b.inflight--
+		if b.inflight == 0 {
+			b.idle.Broadcast()
+		}
+		b.lock.Unlock()
+	}
+}
+
+// get returns the content of a queued object.
+func (b *asyncWriteBackend) get(repoID string, objID string) ([]byte, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	job, ok := b.pending[cacheKey(repoID, objID)]
+	if !ok {
+		return nil, false
+	}
+	return job.data, true
+}
+
+// wait blocks until every queued write is done.
+func (b *asyncWriteBackend) wait() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for b.inflight > 0 {
+		b.idle.Wait()
+	}
+}
+
+func (b *asyncWriteBackend) read(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	if data, ok := b.get(repoID, objID); ok {
+		_, err := w.Write(data)
+		return err
+	}
+	return b.storageBackend.read(ctx, repoID, objID, w)
+}
+
+// write queues the object unless sync is set. It blocks while the queue is
+// full, and gives up without queueing the object when ctx is done.
+func (b *asyncWriteBackend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	if sync {
+		return b.storageBackend.write(ctx, repoID, objID, r, sync)
+	}
+
+	var buf bytes.Buffer
+	if _, err := copyCtx(ctx, &buf, r); err != nil {
+		return err
+	}
+	job := &asyncWrite{repoID, objID, buf.Bytes()}
+	key := cacheKey(repoID, objID)
+
+	b.lock.Lock()
+	prev := b.pending[key]
+	b.pending[key] = job
+	b.inflight++
+	b.lock.Unlock()
+
+	select {
+	case b.queue <- job:
+		return nil
+	case <-ctx.Done():
+		b.lock.Lock()
+		if b.pending[key] == job {
+			if prev != nil {
+				b.pending[key] = prev
+			} else {
+				delete(b.pending, key)
+			}
+		}
+		b.inflight--
+		if b.inflight == 0 {
+			b.idle.Broadcast()
+		}
+		b.lock.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (b *asyncWriteBackend) exists(repoID string, objID string) (bool, error) {
+	if _, ok := b.get(repoID, objID); ok {
+		return true, nil
+	}
+	return b.storageBackend.exists(repoID, objID)
+}
+
+func (b *asyncWriteBackend) stat(repoID string, objID string) (int64, error) {
+	if data, ok := b.get(repoID, objID); ok {
+		return int64(len(data)), nil
+	}
+	return b.storageBackend.stat(repoID, objID)
+}
+
+// delete waits for queued writes, so a queued write of the object can't
+// recreate it afterwards.
+func (b *asyncWriteBackend) delete(repoID string, objID string) error {
+	b.wait()
+	return b.storageBackend.delete(repoID, objID)
+}
+
+// sync waits until the queue is empty, then flushes the wrapped backends.
+func (b *asyncWriteBackend) sync() error {
+	b.wait()
+	b.lock.Lock()
+	err := b.err
+	b.err = nil
+	b.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return syncBackend(b.storageBackend)
+}
+
+// close writes the queued objects and stops the workers.
+func (b *asyncWriteBackend) close() error {
+	err := b.sync()
+	close(b.queue)
+	if closeErr := closeBackend(b.storageBackend); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,326 @@
+// Implementation of Azure Blob Storage backend.
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+const (
+	// azureRPCTimeout bounds metadata requests, which don't take a context from callers.
+	azureRPCTimeout    = 60 * time.Second
+	azureExistsWorkers = 32
+	// azureBlockSize is the size of blocks staged by an MD5-validated upload.
+	azureBlockSize     = 4 * 1024 * 1024
+	azureReadRetries   = 3
+	azureUploadBuffers = 4
+)
+
+type azureBackend struct {
+	container azblob.ContainerURL
+	prefix    string
+	verifyMD5 bool
+	buffers   *bufferPool
+}
+
+func init() {
+	RegisterBackend("azure", func(conf map[string]string) (storageBackend, error) {
+		backend, err := newAzureBackend(conf)
+		if err != nil {
+			return nil, err
+		}
+		return backend, nil
+	})
+}
+
+// newAzureBackend creates an Azure backend from a backend section of seafile.conf:
+//
+//	[block_backend]
+//	type = azure
+//	account_name = seafile
+//	container = seafile-blocks
+//	account_key = <base64 account key>
+//	prefix = seafile/
+//
+// Either account_key or sas_token must be given. endpoint overrides the
+// default https://<account_name>.blob.core.windows.net, e.g. for Azurite.
+// Setting verify_md5 to true makes the service check the MD5 of every
+// uploaded block and store the MD5 of the whole blob.
+func newAzureBackend(conf map[string]string) (*azureBackend, error) {
+	account := conf["account_name"]
+	if account == "" {
+		return nil, fmt.Errorf("account_name of azure backend must be specified")
+	}
+	container := conf["container"]
+	if container == "" {
+		return nil, fmt.Errorf("container of azure backend must be specified")
+	}
+
+	endpoint := conf["endpoint"]
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", account)
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/") + "/" + container)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint of azure backend: %w", err)
+	}
+
+	var credential azblob.Credential
+	if key := conf["account_key"]; key != "" {
+		credential, err = azblob.NewSharedKeyCredential(account, key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid account_key of azure backend: %w", err)
+		}
+	} else if sas := conf["sas_token"]; sas != "" {
+		credential = azblob.NewAnonymousCredential()
+		u.RawQuery = strings.TrimPrefix(sas, "?")
+	} else {
+		return nil, fmt.Errorf("account_key or sas_token of azure backend must be specified")
+	}
+
+	backend := new(azureBackend)
+	backend.container = azblob.NewContainerURL(*u, azblob.NewPipeline(credential, azblob.PipelineOptions{}))
+	backend.prefix = conf["prefix"]
+	backend.buffers, err = bufferPoolFromConf(conf)
+	if err != nil {
+		return nil, err
+	}
+	if verifyStr := conf["verify_md5"]; verifyStr != "" {
+		backend.verifyMD5, err = strconv.ParseBool(verifyStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid verify_md5 of azure backend: %w", err)
+		}
+	}
+	return backend, nil
+}
+
+func (b *azureBackend) blob(repoID string, objID string) azblob.BlockBlobURL {
+	return b.container.NewBlockBlobURL(b.prefix + repoID + "/" + objID)
+}
+
+// mapAzureError maps an Azure error onto the errors of this package.
+func mapAzureError(err error) error {
+	var storageErr azblob.StorageError
+	if errors.As(err, &storageErr) {
+		if storageErr.ServiceCode() == azblob.ServiceCodeBlobNotFound {
+			return ErrObjectNotExist
+		}
+		switch code := storageErr.Response().StatusCode; {
+		case code == http.StatusUnauthorized || code == http.StatusForbidden:
+			return &Error{ErrPermission, err}
+		case code >= http.StatusInternalServerError:
+			return &Error{ErrBackendUnavailable, err}
+		}
+		return err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return &Error{ErrBackendUnavailable, err}
+	}
+	return err
+}
+
+func (b *azureBackend) read(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	return b.download(ctx, repoID, objID, 0, azblob.CountToEnd, w)
+}
+
+func (b *azureBackend) readRange(ctx context.Context, repoID string, objID string, offset int64, length int64, w io.Writer) error {
+	size, err := b.stat(repoID, objID)
+	if err != nil {
+		return err
+	}
+	if err := checkRange(objID, offset, size); err != nil {
+		return err
+	}
+	if length == 0 {
+		return nil
+	}
+	if length < 0 {
+		length = azblob.CountToEnd
+	}
+	return b.download(ctx, repoID, objID, offset, length, w)
+}
+
+func (b *azureBackend) download(ctx context.Context, repoID string, objID string, offset int64, count int64, w io.Writer) error {
+	resp, err := b.blob(repoID, objID).Download(ctx, offset, count, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return mapAzureError(err)
+	}
+	body := resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: azureReadRetries})
+	defer body.Close()
+
+	_, err = b.buffers.copy(ctx, w, body)
+	return mapAzureError(err)
+}
+
+// open returns the body of a download, which retries failed reads.
+func (b *azureBackend) open(ctx context.Context, repoID string, objID string) (io.ReadCloser, error) {
+	resp, err := b.blob(repoID, objID).Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return nil, mapAzureError(err)
+	}
+	return resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: azureReadRetries}), nil
+}
+
+// write uploads r as a block blob. The blob only becomes visible when its
+// block list is committed, so a failed upload never leaves a partial object.
+func (b *azureBackend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	blob := b.blob(repoID, objID)
+	if b.verifyMD5 {
+		return b.uploadVerified(ctx, blob, r)
+	}
+
+	_, err := azblob.UploadStreamToBlockBlob(ctx, r, blob, azblob.UploadStreamToBlockBlobOptions{
+		MaxBuffers: azureUploadBuffers,
+	})
+	return mapAzureError(err)
+}
+
+// uploadVerified stages r block by block, sending the MD5 of each block so
+// the service rejects blocks corrupted on the way.
+func (b *azureBackend) uploadVerified(ctx context.Context, blob azblob.BlockBlobURL, r io.Reader) error {
+	var blockIDs []string
+	blobHash := md5.New()
+	buf := make([]byte, azureBlockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		block := buf[:n]
+		blockMD5 := md5.Sum(block)
+		blobHash.Write(block)
+		// Block IDs of a blob must all have the same length.
+		blockID := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", len(blockIDs))))
+		_, stageErr := blob.StageBlock(ctx, blockID, bytes.NewReader(block), azblob.LeaseAccessConditions{}, blockMD5[:], azblob.ClientProvidedKeyOptions{})
+		if stageErr != nil {
+			return mapAzureError(stageErr)
+		}
+		blockIDs = append(blockIDs, blockID)
+
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	headers := azblob.BlobHTTPHeaders{ContentMD5: blobHash.Sum(nil)}
+	_, err := blob.CommitBlockList(ctx, blockIDs, headers, azblob.Metadata{}, azblob.BlobAccessConditions{},
+		azblob.DefaultAccessTier, nil, azblob.ClientProvidedKeyOptions{})
+	return mapAzureError(err)
+}
+
+func (b *azureBackend) exists(repoID string, objID string) (bool, error) {
+	_, err := b.stat(repoID, objID)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotExist) {
+			return false, nil
+		}
+		return false, existsError(err)
+	}
+	return true, nil
+}
+
+func (b *azureBackend) existsMany(repoID string, objIDs []string) (map[string]bool, error) {
+	return existsConcurrently(objIDs, azureExistsWorkers, func(objID string) (bool, error) {
+		return b.exists(repoID, objID)
+	})
+}
+
+func (b *azureBackend) stat(repoID string, objID string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), azureRPCTimeout)
+	defer cancel()
+	return b.statCtx(ctx, repoID, objID)
+}
+
+func (b *azureBackend) statCtx(ctx context.Context, repoID string, objID string) (int64, error) {
+	props, err := b.blob(repoID, objID).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return -1, mapAzureError(err)
+	}
+	return props.ContentLength(), nil
+}
+
+func (b *azureBackend) delete(repoID string, objID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), azureRPCTimeout)
+	defer cancel()
+
+	_, err := b.blob(repoID, objID).Delete(ctx, azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
+	if err != nil {
+		if err = mapAzureError(err); err != ErrObjectNotExist {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *azureBackend) list(repoID string, fn func(objID string) error) error {
+	prefix := b.prefix + repoID + "/"
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		ctx, cancel := context.WithTimeout(context.Background(), azureRPCTimeout)
+		resp, err := b.container.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{Prefix: prefix})
+		cancel()
+		if err != nil {
+			return mapAzureError(err)
+		}
+		for _, item := range resp.Segment.BlobItems {
+			if err := fn(strings.TrimPrefix(item.Name, prefix)); err != nil {
+				return err
+			}
+		}
+		marker = resp.NextMarker
+	}
+	return nil
+}
+
+// listPage uses the marker of Azure as the page token.
+func (b *azureBackend) listPage(repoID string, token string, limit int) ([]string, string, error) {
+	prefix := b.prefix + repoID + "/"
+	var marker azblob.Marker
+	if token != "" {
+		marker.Val = &token
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), azureRPCTimeout)
+	defer cancel()
+
+	resp, err := b.container.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
+		Prefix:     prefix,
+		MaxResults: int32(limit),
+	})
+	if err != nil {
+		return nil, "", mapAzureError(err)
+	}
+
+	objIDs := make([]string, 0, len(resp.Segment.BlobItems))
+	for _, item := range resp.Segment.BlobItems {
+		objIDs = append(objIDs, strings.TrimPrefix(item.Name, prefix))
+	}
+	if !resp.NextMarker.NotDone() {
+		return objIDs, "", nil
+	}
+	return objIDs, *resp.NextMarker.Val, nil
+}
+
+func (b *azureBackend) healthCheck(ctx context.Context) error {
+	_, err := b.container.GetProperties(ctx, azblob.LeaseAccessConditions{})
+	if err != nil {
+		return existsError(mapAzureError(err))
+	}
+	return nil
+}
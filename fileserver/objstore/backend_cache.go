@@ -0,0 +1,143 @@
+// Implementation of in-memory read-through cache for small objects.
+package objstore
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"io"
+	"sync"
+)
+
+// cachingBackend keeps recently read objects in a LRU cache limited by total size.
+// Objects are content-addressed and immutable, so entries only need to be
+// evicted when the cache is full.
+type cachingBackend struct {
+	storageBackend
+
+	lock     sync.Mutex
+	capacity int64
+	size     int64
+	lru      *list.List
+	entries  map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	data []byte
+}
+
+func newCachingBackend(backend storageBackend, capacity int64) *cachingBackend {
+	cache := new(cachingBackend)
+	cache.storageBackend = backend
+	cache.capacity = capacity
+	cache.lru = list.New()
+	cache.entries = make(map[string]*list.Element)
+	return cache
+}
+
+func (c *cachingBackend) unwrap() []storageBackend {
+	return []storageBackend{c.storageBackend}
+}
+
+func cacheKey(repoID string, objID string) string {
+	return repoID + "/" + objID
+}
+
+func (c *cachingBackend) get(key string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).data, true
+}
+
+func (c *cachingBackend) add(key string, data []byte) {
+	if int64(len(data)) > c.capacity {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key, data})
+	c.size += int64(len(data))
+	for c.size > c.capacity {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *cachingBackend) remove(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+func (c *cachingBackend) removeElement(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.data))
+}
+
+func (c *cachingBackend) read(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	key := cacheKey(repoID, objID)
+	if data, ok := c.get(key); ok {
+		_, err := w.Write(data)
+		return err
+	}
+
+	var buf bytes.Buffer
+	err := c.storageBackend.read(ctx, repoID, objID, io.MultiWriter(w, &buf))
+	if err != nil {
+		return err
+	}
+	c.add(key, buf.Bytes())
+
+	return nil
+}
+
+func (c *cachingBackend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	defer c.remove(cacheKey(repoID, objID))
+	return c.storageBackend.write(ctx, repoID, objID, r, sync)
+}
+
+func (c *cachingBackend) writeSized(ctx context.Context, repoID string, objID string, r io.Reader, size int64, sync bool) error {
+	defer c.remove(cacheKey(repoID, objID))
+	return writeSizedTo(ctx, c.storageBackend, repoID, objID, r, size, sync)
+}
+
+func (c *cachingBackend) exists(repoID string, objID string) (bool, error) {
+	if _, ok := c.get(cacheKey(repoID, objID)); ok {
+		return true, nil
+	}
+	return c.storageBackend.exists(repoID, objID)
+}
+
+func (c *cachingBackend) stat(repoID string, objID string) (int64, error) {
+	if data, ok := c.get(cacheKey(repoID, objID)); ok {
+		return int64(len(data)), nil
+	}
+	return c.storageBackend.stat(repoID, objID)
+}
+
+func (c *cachingBackend) delete(repoID string, objID string) error {
+	defer c.remove(cacheKey(repoID, objID))
+	return c.storageBackend.delete(repoID, objID)
+}
+
+// transparentFor reports whether op leaves the cached contents valid: a
+// move removes the source object, and objects with TTL would still be
+// served from the cache after they expire.
+func (c *cachingBackend) transparentFor(op string) bool {
+	return op == "copy" || op == "list_page" || op == "exists_many" || op == "repo_stats"
+}
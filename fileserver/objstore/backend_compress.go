@@ -0,0 +1,151 @@
+// Implementation of transparent zstd compression of objects.
+package objstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressMagic starts every object written by compressingBackend. It's
+// followed by the uncompressed size as a big endian uint64, then the zstd
+// stream. Objects without the header are stored uncompressed.
+var compressMagic = []byte{'S', 'F', 'Z', 0}
+
+const compressHeaderSize = 12
+
+// compressingBackend compresses objects with zstd on write and decompresses them on read.
+// Objects written before compression was enabled are read as is.
+type compressingBackend struct {
+	storageBackend
+	encoder *zstd.Encoder
+}
+
+// newCompressingBackend wraps backend with compression at the zstd level,
+// from 1 (fastest) to 22 (best compression).
+func newCompressingBackend(backend storageBackend, level int) (*compressingBackend, error) {
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+	}
+
+	b := new(compressingBackend)
+	b.storageBackend = backend
+	b.encoder = encoder
+	return b, nil
+}
+
+func isCompressed(data []byte) bool {
+	return len(data) >= compressHeaderSize && bytes.Equal(data[:len(compressMagic)], compressMagic)
+}
+
+func (b *compressingBackend) unwrap() []storageBackend {
+	return []storageBackend{b.storageBackend}
+}
+
+// read streams an object, detecting from its header whether it's
+// compressed. Objects without the header, e.g. written before compression
+// was enabled, are streamed as is.
+func (b *compressingBackend) read(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	pr, pw := io.Pipe()
+	readErr := make(chan error, 1)
+	go func() {
+		err := b.storageBackend.read(ctx, repoID, objID, pw)
+		pw.CloseWithError(err)
+		readErr <- err
+	}()
+
+	err := b.decode(ctx, objID, pr, w)
+	// Unblock the backend if decoding stopped before the end of the object.
+	pr.CloseWithError(err)
+	if rerr := <-readErr; err == nil {
+		err = rerr
+	}
+	return err
+}
+
+func (b *compressingBackend) decode(ctx context.Context, objID string, r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(compressHeaderSize)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if !isCompressed(header) {
+		_, err = copyCtx(ctx, w, br)
+		return err
+	}
+
+	if _, err := br.Discard(compressHeaderSize); err != nil {
+		return err
+	}
+	decoder, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return fmt.Errorf("failed to create zstd decoder: %w", err)
+	}
+	defer decoder.Close()
+	dst := &recordingWriter{w: w}
+	_, err = copyCtx(ctx, dst, decoder)
+	if err != nil && dst.err == nil && ctx.Err() == nil {
+		return fmt.Errorf("failed to decompress object %s: %w", objID, err)
+	}
+	return err
+}
+
+// recordingWriter records the error of writing to w, to tell it from
+// errors of reading.
+type recordingWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (r *recordingWriter) Write(p []byte) (int, error) {
+	n, err := r.w.Write(p)
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+func (b *compressingBackend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	var buf bytes.Buffer
+	_, err := copyCtx(ctx, &buf, r)
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, compressHeaderSize, compressHeaderSize+buf.Len()/2)
+	copy(data, compressMagic)
+	binary.BigEndian.PutUint64(data[len(compressMagic):], uint64(buf.Len()))
+	data = b.encoder.EncodeAll(buf.Bytes(), data)
+
+	return b.storageBackend.write(ctx, repoID, objID, bytes.NewReader(data), sync)
+}
+
+// stat returns the uncompressed size stored in the header.
+func (b *compressingBackend) stat(repoID string, objID string) (int64, error) {
+	size, err := b.storageBackend.stat(repoID, objID)
+	if err != nil {
+		return -1, err
+	}
+
+	var header bytes.Buffer
+	if rr, ok := b.storageBackend.(rangeReader); ok && size >= compressHeaderSize {
+		err = rr.readRange(context.Background(), repoID, objID, 0, compressHeaderSize, &header)
+	} else {
+		err = b.storageBackend.read(context.Background(), repoID, objID, &header)
+	}
+	if err != nil {
+		return -1, err
+	}
+
+	data := header.Bytes()
+	if !isCompressed(data) {
+		return size, nil
+	}
+	return int64(binary.BigEndian.Uint64(data[len(compressMagic):compressHeaderSize])), nil
+}
@@ -0,0 +1,281 @@
+// Implementation of a read-through cache of objects on local disk.
+package objstore
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// defaultDiskCacheSize is the size of the disk cache if disk_cache_size
+// isn't set.
+const defaultDiskCacheSize = 1000000000
+
+// diskCacheBackend keeps objects read from a remote backend in a local
+// directory, laid out like the fs backend, and serves later reads from there.
+// Objects are immutable, so cached copies never need invalidating; the
+// least recently read objects are evicted when the cache exceeds its size.
+//
+// The access time of a cached object is kept as its modification time, so
+// the LRU order survives restarts: the cache directory is scanned when the
+// backend is created.
+type diskCacheBackend struct {
+	storageBackend
+	cache *fsBackend
+
+	lock     sync.Mutex
+	capacity int64
+	size     int64
+	lru      *list.List
+	entries  map[string]*list.Element
+}
+
+type diskCacheEntry struct {
+	repoID string
+	objID  string
+	size   int64
+}
+
+// diskCacheFromConfig wraps backend with a disk cache if disk_cache of the
+// store section is set to a directory:
+//
+//	[store]
+//	disk_cache = /var/cache/seafile
+//	disk_cache_size = 10GB
+//
+// Reading from a local file system is already fast, so backends of type fs
+// are returned as is.
+func diskCacheFromConfig(config *ini.File, backendType string, objType string, backend storageBackend) (storageBackend, error) {
+	dir := configValue(config, "store", "disk_cache")
+	if dir == "" || backendType == "fs" {
+		return backend, nil
+	}
+	capacity := int64(defaultDiskCacheSize)
+	if sizeStr := configValue(config, "store", "disk_cache_size"); sizeStr != "" {
+		var err error
+		capacity, err = parseSize(sizeStr)
+		if err != nil || capacity <= 0 {
+			return nil, fmt.Errorf("invalid disk_cache_size of store: %s", sizeStr)
+		}
+	}
+	return newDiskCacheBackend(backend, dir, objType, capacity)
+}
+
+func newDiskCacheBackend(backend storageBackend, dir string, objType string, capacity int64) (*diskCacheBackend, error) {
+	cache, err := newFSBackend(dir, objType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create disk cache: %w", err)
+	}
+	b := new(diskCacheBackend)
+	b.storageBackend = backend
+	b.cache = cache
+	b.capacity = capacity
+	b.lru = list.New()
+	b.entries = make(map[string]*list.Element)
+	if err := b.load(); err != nil {
+		return nil, fmt.Errorf("failed to load disk cache: %w", err)
+	}
+	return b, nil
+}
+
+func (b *diskCacheBackend) unwrap() []storageBackend {
+	return []storageBackend{b.storageBackend}
+}
+
+// load indexes the objects in the cache directory, most recently read first.
+func (b *diskCacheBackend) load() error {
+	repos, err := ioutil.ReadDir(b.cache.objDir)
+	if err != nil {
+		return err
+	}
+	type cached struct {
+		entry *diskCacheEntry
+		atime time.Time
+	}
+	var objects []cached
+	for _, repo := range repos {
+		if !repo.IsDir() || strings.HasPrefix(repo.Name(), ".") {
+			continue
+		}
+		dirs, err := b.cache.layout.objectDirs(path.Join(b.cache.objDir, repo.Name()))
+		if err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			files, err := readObjectDir(dir.path)
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				entry := &diskCacheEntry{repo.Name(), dir.prefix + file.Name(), file.Size()}
+				objects = append(objects, cached{entry, file.ModTime()})
+			}
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].atime.After(objects[j].atime)
+	})
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, obj := range objects {
+		b.entries[cacheKey(obj.entry.repoID, obj.entry.objID)] = b.lru.PushBack(obj.entry)
+		b.size += obj.entry.size
+	}
+	b.evict()
+	return nil
+}
+
+// get returns the cache entry of an object, marking it as recently read.
+func (b *diskCacheBackend) get(repoID string, objID string) (*diskCacheEntry, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	elem, ok := b.entries[cacheKey(repoID, objID)]
+	if !ok {
+		return nil, false
+	}
+	b.lru.MoveToFront(elem)
+	return elem.Value.(*diskCacheEntry), true
+}
+
+func (b *diskCacheBackend) add(entry *diskCacheEntry) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	key := cacheKey(entry.repoID, entry.objID)
+	if _, ok := b.entries[key]; ok {
+		return
+	}
+	b.entries[key] = b.lru.PushFront(entry)
+	b.size += entry.size
+	b.evict()
+}
+
+// evict removes the least recently read objects until the cache fits. The
+// caller must hold the lock.
+func (b *diskCacheBackend) evict() {
+	for b.size > b.capacity {
+		b.removeElement(b.lru.Back())
+	}
+}
+
+func (b *diskCacheBackend) remove(repoID string, objID string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if elem, ok := b.entries[cacheKey(repoID, objID)]; ok {
+		b.removeElement(elem)
+	}
+}
+
+func (b *diskCacheBackend) removeElement(elem *list.Element) {
+	entry := b.lru.Remove(elem).(*diskCacheEntry)
+	delete(b.entries, cacheKey(entry.repoID, entry.objID))
+	b.size -= entry.size
+	b.cache.delete(entry.repoID, entry.objID)
+}
+
+func (b *diskCacheBackend) read(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	if _, ok := b.get(repoID, objID); ok {
+		now := time.Now()
+		os.Chtimes(b.cache.objectPath(repoID, objID), now, now)
+		err := b.cache.read(ctx, repoID, objID, w)
+		if !errors.Is(err, ErrObjectNotExist) {
+			return err
+		}
+		// Removed from the directory behind our back.
+		b.remove(repoID, objID)
+	}
+	return b.readCaching(ctx, repoID, objID, w)
+}
+
+// readCaching reads an object into w while writing it into the cache. The
+// object isn't cached if the read fails, and a failure of the cache doesn't
+// fail the read.
+func (b *diskCacheBackend) readCaching(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	pr, pw := io.Pipe()
+	cached := make(chan error, 1)
+	go func() {
+		err := b.cache.write(ctx, repoID, objID, pr, false)
+		pr.CloseWithError(err)
+		cached <- err
+	}()
+
+	cw := &countingWriter{w: pw}
+	tee := &promoteWriter{w: w, promote: cw}
+	err := b.storageBackend.read(ctx, repoID, objID, tee)
+	if err != nil {
+		pw.CloseWithError(err)
+	} else {
+		pw.Close()
+	}
+	if cacheErr := <-cached; err == nil && cacheErr == nil && !tee.failed {
+		b.add(&diskCacheEntry{repoID, objID, cw.n})
+	}
+	return err
+}
+
+// writeSized passes sized writes through, which write doesn't need to
+// override as objects are only cached when read.
+func (b *diskCacheBackend) writeSized(ctx context.Context, repoID string, objID string, r io.Reader, size int64, sync bool) error {
+	return writeSizedTo(ctx, b.storageBackend, repoID, objID, r, size, sync)
+}
+
+func (b *diskCacheBackend) exists(repoID string, objID string) (bool, error) {
+	if _, ok := b.get(repoID, objID); ok {
+		return true, nil
+	}
+	return b.storageBackend.exists(repoID, objID)
+}
+
+func (b *diskCacheBackend) stat(repoID string, objID string) (int64, error) {
+	if entry, ok := b.get(repoID, objID); ok {
+		return entry.size, nil
+	}
+	return b.storageBackend.stat(repoID, objID)
+}
+
+func (b *diskCacheBackend) delete(repoID string, objID string) error {
+	defer b.remove(repoID, objID)
+	return b.storageBackend.delete(repoID, objID)
+}
+
+// deleteRepo deletes the repo from the wrapped backend and drops its
+// cached objects.
+func (b *diskCacheBackend) deleteRepo(repoID string) error {
+	if err := deleteRepoBackend(b.storageBackend, repoID); err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	for elem := b.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*diskCacheEntry).repoID == repoID {
+			entry := b.lru.Remove(elem).(*diskCacheEntry)
+			delete(b.entries, cacheKey(entry.repoID, entry.objID))
+			b.size -= entry.size
+		}
+		elem = next
+	}
+	b.lock.Unlock()
+	return b.cache.deleteRepo(repoID)
+}
+
+// transparentFor reports whether op leaves the cached objects valid: a move
+// removes the source object, and objects with TTL would still be served
+// from the cache after they expire.
+func (b *diskCacheBackend) transparentFor(op string) bool {
+	return op == "copy" || op == "list_page" || op == "exists_many" || op == "repo_stats"
+}
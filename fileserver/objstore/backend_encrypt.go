@@ -0,0 +1,203 @@
+// Implementation of encryption at rest of objects.
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"gopkg.in/ini.v1"
+)
+
+// encryptMagic starts every object written by encryptingBackend. It's
+// followed by the ID of the key as a big endian uint32, the random nonce,
+// then the AES-GCM sealed content. Objects without the header are stored
+// unencrypted.
+var encryptMagic = []byte{'S', 'F', 'E', 0}
+
+const (
+	encryptNonceSize  = 12
+	encryptHeaderSize = 8 + encryptNonceSize
+	encryptKeySize    = 32
+	// encryptKeyEnv is the environment variable holding the master key if
+	// it's not set in seafile.conf.
+	encryptKeyEnv = "SEAFILE_OBJECT_ENCRYPTION_KEY"
+)
+
+// encryptingBackend encrypts objects with AES-256-GCM on write and decrypts
+// them on read. Object IDs are unchanged, and the ID is authenticated with
+// the content, so an object can't be swapped with another one.
+//
+// Each object records the ID of the key it's sealed with, so keys can be
+// rotated by adding a new current key and keeping the old ones for reading.
+// Objects written before encryption was enabled are read as is.
+type encryptingBackend struct {
+	storageBackend
+	keys    map[uint32]cipher.AEAD
+	current uint32
+}
+
+// newEncryptingBackend wraps backend with encryption by keys, which maps key
+// IDs to 32-byte keys. New objects are sealed with the key of current.
+func newEncryptingBackend(backend storageBackend, keys map[uint32][]byte, current uint32) (*encryptingBackend, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("encryption key %d is not configured", current)
+	}
+
+	b := new(encryptingBackend)
+	b.storageBackend = backend
+	b.keys = make(map[uint32]cipher.AEAD, len(keys))
+	for id, key := range keys {
+		if len(key) != encryptKeySize {
+			return nil, fmt.Errorf("encryption key %d must be %d bytes", id, encryptKeySize)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		b.keys[id] = aead
+	}
+	b.current = current
+	return b, nil
+}
+
+// encryptionFromConfig creates an encrypting backend around backend if
+// encrypt_objects of the store section is true:
+//
+//	[store]
+//	encrypt_objects = true
+//	encryption_key = <64 hex digits>
+//	encryption_key_id = 1
+//
+// The key is read from the SEAFILE_OBJECT_ENCRYPTION_KEY environment
+// variable if encryption_key isn't set. encryption_key_id defaults to 1.
+func encryptionFromConfig(config *ini.File, backend storageBackend) (storageBackend, error) {
+	encrypt, _ := strconv.ParseBool(configValue(config, "store", "encrypt_objects"))
+	if !encrypt {
+		return backend, nil
+	}
+
+	keyStr := configValue(config, "store", "encryption_key")
+	if keyStr == "" {
+		keyStr = os.Getenv(encryptKeyEnv)
+	}
+	if keyStr == "" {
+		return nil, fmt.Errorf("encryption_key of store or %s must be set to encrypt objects", encryptKeyEnv)
+	}
+	key, err := hex.DecodeString(keyStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+
+	var keyID uint32 = 1
+	if idStr := configValue(config, "store", "encryption_key_id"); idStr != "" {
+		id, err := strconv.ParseUint(idStr, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption_key_id of store: %w", err)
+		}
+		keyID = uint32(id)
+	}
+
+	return newEncryptingBackend(backend, map[uint32][]byte{keyID: key}, keyID)
+}
+
+func isEncrypted(data []byte) bool {
+	return len(data) >= encryptHeaderSize && bytes.Equal(data[:len(encryptMagic)], encryptMagic)
+}
+
+func (b *encryptingBackend) unwrap() []storageBackend {
+	return []storageBackend{b.storageBackend}
+}
+
+// load reads the stored object and returns its decrypted content.
+func (b *encryptingBackend) load(ctx context.Context, repoID string, objID string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := b.storageBackend.read(ctx, repoID, objID, &buf)
+	if err != nil {
+		return nil, err
+	}
+
+	data := buf.Bytes()
+	if !isEncrypted(data) {
+		return data, nil
+	}
+	keyID := binary.BigEndian.Uint32(data[len(encryptMagic):])
+	aead, ok := b.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("object %s is encrypted with unknown key %d", objID, keyID)
+	}
+	nonce := data[8:encryptHeaderSize]
+	content, err := aead.Open(nil, nonce, data[encryptHeaderSize:], []byte(objID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt object %s: %w", objID, err)
+	}
+	return content, nil
+}
+
+func (b *encryptingBackend) read(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	content, err := b.load(ctx, repoID, objID)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	return err
+}
+
+func (b *encryptingBackend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	var buf bytes.Buffer
+	_, err := copyCtx(ctx, &buf, r)
+	if err != nil {
+		return err
+	}
+
+	aead := b.keys[b.current]
+	data := make([]byte, encryptHeaderSize, encryptHeaderSize+buf.Len()+aead.Overhead())
+	copy(data, encryptMagic)
+	binary.BigEndian.PutUint32(data[len(encryptMagic):], b.current)
+	nonce := data[8:encryptHeaderSize]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	data = aead.Seal(data, nonce, buf.Bytes(), []byte(objID))
+
+	return b.storageBackend.write(ctx, repoID, objID, bytes.NewReader(data), sync)
+}
+
+// stat returns the size of the decrypted content.
+func (b *encryptingBackend) stat(repoID string, objID string) (int64, error) {
+	size, err := b.storageBackend.stat(repoID, objID)
+	if err != nil {
+		return -1, err
+	}
+
+	var header bytes.Buffer
+	if rr, ok := b.storageBackend.(rangeReader); ok && size >= encryptHeaderSize {
+		err = rr.readRange(context.Background(), repoID, objID, 0, encryptHeaderSize, &header)
+	} else {
+		err = b.storageBackend.read(context.Background(), repoID, objID, &header)
+	}
+	if err != nil {
+		return -1, err
+	}
+	if !isEncrypted(header.Bytes()) {
+		return size, nil
+	}
+	keyID := binary.BigEndian.Uint32(header.Bytes()[len(encryptMagic):])
+	aead, ok := b.keys[keyID]
+	if !ok {
+		return -1, fmt.Errorf("object %s is encrypted with unknown key %d", objID, keyID)
+	}
+	return size - encryptHeaderSize - int64(aead.Overhead()), nil
+}
@@ -2,98 +2,578 @@
 package objstore
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// fsExistsWorkers is the number of concurrent stat calls of existsMany().
+	fsExistsWorkers = 16
+	// fsDeleteWorkers is the number of concurrent unlinks of deleteMany().
+	fsDeleteWorkers = 16
 )
 
 type fsBackend struct {
 	// Path of the object directory
 	objDir  string
 	objType string
-	tmpDir  string
+	buffers *bufferPool
+	// Whether to read objects from memory maps
+	useMmap bool
+	layout  fsLayout
+	// Permissions of created directories and object files, which are
+	// set regardless of the umask. Zero keeps the defaults.
+	dirMode  os.FileMode
+	fileMode os.FileMode
 }
 
-func newFSBackend(seafileDataDir string, objType string) (*fsBackend, error) {
-	objDir := path.Join(seafileDataDir, "storage", objType)
-	err := os.MkdirAll(objDir, os.ModePerm)
+// fsError classifies a file system error. Errors from a failing disk or
+// an unreachable network file system mean the backend is unavailable.
+func fsError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case os.IsPermission(err):
+		return &Error{ErrPermission, err}
+	case errors.Is(err, syscall.EIO), errors.Is(err, syscall.ESTALE), errors.Is(err, syscall.ENOTCONN),
+		errors.Is(err, syscall.EHOSTDOWN), errors.Is(err, syscall.ETIMEDOUT):
+		return &Error{ErrBackendUnavailable, err}
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return &Error{ErrNoSpace, err}
+	}
+	return err
+}
+
+// objectError is like fsError, but maps a missing file to ErrObjectNotExist.
+func objectError(err error) error {
+	if os.IsNotExist(err) {
+		return ErrObjectNotExist
+	}
+	return fsError(err)
+}
+
+// checkIDs rejects IDs that could make an object path escape the object
+// directory or clash with the temp files and directories of the backend.
+func checkIDs(repoID string, objID string) error {
+	if err := checkRepoID(repoID); err != nil {
+		return err
+	}
+	if len(objID) < 3 || !isSafeName(objID) {
+		return fmt.Errorf("%w: object %q", ErrInvalidObjectID, objID)
+	}
+	return nil
+}
+
+func checkRepoID(repoID string) error {
+	if repoID == "" || !isSafeName(repoID) {
+		return fmt.Errorf("%w: repo %q", ErrInvalidObjectID, repoID)
+	}
+	return nil
+}
+
+// isSafeName reports whether name is a single path component that isn't
+// hidden and can't refer to a parent directory.
+func isSafeName(name string) bool {
+	return !strings.HasPrefix(name, ".") && !strings.Contains(name, "..") &&
+		!strings.ContainsAny(name, "/\\\x00")
+}
+
+func init() {
+	RegisterBackend("fs", func(conf map[string]string) (storageBackend, error) {
+		backend, err := newFSBackendFromConf(conf)
+		if err != nil {
+			return nil, err
+		}
+		return backend, nil
+	})
+}
+
+// newFSBackendFromConf creates an fs backend for the data_dir and obj_type
+// of conf, with the layout, modes and other options of conf.
+func newFSBackendFromConf(conf map[string]string) (*fsBackend, error) {
+	// The data directory is created unless create_data_dir is false, e.g.
+	// when it's a mount point that must not be written to where the mount
+	// is missing.
+	if createStr := conf["create_data_dir"]; createStr != "" {
+		create, err := strconv.ParseBool(createStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid create_data_dir of fs backend: %w", err)
+		}
+		if info, err := os.Stat(conf["data_dir"]); !create && (err != nil || !info.IsDir()) {
+			return nil, fmt.Errorf("data dir %s of fs backend doesn't exist", conf["data_dir"])
+		}
+	}
+	backend, err := newFSBackend(conf["data_dir"], conf["obj_type"])
+	if err != nil {
+		return nil, err
+	}
+	backend.buffers, err = bufferPoolFromConf(conf)
 	if err != nil {
 		return nil, err
 	}
-	tmpDir := path.Join(seafileDataDir, "tmpfiles")
-	err = os.MkdirAll(tmpDir, os.ModePerm)
+	backend.layout, err = parseLayout(conf["layout"])
+	if err != nil {
+		return nil, err
+	}
+	if mmapStr := conf["use_mmap"]; mmapStr != "" {
+		backend.useMmap, err = strconv.ParseBool(mmapStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid use_mmap of fs backend: %w", err)
+		}
+	}
+	if backend.dirMode, err = parseMode(conf, "dir_mode"); err != nil {
+		return nil, err
+	}
+	if backend.fileMode, err = parseMode(conf, "file_mode"); err != nil {
+		return nil, err
+	}
+	return backend, nil
+}
+
+// parseMode parses an octal permission like "0700" of the fs backend.
+func parseMode(conf map[string]string, key string) (os.FileMode, error) {
+	modeStr := conf[key]
+	if modeStr == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(modeStr, 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		return 0, fmt.Errorf("invalid %s of fs backend: %s", key, modeStr)
+	}
+	return os.FileMode(mode), nil
+}
+
+func newFSBackend(seafileDataDir string, objType string) (*fsBackend, error) {
+	objDir := path.Join(seafileDataDir, "storage", objType)
+	err := os.MkdirAll(objDir, os.ModePerm)
 	if err != nil {
 		return nil, err
 	}
 	backend := new(fsBackend)
 	backend.objDir = objDir
 	backend.objType = objType
-	backend.tmpDir = tmpDir
+	backend.buffers = defaultBuffers
+	backend.layout = layoutSharded
 	return backend, nil
 }
 
-func (b *fsBackend) read(repoID string, objID string, w io.Writer) error {
-	p := path.Join(b.objDir, repoID, objID[:2], objID[2:])
-	fd, err := os.Open(p)
-	if err != nil {
+func (b *fsBackend) read(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	if err := checkIDs(repoID, objID); err != nil {
 		return err
 	}
+	fd, err := b.openObject(repoID, objID)
+	if err != nil {
+		return objectError(err)
+	}
 	defer fd.Close()
 
-	_, err = io.Copy(w, fd)
+	if b.useMmap {
+		if ok, err := readMmap(ctx, fd, w); ok {
+			return err
+		}
+	}
+
+	_, err = b.buffers.copy(ctx, w, fd)
 	if err != nil {
-		return err
+		return fsError(err)
 	}
 
 	return nil
 }
 
-func (b *fsBackend) write(repoID string, objID string, r io.Reader, sync bool) error {
-	parentDir := path.Join(b.objDir, repoID, objID[:2])
-	p := path.Join(parentDir, objID[2:])
-	err := os.MkdirAll(parentDir, os.ModePerm)
-	if err != nil {
+func (b *fsBackend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	if err := checkIDs(repoID, objID); err != nil {
 		return err
 	}
+	return b.writeFile(ctx, b.objectPath(repoID, objID), objID, r, sync, time.Time{})
+}
+
+// objectPath returns the path of an object in the configured layout.
+func (b *fsBackend) objectPath(repoID string, objID string) string {
+	return b.layout.objectPath(path.Join(b.objDir, repoID), objID)
+}
+
+// writeFile writes an object to path p, setting its modification time to
+// mtime unless it's zero.
+func (b *fsBackend) writeFile(ctx context.Context, p string, objID string, r io.Reader, sync bool, mtime time.Time) error {
+	_, err := b.createFile(ctx, p, objID, r, sync, mtime, false)
+	return err
+}
 
-	tFile, err := ioutil.TempFile(b.tmpDir, objID)
+// createFile writes an object to path p like writeFile. If exclusive is set
+// an existing file at p is left alone, and created is false.
+func (b *fsBackend) createFile(ctx context.Context, p string, objID string, r io.Reader, sync bool, mtime time.Time, exclusive bool) (created bool, err error) {
+	parentDir := path.Dir(p)
+	err = b.mkdirAll(parentDir)
 	if err != nil {
-		return err
+		return false, fsError(err)
 	}
-	defer os.Remove(tFile.Name())
-	defer tFile.Close()
 
-	_, err = io.Copy(tFile, r)
+	// Write into a temp file next to the object and only rename it into
+	// place after a full copy, so a crash never leaves a partial object.
+	tFile, err := ioutil.TempFile(parentDir, "."+objID+".tmp.")
 	if err != nil {
-		return err
+		return false, fsError(err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tFile.Close()
+			os.Remove(tFile.Name())
+		}
+	}()
+	if b.fileMode != 0 {
+		if err := tFile.Chmod(b.fileMode); err != nil {
+			return false, fsError(err)
+		}
 	}
 
-	err = os.Rename(tFile.Name(), p)
+	_, err = b.buffers.copy(ctx, tFile, r)
+	if err != nil {
+		return false, fsError(err)
+	}
+	if sync {
+		err = tFile.Sync()
+		if err != nil {
+			return false, fsError(err)
+		}
+	}
+	err = tFile.Close()
+	if err != nil {
+		return false, fsError(err)
+	}
+	if !mtime.IsZero() {
+		if err := os.Chtimes(tFile.Name(), mtime, mtime); err != nil {
+			return false, fsError(err)
+		}
+	}
+
+	if exclusive {
+		// Unlike a rename, a link fails if the object already exists,
+		// so of concurrent writers exactly one creates it.
+		err = os.Link(tFile.Name(), p)
+		if os.IsExist(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fsError(err)
+		}
+		os.Remove(tFile.Name())
+	} else {
+		err = os.Rename(tFile.Name(), p)
+		if err != nil {
+			return false, fsError(err)
+		}
+	}
+	committed = true
+
+	if sync {
+		return true, syncDir(parentDir)
+	}
+	return true, nil
+}
+
+// writeIfAbsent writes an object unless it already exists.
+func (b *fsBackend) writeIfAbsent(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) (bool, error) {
+	if err := checkIDs(repoID, objID); err != nil {
+		return false, err
+	}
+	return b.createFile(ctx, b.objectPath(repoID, objID), objID, r, sync, time.Time{}, true)
+}
+
+// mkdirAll creates dir and its missing parents with dirMode, which is
+// set explicitly so the umask doesn't matter.
+func (b *fsBackend) mkdirAll(dir string) error {
+	if b.dirMode == 0 {
+		return os.MkdirAll(dir, os.ModePerm)
+	}
+	if info, err := os.Stat(dir); err == nil && info.IsDir() {
+		return nil
+	}
+	if parent := path.Dir(dir); parent != dir {
+		if err := b.mkdirAll(parent); err != nil {
+			return err
+		}
+	}
+	err := os.Mkdir(dir, b.dirMode)
+	if os.IsExist(err) {
+		// Created concurrently by another write.
+		return nil
+	}
 	if err != nil {
 		return err
 	}
+	return os.Chmod(dir, b.dirMode)
+}
 
-	return nil
+// syncDir flushes a directory so that entries renamed into it survive a crash.
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return fd.Sync()
 }
 
 func (b *fsBackend) exists(repoID string, objID string) (bool, error) {
-	path := path.Join(b.objDir, repoID, objID[:2], objID[2:])
-	_, err := os.Stat(path)
+	if err := checkIDs(repoID, objID); err != nil {
+		return false, err
+	}
+	_, err := b.statObject(repoID, objID)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return false, err
+			return false, nil
 		}
-		return true, err
+		return false, existsError(fsError(err))
 	}
 	return true, nil
 }
 
+func (b *fsBackend) existsMany(repoID string, objIDs []string) (map[string]bool, error) {
+	return existsConcurrently(objIDs, fsExistsWorkers, func(objID string) (bool, error) {
+		return b.exists(repoID, objID)
+	})
+}
+
 func (b *fsBackend) stat(repoID string, objID string) (int64, error) {
-	path := path.Join(b.objDir, repoID, objID[:2], objID[2:])
-	fileInfo, err := os.Stat(path)
-	if err != nil {
+	if err := checkIDs(repoID, objID); err != nil {
 		return -1, err
 	}
+	fileInfo, err := b.statObject(repoID, objID)
+	if err != nil {
+		return -1, objectError(err)
+	}
 	return fileInfo.Size(), nil
 }
+
+func (b *fsBackend) delete(repoID string, objID string) error {
+	if err := checkIDs(repoID, objID); err != nil {
+		return err
+	}
+	ttlErr := os.Remove(b.ttlPath(repoID, objID))
+	if ttlErr != nil && !os.IsNotExist(ttlErr) {
+		return fsError(ttlErr)
+	}
+
+	err := os.Remove(b.objectPath(repoID, objID))
+	if err == nil {
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return fsError(err)
+	}
+	if ttlErr == nil {
+		return nil
+	}
+
+	repoDir := path.Join(b.objDir, repoID)
+	if _, err := os.Stat(repoDir); err != nil {
+		return fmt.Errorf("failed to delete object %s of repo %s: %w", objID, repoID, err)
+	}
+	return nil
+}
+
+func (b *fsBackend) deleteMany(repoID string, objIDs []string) []error {
+	return deleteConcurrently(objIDs, fsDeleteWorkers, func(objID string) error {
+		return b.delete(repoID, objID)
+	})
+}
+
+func (b *fsBackend) list(repoID string, fn func(objID string) error) error {
+	if err := checkRepoID(repoID); err != nil {
+		return err
+	}
+	dirs, err := b.layout.objectDirs(path.Join(b.objDir, repoID))
+	if err != nil {
+		return fsError(err)
+	}
+
+	for _, dir := range dirs {
+		entries, err := readObjectDir(dir.path)
+		if err != nil {
+			return fsError(err)
+		}
+		for _, entry := range entries {
+			if err := fn(dir.prefix + entry.Name()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (b *fsBackend) copy(srcRepoID string, dstRepoID string, objID string) error {
+	if err := checkIDs(srcRepoID, objID); err != nil {
+		return err
+	}
+	if err := checkRepoID(dstRepoID); err != nil {
+		return err
+	}
+	srcPath := b.objectPath(srcRepoID, objID)
+	if _, err := b.statObject(srcRepoID, objID); err != nil {
+		return objectError(err)
+	}
+
+	dstPath := b.objectPath(dstRepoID, objID)
+	err := b.mkdirAll(path.Dir(dstPath))
+	if err != nil {
+		return fsError(err)
+	}
+
+	// Objects are immutable, so the source and destination can share the same inode.
+	err = os.Link(srcPath, dstPath)
+	if err == nil || os.IsExist(err) {
+		return nil
+	}
+
+	// Fall back to copying when hard link isn't possible, e.g. across file
+	// systems or for objects with TTL.
+	fd, err := b.openObject(srcRepoID, objID)
+	if err != nil {
+		return objectError(err)
+	}
+	defer fd.Close()
+
+	return b.write(context.Background(), dstRepoID, objID, fd, false)
+}
+
+// move renames the object into the destination repo, which is atomic.
+// It falls back to copying when renaming isn't possible, e.g. when the
+// repos are on different file systems.
+func (b *fsBackend) move(srcRepoID string, dstRepoID string, objID string) error {
+	if err := checkIDs(srcRepoID, objID); err != nil {
+		return err
+	}
+	if err := checkRepoID(dstRepoID); err != nil {
+		return err
+	}
+
+	dstPath := b.objectPath(dstRepoID, objID)
+	err := b.mkdirAll(path.Dir(dstPath))
+	if err != nil {
+		return fsError(err)
+	}
+	err = os.Rename(b.objectPath(srcRepoID, objID), dstPath)
+	if err == nil {
+		return nil
+	}
+	if !os.IsNotExist(err) && !errors.Is(err, syscall.EXDEV) {
+		return fsError(err)
+	}
+
+	// The object may only exist with TTL, which copy handles.
+	if err := b.copy(srcRepoID, dstRepoID, objID); err != nil {
+		return err
+	}
+	return b.delete(srcRepoID, objID)
+}
+
+func (b *fsBackend) readRange(ctx context.Context, repoID string, objID string, offset int64, length int64, w io.Writer) error {
+	if err := checkIDs(repoID, objID); err != nil {
+		return err
+	}
+	fd, err := b.openObject(repoID, objID)
+	if err != nil {
+		return objectError(err)
+	}
+	defer fd.Close()
+
+	fileInfo, err := fd.Stat()
+	if err != nil {
+		return fsError(err)
+	}
+	if err := checkRange(objID, offset, fileInfo.Size()); err != nil {
+		return err
+	}
+	if _, err := fd.Seek(offset, io.SeekStart); err != nil {
+		return fsError(err)
+	}
+
+	var r io.Reader = fd
+	if length >= 0 {
+		r = io.LimitReader(fd, length)
+	}
+	_, err = b.buffers.copy(ctx, w, r)
+	return err
+}
+
+// sync flushes the whole file system holding the objects, which covers the
+// data and directory entries of all objects written with sync=false.
+func (b *fsBackend) sync() error {
+	fd, err := os.Open(b.objDir)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return unix.Syncfs(int(fd.Fd()))
+}
+
+func (b *fsBackend) repoStats(repoID string) (int64, int64, error) {
+	if err := checkRepoID(repoID); err != nil {
+		return 0, 0, err
+	}
+	var count, total int64
+	dirs, err := b.layout.objectDirs(path.Join(b.objDir, repoID))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, dir := range dirs {
+		shardDir := dir.path
+		fd, err := os.Open(shardDir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, 0, err
+		}
+		names, err := fd.Readdirnames(-1)
+		fd.Close()
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, name := range names {
+			if strings.HasPrefix(name, ".") {
+				continue
+			}
+			fileInfo, err := os.Lstat(path.Join(shardDir, name))
+			if err != nil {
+				// The object may be deleted after listing.
+				if os.IsNotExist(err) {
+					continue
+				}
+				return 0, 0, err
+			}
+			if fileInfo.Mode().IsRegular() {
+				count++
+				total += fileInfo.Size()
+			}
+		}
+	}
+
+	return count, total, nil
+}
+
+func (b *fsBackend) healthCheck(ctx context.Context) error {
+	fileInfo, err := os.Stat(b.objDir)
+	if err != nil {
+		return existsError(fsError(err))
+	}
+	if !fileInfo.IsDir() {
+		return &Error{ErrBackendUnavailable, fmt.Errorf("%s is not a directory", b.objDir)}
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+// Implementation of Google Cloud Storage backend.
+package objstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+const (
+	// gcsRPCTimeout bounds metadata requests, which don't take a context from callers.
+	gcsRPCTimeout    = 60 * time.Second
+	gcsExistsWorkers = 32
+)
+
+type gcsBackend struct {
+	client  *storage.Client
+	bucket  *storage.BucketHandle
+	prefix  string
+	buffers *bufferPool
+}
+
+func init() {
+	RegisterBackend("gcs", func(conf map[string]string) (storageBackend, error) {
+		backend, err := newGCSBackend(conf)
+		if err != nil {
+			return nil, err
+		}
+		return backend, nil
+	})
+}
+
+// newGCSBackend creates a GCS backend from a backend section of seafile.conf:
+//
+//	[block_backend]
+//	type = gcs
+//	bucket = seafile-blocks
+//	prefix = seafile/
+//	credentials_path = /etc/seafile/gcs-key.json
+//
+// prefix is prepended to object names. Without credentials_path the
+// application default credentials are used.
+func newGCSBackend(conf map[string]string) (*gcsBackend, error) {
+	bucket := conf["bucket"]
+	if bucket == "" {
+		return nil, fmt.Errorf("bucket of gcs backend must be specified")
+	}
+
+	buffers, err := bufferPoolFromConf(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts []option.ClientOption
+	if credentials := conf["credentials_path"]; credentials != "" {
+		opts = append(opts, option.WithCredentialsFile(credentials))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), gcsRPCTimeout)
+	defer cancel()
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gcs client: %w", err)
+	}
+
+	backend := new(gcsBackend)
+	backend.client = client
+	backend.bucket = client.Bucket(bucket)
+	backend.prefix = conf["prefix"]
+	backend.buffers = buffers
+	return backend, nil
+}
+
+func (b *gcsBackend) object(repoID string, objID string) *storage.ObjectHandle {
+	return b.bucket.Object(b.prefix + repoID + "/" + objID)
+}
+
+// mapGCSError maps a GCS error onto the errors of this package.
+func mapGCSError(err error) error {
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return ErrObjectNotExist
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch code := apiErr.Code; {
+		case code == http.StatusUnauthorized || code == http.StatusForbidden:
+			return &Error{ErrPermission, err}
+		case code >= http.StatusInternalServerError:
+			return &Error{ErrBackendUnavailable, err}
+		}
+		return err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return &Error{ErrBackendUnavailable, err}
+	}
+	return err
+}
+
+func (b *gcsBackend) read(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	reader, err := b.object(repoID, objID).NewReader(ctx)
+	if err != nil {
+		return mapGCSError(err)
+	}
+	defer reader.Close()
+
+	_, err = b.buffers.copy(ctx, w, reader)
+	return err
+}
+
+func (b *gcsBackend) open(ctx context.Context, repoID string, objID string) (io.ReadCloser, error) {
+	reader, err := b.object(repoID, objID).NewReader(ctx)
+	if err != nil {
+		return nil, mapGCSError(err)
+	}
+	return reader, nil
+}
+
+func (b *gcsBackend) readRange(ctx context.Context, repoID string, objID string, offset int64, length int64, w io.Writer) error {
+	size, err := b.stat(repoID, objID)
+	if err != nil {
+		return err
+	}
+	if err := checkRange(objID, offset, size); err != nil {
+		return err
+	}
+	if length == 0 {
+		return nil
+	}
+
+	reader, err := b.object(repoID, objID).NewRangeReader(ctx, offset, length)
+	if err != nil {
+		return mapGCSError(err)
+	}
+	defer reader.Close()
+
+	_, err = b.buffers.copy(ctx, w, reader)
+	return err
+}
+
+// write streams r to a new object, which is only created when the writer
+// is closed. Canceling the context aborts the upload.
+func (b *gcsBackend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	return b.upload(ctx, repoID, objID, r, googleapi.DefaultUploadChunkSize)
+}
+
+// writeSized uploads objects smaller than the default chunk size with a
+// chunk just large enough to hold them, so a small object doesn't take a
+// whole default chunk buffer and is sent in one request.
+func (b *gcsBackend) writeSized(ctx context.Context, repoID string, objID string, r io.Reader, size int64, sync bool) error {
+	chunkSize := googleapi.DefaultUploadChunkSize
+	if size < int64(chunkSize) {
+		// Chunk sizes are rounded up to a multiple of the minimum anyway.
+		chunks := size/googleapi.MinUploadChunkSize + 1
+		chunkSize = int(chunks * googleapi.MinUploadChunkSize)
+	}
+	return b.upload(ctx, repoID, objID, r, chunkSize)
+}
+
+func (b *gcsBackend) upload(ctx context.Context, repoID string, objID string, r io.Reader, chunkSize int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	writer := b.object(repoID, objID).NewWriter(ctx)
+	writer.ChunkSize = chunkSize
+	_, err := b.buffers.copy(ctx, writer, r)
+	if err != nil {
+		cancel()
+		writer.Close()
+		return err
+	}
+
+	return mapGCSError(writer.Close())
+}
+
+func (b *gcsBackend) exists(repoID string, objID string) (bool, error) {
+	_, err := b.stat(repoID, objID)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotExist) {
+			return false, nil
+		}
+		return false, existsError(err)
+	}
+	return true, nil
+}
+
+func (b *gcsBackend) existsMany(repoID string, objIDs []string) (map[string]bool, error) {
+	return existsConcurrently(objIDs, gcsExistsWorkers, func(objID string) (bool, error) {
+		return b.exists(repoID, objID)
+	})
+}
+
+func (b *gcsBackend) stat(repoID string, objID string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gcsRPCTimeout)
+	defer cancel()
+	return b.statCtx(ctx, repoID, objID)
+}
+
+func (b *gcsBackend) statCtx(ctx context.Context, repoID string, objID string) (int64, error) {
+	attrs, err := b.object(repoID, objID).Attrs(ctx)
+	if err != nil {
+		return -1, mapGCSError(err)
+	}
+	return attrs.Size, nil
+}
+
+func (b *gcsBackend) delete(repoID string, objID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), gcsRPCTimeout)
+	defer cancel()
+
+	err := b.object(repoID, objID).Delete(ctx)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return mapGCSError(err)
+	}
+	return nil
+}
+
+func (b *gcsBackend) copy(srcRepoID string, dstRepoID string, objID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), gcsRPCTimeout)
+	defer cancel()
+
+	_, err := b.object(dstRepoID, objID).CopierFrom(b.object(srcRepoID, objID)).Run(ctx)
+	return mapGCSError(err)
+}
+
+func (b *gcsBackend) list(repoID string, fn func(objID string) error) error {
+	prefix := b.prefix + repoID + "/"
+	it := b.bucket.Objects(context.Background(), &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return mapGCSError(err)
+		}
+		if err := fn(strings.TrimPrefix(attrs.Name, prefix)); err != nil {
+			return err
+		}
+	}
+}
+
+// listPage uses the page token of GCS as the page token.
+func (b *gcsBackend) listPage(repoID string, token string, limit int) ([]string, string, error) {
+	prefix := b.prefix + repoID + "/"
+	ctx, cancel := context.WithTimeout(context.Background(), gcsRPCTimeout)
+	defer cancel()
+
+	it := b.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	var page []*storage.ObjectAttrs
+	nextToken, err := iterator.NewPager(it, limit, token).NextPage(&page)
+	if err != nil {
+		return nil, "", mapGCSError(err)
+	}
+
+	objIDs := make([]string, 0, len(page))
+	for _, attrs := range page {
+		objIDs = append(objIDs, strings.TrimPrefix(attrs.Name, prefix))
+	}
+	return objIDs, nextToken, nil
+}
+
+func (b *gcsBackend) close() error {
+	return b.client.Close()
+}
+
+func (b *gcsBackend) healthCheck(ctx context.Context) error {
+	_, err := b.bucket.Attrs(ctx)
+	if err != nil {
+		return existsError(mapGCSError(err))
+	}
+	return nil
+}
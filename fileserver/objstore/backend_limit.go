@@ -0,0 +1,103 @@
+// Implementation of limiting concurrent backend operations.
+package objstore
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/semaphore"
+)
+
+// limitingBackend caps the number of concurrent operations on a backend.
+// Operations over the cap wait for a slot instead of failing; reads and
+// writes stop waiting with ctx.Err() when their context is done.
+type limitingBackend struct {
+	storageBackend
+	sem      *semaphore.Weighted
+	inflight prometheus.Gauge
+	wait     prometheus.Counter
+}
+
+func newLimitingBackend(backend storageBackend, maxOps int64, objType string) *limitingBackend {
+	b := new(limitingBackend)
+	b.storageBackend = backend
+	b.sem = semaphore.NewWeighted(maxOps)
+	b.inflight = inflightOps.WithLabelValues(objType)
+	b.wait = limitWait.WithLabelValues(objType)
+	return b
+}
+
+func (b *limitingBackend) unwrap() []storageBackend {
+	return []storageBackend{b.storageBackend}
+}
+
+// acquire waits for a slot, which must be given back with release.
+func (b *limitingBackend) acquire(ctx context.Context) error {
+	start := time.Now()
+	err := b.sem.Acquire(ctx, 1)
+	b.wait.Add(time.Since(start).Seconds())
+	if err != nil {
+		return err
+	}
+	b.inflight.Inc()
+	return nil
+}
+
+func (b *limitingBackend) release() {
+	b.inflight.Dec()
+	b.sem.Release(1)
+}
+
+func (b *limitingBackend) read(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	if err := b.acquire(ctx); err != nil {
+		return err
+	}
+	defer b.release()
+	return b.storageBackend.read(ctx, repoID, objID, w)
+}
+
+func (b *limitingBackend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	if err := b.acquire(ctx); err != nil {
+		return err
+	}
+	defer b.release()
+	return b.storageBackend.write(ctx, repoID, objID, r, sync)
+}
+
+func (b *limitingBackend) writeSized(ctx context.Context, repoID string, objID string, r io.Reader, size int64, sync bool) error {
+	if err := b.acquire(ctx); err != nil {
+		return err
+	}
+	defer b.release()
+	return writeSizedTo(ctx, b.storageBackend, repoID, objID, r, size, sync)
+}
+
+func (b *limitingBackend) exists(repoID string, objID string) (bool, error) {
+	if err := b.acquire(context.Background()); err != nil {
+		return false, err
+	}
+	defer b.release()
+	return b.storageBackend.exists(repoID, objID)
+}
+
+func (b *limitingBackend) stat(repoID string, objID string) (int64, error) {
+	if err := b.acquire(context.Background()); err != nil {
+		return -1, err
+	}
+	defer b.release()
+	return b.storageBackend.stat(repoID, objID)
+}
+
+func (b *limitingBackend) delete(repoID string, objID string) error {
+	if err := b.acquire(context.Background()); err != nil {
+		return err
+	}
+	defer b.release()
+	return b.storageBackend.delete(repoID, objID)
+}
+
+func (b *limitingBackend) transparentFor(op string) bool {
+	return true
+}
@@ -0,0 +1,183 @@
+// Implementation of an in-memory backend, for tests.
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemBackend keeps objects in memory, keyed by repo and object ID. It's a
+// test double for the packages built on the object store, so their tests
+// need neither a data directory nor a hand-written mock. It's safe for
+// concurrent use.
+//
+// Failures can be injected with FailOn, so error handling paths can be
+// tested deterministically.
+type MemBackend struct {
+	lock    sync.Mutex
+	objects map[string][]byte
+	calls   map[string]int
+	fails   map[string]memFailure
+}
+
+// memFailure makes the call of an operation numbered n fail with err.
+type memFailure struct {
+	n   int
+	err error
+}
+
+// NewMemBackend returns an empty in-memory backend.
+func NewMemBackend() *MemBackend {
+	b := new(MemBackend)
+	b.objects = make(map[string][]byte)
+	b.calls = make(map[string]int)
+	b.fails = make(map[string]memFailure)
+	return b
+}
+
+// NewMemStore returns an object store for objType backed by a new
+// MemBackend.
+func NewMemStore(objType string) *ObjectStore {
+	return NewMemBackend().Store(objType)
+}
+
+// Store returns an object store for objType backed by b. Stores of the same
+// backend share their objects.
+func (b *MemBackend) Store(objType string) *ObjectStore {
+	obj := new(ObjectStore)
+	obj.ObjType = objType
+	obj.backendType = "memory"
+	obj.metrics = newStoreMetrics(objType)
+	obj.maxReadBytes = defaultMaxReadBytes
+	obj.backend = b
+	return obj
+}
+
+// FailOn makes the nth call of op from now on fail with err, where op is
+// one of "read", "write", "exists", "stat", "delete" or "list" and n starts
+// at 1. A failed write stores nothing. Only the latest failure set for an
+// op is kept, and a nil err clears it.
+func (b *MemBackend) FailOn(op string, n int, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if err == nil {
+		delete(b.fails, op)
+		return
+	}
+	b.fails[op] = memFailure{b.calls[op] + n, err}
+}
+
+// Len returns the number of objects stored.
+func (b *MemBackend) Len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.objects)
+}
+
+// call counts a call of op and returns the error injected for it, if any.
+// The caller must hold the lock.
+func (b *MemBackend) call(op string) error {
+	b.calls[op]++
+	if f, ok := b.fails[op]; ok && f.n == b.calls[op] {
+		delete(b.fails, op)
+		return f.err
+	}
+	return nil
+}
+
+func (b *MemBackend) read(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	b.lock.Lock()
+	err := b.call("read")
+	data, ok := b.objects[cacheKey(repoID, objID)]
+	b.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrObjectNotExist
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (b *MemBackend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	var buf bytes.Buffer
+	if _, err := copyCtx(ctx, &buf, r); err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err := b.call("write"); err != nil {
+		return err
+	}
+	b.objects[cacheKey(repoID, objID)] = buf.Bytes()
+	return nil
+}
+
+func (b *MemBackend) exists(repoID string, objID string) (bool, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err := b.call("exists"); err != nil {
+		return false, err
+	}
+	_, ok := b.objects[cacheKey(repoID, objID)]
+	return ok, nil
+}
+
+func (b *MemBackend) stat(repoID string, objID string) (int64, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err := b.call("stat"); err != nil {
+		return -1, err
+	}
+	data, ok := b.objects[cacheKey(repoID, objID)]
+	if !ok {
+		return -1, ErrObjectNotExist
+	}
+	return int64(len(data)), nil
+}
+
+func (b *MemBackend) delete(repoID string, objID string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err := b.call("delete"); err != nil {
+		return err
+	}
+	delete(b.objects, cacheKey(repoID, objID))
+	return nil
+}
+
+// list calls fn in order of object ID, without holding the lock, so fn may
+// use the backend.
+func (b *MemBackend) list(repoID string, fn func(objID string) error) error {
+	b.lock.Lock()
+	err := b.call("list")
+	var ids []string
+	prefix := repoID + "/"
+	for key := range b.objects {
+		if strings.HasPrefix(key, prefix) {
+			ids = append(ids, key[len(prefix):])
+		}
+	}
+	b.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(ids)
+	for _, id := range ids {
+		if err := fn(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+// Implementation of caching of missing objects.
+package objstore
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// defaultNegativeCacheTTL is how long an object is remembered as missing if
+// negative_cache_ttl isn't set.
+const defaultNegativeCacheTTL = 10 * time.Second
+
+// negativeCachingBackend remembers objects found missing by exists() for a
+// short while, so a sync checking the same missing objects again doesn't
+// stat them every time. Objects are forgotten as soon as they're written.
+type negativeCachingBackend struct {
+	storageBackend
+	capacity int
+	ttl      time.Duration
+
+	lock    sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	// writes counts completed writes. A miss is only recorded if no write
+	// completed while it was checked, as it may be of the same object.
+	writes uint64
+}
+
+type negativeEntry struct {
+	key     string
+	expires time.Time
+}
+
+// negativeCacheFromConfig wraps backend with a cache of up to
+// negative_cache_size missing objects of the store section, which are
+// remembered for negative_cache_ttl. The cache is disabled by default.
+//
+//	[store]
+//	negative_cache_size = 100000
+//	negative_cache_ttl = 10s
+func negativeCacheFromConfig(config *ini.File, backend storageBackend) (storageBackend, error) {
+	sizeStr := configValue(config, "store", "negative_cache_size")
+	if sizeStr == "" {
+		return backend, nil
+	}
+	size, err := strconv.Atoi(sizeStr)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid negative_cache_size of store: %s", sizeStr)
+	}
+	if size == 0 {
+		return backend, nil
+	}
+
+	ttl := defaultNegativeCacheTTL
+	if ttlStr := configValue(config, "store", "negative_cache_ttl"); ttlStr != "" {
+		ttl, err = time.ParseDuration(ttlStr)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid negative_cache_ttl of store: %s", ttlStr)
+		}
+	}
+	return newNegativeCachingBackend(backend, size, ttl), nil
+}
+
+func newNegativeCachingBackend(backend storageBackend, capacity int, ttl time.Duration) *negativeCachingBackend {
+	b := new(negativeCachingBackend)
+	b.storageBackend = backend
+	b.capacity = capacity
+	b.ttl = ttl
+	b.lru = list.New()
+	b.entries = make(map[string]*list.Element)
+	return b
+}
+
+func (b *negativeCachingBackend) unwrap() []storageBackend {
+	return []storageBackend{b.storageBackend}
+}
+
+// missing reports whether the object is remembered as missing.
+func (b *negativeCachingBackend) missing(key string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	elem, ok := b.entries[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(elem.Value.(*negativeEntry).expires) {
+		b.lru.Remove(elem)
+		delete(b.entries, key)
+		return false
+	}
+	return true
+}
+
+// addMissing remembers the object as missing unless a write completed since
+// the writes counter was read.
+func (b *negativeCachingBackend) addMissing(key string, writes uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.writes != writes {
+		return
+	}
+	if elem, ok := b.entries[key]; ok {
+		b.lru.Remove(elem)
+	}
+	b.entries[key] = b.lru.PushFront(&negativeEntry{key, time.Now().Add(b.ttl)})
+	for b.lru.Len() > b.capacity {
+		entry := b.lru.Remove(b.lru.Back()).(*negativeEntry)
+		delete(b.entries, entry.key)
+	}
+}
+
+func (b *negativeCachingBackend) forget(key string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.writes++
+	if elem, ok := b.entries[key]; ok {
+		b.lru.Remove(elem)
+		delete(b.entries, key)
+	}
+}
+
+func (b *negativeCachingBackend) exists(repoID string, objID string) (bool, error) {
+	key := cacheKey(repoID, objID)
+	if b.missing(key) {
+		return false, nil
+	}
+
+	b.lock.Lock()
+	writes := b.writes
+	b.lock.Unlock()
+
+	ret, err := b.storageBackend.exists(repoID, objID)
+	if err == nil && !ret {
+		b.addMissing(key, writes)
+	}
+	return ret, err
+}
+
+// existsMany answers for the objects remembered as missing, and checks the
+// others in a batch, remembering the ones found missing.
+func (b *negativeCachingBackend) existsMany(repoID string, objIDs []string) (map[string]bool, error) {
+	res := make(map[string]bool, len(objIDs))
+	unknown := make([]string, 0, len(objIDs))
+	for _, objID := range objIDs {
+		if b.missing(cacheKey(repoID, objID)) {
+			res[objID] = false
+		} else {
+			unknown = append(unknown, objID)
+		}
+	}
+	if len(unknown) == 0 {
+		return res, nil
+	}
+
+	b.lock.Lock()
+	writes := b.writes
+	b.lock.Unlock()
+
+	found, err := existsManyBackend(b.storageBackend, repoID, unknown)
+	for _, objID := range unknown {
+		res[objID] = found[objID]
+		if err == nil && !found[objID] {
+			b.addMissing(cacheKey(repoID, objID), writes)
+		}
+	}
+	return res, err
+}
+
+// write forgets the object once it's written, even if the write fails, as
+// it may be partly done.
+func (b *negativeCachingBackend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	defer b.forget(cacheKey(repoID, objID))
+	return b.storageBackend.write(ctx, repoID, objID, r, sync)
+}
+
+func (b *negativeCachingBackend) writeSized(ctx context.Context, repoID string, objID string, r io.Reader, size int64, sync bool) error {
+	defer b.forget(cacheKey(repoID, objID))
+	return writeSizedTo(ctx, b.storageBackend, repoID, objID, r, size, sync)
+}
+
+// copy and move forget the destination object like write, which they
+// create.
+func (b *negativeCachingBackend) copy(srcRepoID string, dstRepoID string, objID string) error {
+	defer b.forget(cacheKey(dstRepoID, objID))
+	return copyBackend(b.storageBackend, srcRepoID, dstRepoID, objID)
+}
+
+func (b *negativeCachingBackend) move(srcRepoID string, dstRepoID string, objID string) error {
+	defer b.forget(cacheKey(dstRepoID, objID))
+	return moveBackend(b.storageBackend, srcRepoID, dstRepoID, objID)
+}
+
+func (b *negativeCachingBackend) writeWithTTL(ctx context.Context, repoID string, objID string, r io.Reader, expires time.Time) error {
+	ttl := ttlBackend(b.storageBackend)
+	if ttl == nil {
+		return fmt.Errorf("objects with TTL: %w", ErrNotSupported)
+	}
+	defer b.forget(cacheKey(repoID, objID))
+	return ttl.writeWithTTL(ctx, repoID, objID, r, expires)
+}
+
+// purgeExpired needs no forgetting, as only objects found existing are
+// purged.
+func (b *negativeCachingBackend) purgeExpired(repoID string, now time.Time) (int, error) {
+	ttl := ttlBackend(b.storageBackend)
+	if ttl == nil {
+		return 0, nil
+	}
+	return ttl.purgeExpired(repoID, now)
+}
+
+// transparentFor reports that listing pages and summing up a repo don't
+// change which objects are missing.
+func (b *negativeCachingBackend) transparentFor(op string) bool {
+	return op == "list_page" || op == "repo_stats"
+}
@@ -0,0 +1,171 @@
+// Implementation of rate limiting backend operations.
+package objstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+	"gopkg.in/ini.v1"
+)
+
+// rateLimitedBackend bounds the rate of writes, and optionally reads, to a
+// backend with token buckets of operations and of bytes per second, so
+// bursts stay within the limits of object stores which throttle requests.
+// Operations over the limit wait, until their context is done for reads and
+// writes; a burst of one second worth of operations or bytes is allowed.
+type rateLimitedBackend struct {
+	storageBackend
+	writeOps   *rate.Limiter
+	writeBytes *rate.Limiter
+	readOps    *rate.Limiter
+	readBytes  *rate.Limiter
+	writeWait  prometheus.Counter
+	readWait   prometheus.Counter
+}
+
+// rateLimitFromConfig wraps backend with the rate limits of the store
+// section. Operations are limited per second, and bytes per second are
+// given as sizes such as "50MB":
+//
+//	[store]
+//	write_rate_limit = 100
+//	write_bytes_rate_limit = 50MB
+//	read_rate_limit = 500
+//	read_bytes_rate_limit = 200MB
+//
+// backend is returned as is if no limit is set.
+func rateLimitFromConfig(config *ini.File, objType string, backend storageBackend) (storageBackend, error) {
+	b := &rateLimitedBackend{storageBackend: backend}
+	limits := []struct {
+		key     string
+		limiter **rate.Limiter
+		size    bool
+	}{
+		{"write_rate_limit", &b.writeOps, false},
+		{"write_bytes_rate_limit", &b.writeBytes, true},
+		{"read_rate_limit", &b.readOps, false},
+		{"read_bytes_rate_limit", &b.readBytes, true},
+	}
+	limited := false
+	for _, l := range limits {
+		str := configValue(config, "store", l.key)
+		if str == "" {
+			continue
+		}
+		var limit int64
+		var err error
+		if l.size {
+			limit, err = parseSize(str)
+		} else {
+			limit, err = strconv.ParseInt(str, 10, 64)
+		}
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid %s of store: %s", l.key, str)
+		}
+		*l.limiter = rate.NewLimiter(rate.Limit(limit), int(limit))
+		limited = true
+	}
+	if !limited {
+		return backend, nil
+	}
+	b.writeWait = rateLimitWait.WithLabelValues(objType, "write")
+	b.readWait = rateLimitWait.WithLabelValues(objType, "read")
+	return b, nil
+}
+
+func (b *rateLimitedBackend) unwrap() []storageBackend {
+	return []storageBackend{b.storageBackend}
+}
+
+// waitN takes n tokens from limiter, which may be nil for no limit, and
+// adds the time waited to wait. Requests larger than the burst are split.
+func waitN(ctx context.Context, limiter *rate.Limiter, n int, wait prometheus.Counter) error {
+	if limiter == nil {
+		return nil
+	}
+	start := time.Now()
+	defer func() {
+		wait.Add(time.Since(start).Seconds())
+	}()
+	for n > 0 {
+		chunk := n
+		if burst := limiter.Burst(); chunk > burst {
+			chunk = burst
+		}
+		if err := limiter.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+func (b *rateLimitedBackend) read(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	if err := waitN(ctx, b.readOps, 1, b.readWait); err != nil {
+		return err
+	}
+	if b.readBytes != nil {
+		w = &rateLimitedWriter{ctx, w, b.readBytes, b.readWait}
+	}
+	return b.storageBackend.read(ctx, repoID, objID, w)
+}
+
+func (b *rateLimitedBackend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	if err := waitN(ctx, b.writeOps, 1, b.writeWait); err != nil {
+		return err
+	}
+	if b.writeBytes != nil {
+		r = &rateLimitedReader{ctx, r, b.writeBytes, b.writeWait}
+	}
+	return b.storageBackend.write(ctx, repoID, objID, r, sync)
+}
+
+func (b *rateLimitedBackend) writeSized(ctx context.Context, repoID string, objID string, r io.Reader, size int64, sync bool) error {
+	if err := waitN(ctx, b.writeOps, 1, b.writeWait); err != nil {
+		return err
+	}
+	if b.writeBytes != nil {
+		r = &rateLimitedReader{ctx, r, b.writeBytes, b.writeWait}
+	}
+	return writeSizedTo(ctx, b.storageBackend, repoID, objID, r, size, sync)
+}
+
+// rateLimitedReader takes a token of limiter for every byte read.
+type rateLimitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+	wait    prometheus.Counter
+}
+
+func (l *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if werr := waitN(l.ctx, l.limiter, n, l.wait); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+// rateLimitedWriter takes a token of limiter for every byte written.
+type rateLimitedWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter *rate.Limiter
+	wait    prometheus.Counter
+}
+
+func (l *rateLimitedWriter) Write(p []byte) (int, error) {
+	if err := waitN(l.ctx, l.limiter, len(p), l.wait); err != nil {
+		return 0, err
+	}
+	return l.w.Write(p)
+}
+
+func (b *rateLimitedBackend) transparentFor(op string) bool {
+	return true
+}
@@ -0,0 +1,100 @@
+// Implementation of read-after-write checks of eventually consistent backends.
+package objstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+
+	"gopkg.in/ini.v1"
+)
+
+// defaultReadbackAttempts is the number of exists checks made after a
+// write if write_readback_attempts isn't set.
+const defaultReadbackAttempts = 5
+
+// readbackBackend checks that every written object is visible before the
+// write returns, as Seafile reads objects right after writing them. Object
+// stores that are only eventually consistent may not list or serve a new
+// object for a short while, so the check is retried with backoff.
+type readbackBackend struct {
+	storageBackend
+	maxAttempts int
+}
+
+// readbackFromConfig wraps backend with read-after-write checks if
+// verify_write_readback of the store section is true:
+//
+//	[store]
+//	verify_write_readback = true
+//	write_readback_attempts = 5
+//
+// Objects written to a file system are visible once renamed into place, so
+// backends of type fs are returned as is.
+func readbackFromConfig(config *ini.File, backendType string, backend storageBackend) (storageBackend, error) {
+	verifyStr := configValue(config, "store", "verify_write_readback")
+	if verifyStr == "" {
+		return backend, nil
+	}
+	verify, err := strconv.ParseBool(verifyStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid verify_write_readback of store: %w", err)
+	}
+	if !verify || backendType == "fs" {
+		return backend, nil
+	}
+
+	attempts := defaultReadbackAttempts
+	if attemptsStr := configValue(config, "store", "write_readback_attempts"); attemptsStr != "" {
+		attempts, err = strconv.Atoi(attemptsStr)
+		if err != nil || attempts <= 0 {
+			return nil, fmt.Errorf("invalid write_readback_attempts of store: %s", attemptsStr)
+		}
+	}
+	return &readbackBackend{backend, attempts}, nil
+}
+
+func (b *readbackBackend) unwrap() []storageBackend {
+	return []storageBackend{b.storageBackend}
+}
+
+func (b *readbackBackend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	if err := b.storageBackend.write(ctx, repoID, objID, r, sync); err != nil {
+		return err
+	}
+	return b.waitVisible(ctx, repoID, objID)
+}
+
+func (b *readbackBackend) writeSized(ctx context.Context, repoID string, objID string, r io.Reader, size int64, sync bool) error {
+	if err := writeSizedTo(ctx, b.storageBackend, repoID, objID, r, size, sync); err != nil {
+		return err
+	}
+	return b.waitVisible(ctx, repoID, objID)
+}
+
+// waitVisible checks that an object exists up to maxAttempts times. It
+// fails with ErrBackendUnavailable if the object never shows up.
+func (b *readbackBackend) waitVisible(ctx context.Context, repoID string, objID string) error {
+	for attempt := 0; attempt < b.maxAttempts; attempt++ {
+		if attempt > 0 {
+			if err := backoff(ctx, attempt-1); err != nil {
+				return err
+			}
+		}
+		exists, err := b.storageBackend.exists(repoID, objID)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return nil
+		}
+	}
+	return &Error{ErrBackendUnavailable, fmt.Errorf("object %s of repo %s isn't visible after %d checks of the write", objID, repoID, b.maxAttempts)}
+}
+
+// transparentFor reports that other operations than writes don't need to be
+// checked.
+func (b *readbackBackend) transparentFor(op string) bool {
+	return true
+}
@@ -0,0 +1,258 @@
+// Implementation of retrying transient backend errors.
+package objstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const (
+	retryBaseDelay = 100 * time.Millisecond
+	retryMaxDelay  = 5 * time.Second
+)
+
+// errNotRewindable stops retrying a write which consumed part of content
+// that can't be rewound. It's never returned, the error of the failed
+// attempt is.
+var errNotRewindable = errors.New("can't retry write: content is partially consumed")
+
+// retryingBackend retries operations failed with transient errors,
+// waiting an exponentially growing, jittered delay between attempts.
+type retryingBackend struct {
+	storageBackend
+	maxAttempts int
+}
+
+func newRetryingBackend(backend storageBackend, maxRetries int) *retryingBackend {
+	retry := new(retryingBackend)
+	retry.storageBackend = backend
+	retry.maxAttempts = maxRetries + 1
+	return retry
+}
+
+func (b *retryingBackend) unwrap() []storageBackend {
+	return []storageBackend{b.storageBackend}
+}
+
+// IsRetryable reports whether err is a transient error, such as a
+// connection reset or a 5xx response, that may succeed if retried.
+// Missing objects, permission errors, a full backend, content not matching
+// the size of a sized write and canceled contexts are not retryable.
+func IsRetryable(err error) bool {
+	// A timeout of the store wraps context.DeadlineExceeded, but unlike the
+	// deadline of the caller it only bounds a single attempt.
+	if errors.Is(err, ErrBackendTimeout) {
+		return true
+	}
+	if err == nil || errors.Is(err, ErrObjectNotExist) || errors.Is(err, ErrPermission) ||
+		errors.Is(err, ErrNoSpace) || errors.Is(err, ErrSizeMismatch) || isCallerError(err) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, ErrBackendUnavailable) {
+		return true
+	}
+
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		return reqErr.StatusCode() >= http.StatusInternalServerError ||
+			reqErr.StatusCode() == http.StatusTooManyRequests
+	}
+	if request.IsErrorRetryable(err) || request.IsErrorThrottle(err) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isCallerError reports whether err is caused by the request rather than
+// the backend, so it fails again however often it's retried.
+func isCallerError(err error) bool {
+	for _, target := range []error{ErrInvalidObjectID, ErrQuotaExceeded, ErrChecksumMismatch, ErrObjectTooLarge,
+		ErrOutOfRange, ErrNotSupported, ErrReadOnly} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff waits before the attempt-th retry, or returns ctx.Err() if ctx is done first.
+func backoff(ctx context.Context, attempt int) error {
+	delay := retryBaseDelay << uint(attempt)
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+	// Full jitter spreads out retries of concurrent requests.
+	delay = time.Duration(rand.Int63n(int64(delay)) + 1)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// do calls op until it succeeds, fails with a non-retryable error, or all attempts are used.
+func (b *retryingBackend) do(ctx context.Context, op func() error) error {
+	return b.doRewinding(ctx, op, nil)
+}
+
+// doRewinding is do calling rewind before each retry, to prepare the input
+// of op again. If rewind fails, e.g. with errNotRewindable, op isn't
+// retried and the error of the failed attempt is returned.
+func (b *retryingBackend) doRewinding(ctx context.Context, op func() error, rewind func() error) error {
+	var err error
+	for attempt := 0; attempt < b.maxAttempts; attempt++ {
+		if attempt > 0 {
+			if rewind != nil && rewind() != nil {
+				return err
+			}
+			if err := backoff(ctx, attempt-1); err != nil {
+				return err
+			}
+		}
+		err = op()
+		if !IsRetryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// skipWriter discards the first skip bytes written to it.
+// It lets a retried read resume after the bytes already passed to the caller.
+type skipWriter struct {
+	w       io.Writer
+	skip    int64
+	written int64
+}
+
+func (s *skipWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if s.skip > 0 {
+		if int64(n) <= s.skip {
+			s.skip -= int64(n)
+			return n, nil
+		}
+		p = p[s.skip:]
+		s.skip = 0
+	}
+	nw, err := s.w.Write(p)
+	s.written += int64(nw)
+	return n - len(p) + nw, err
+}
+
+func (b *retryingBackend) read(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	var written int64
+	return b.do(ctx, func() error {
+		sw := &skipWriter{w: w, skip: written}
+		err := b.storageBackend.read(ctx, repoID, objID, sw)
+		written += sw.written
+		return err
+	})
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (b *retryingBackend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	return b.rewinding(ctx, r, func(r io.Reader) error {
+		return b.storageBackend.write(ctx, repoID, objID, r, sync)
+	})
+}
+
+func (b *retryingBackend) writeSized(ctx context.Context, repoID string, objID string, r io.Reader, size int64, sync bool) error {
+	return b.rewinding(ctx, r, func(r io.Reader) error {
+		return writeSizedTo(ctx, b.storageBackend, repoID, objID, r, size, sync)
+	})
+}
+
+// rewinding retries write, rewinding r before each retry. A write which
+// consumed part of r isn't retried unless r is seekable, and returns its
+// own error.
+func (b *retryingBackend) rewinding(ctx context.Context, r io.Reader, write func(r io.Reader) error) error {
+	seeker, _ := r.(io.Seeker)
+	var start int64
+	if seeker != nil {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seeker = nil
+		}
+	}
+
+	cr := &countingReader{r: r}
+	rewind := func() error {
+		if cr.n == 0 {
+			return nil
+		}
+		// The content can only be sent again if r can be rewound.
+		if seeker == nil {
+			return errNotRewindable
+		}
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		cr.n = 0
+		return nil
+	}
+	return b.doRewinding(ctx, func() error {
+		return write(cr)
+	}, rewind)
+}
+
+func (b *retryingBackend) exists(repoID string, objID string) (bool, error) {
+	var res bool
+	err := b.do(context.Background(), func() error {
+		var err error
+		res, err = b.storageBackend.exists(repoID, objID)
+		return err
+	})
+	return res, err
+}
+
+func (b *retryingBackend) stat(repoID string, objID string) (int64, error) {
+	var size int64
+	err := b.do(context.Background(), func() error {
+		var err error
+		size, err = b.storageBackend.stat(repoID, objID)
+		return err
+	})
+	return size, err
+}
+
+func (b *retryingBackend) delete(repoID string, objID string) error {
+	return b.do(context.Background(), func() error {
+		return b.storageBackend.delete(repoID, objID)
+	})
+}
+
+func (b *retryingBackend) transparentFor(op string) bool {
+	return true
+}
@@ -0,0 +1,155 @@
+// Implementation of routing repos to different storage backends.
+package objstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// routingBackend dispatches each operation to the backend owning the repo.
+// A repo is owned by the backend returned by the lookup function if set,
+// otherwise by the backend of the longest matching repo ID prefix in
+// routes, or by the default backend.
+//
+// It's configured with sub-backend options prefixed by their names:
+//
+//	[block_backend]
+//	type = routing
+//	default = hot
+//	routes = 0:cold, 1a:cold
+//	hot.type = fs
+//	cold.type = s3
+//	cold.bucket = seafile-cold
+type routingBackend struct {
+	backends    map[string]storageBackend
+	defaultName string
+
+	lock   sync.RWMutex
+	routes map[string]string
+	lookup func(repoID string) string
+}
+
+func init() {
+	RegisterBackend("routing", func(conf map[string]string) (storageBackend, error) {
+		backend, err := newRoutingBackend(conf)
+		if err != nil {
+			return nil, err
+		}
+		return backend, nil
+	})
+}
+
+func newRoutingBackend(conf map[string]string) (*routingBackend, error) {
+	backends, err := createSubBackends(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	backend := new(routingBackend)
+	backend.backends = backends
+	backend.defaultName = conf["default"]
+	if _, ok := backend.backends[backend.defaultName]; !ok {
+		return nil, fmt.Errorf("default backend %q of routing backend is not configured", backend.defaultName)
+	}
+	if err := backend.setRoutes(conf["routes"]); err != nil {
+		return nil, err
+	}
+
+	return backend, nil
+}
+
+// setRoutes replaces the repo ID prefix routes with routesStr,
+// a comma separated list of prefix:backend pairs.
+func (b *routingBackend) setRoutes(routesStr string) error {
+	routes := make(map[string]string)
+	for _, route := range strings.Split(routesStr, ",") {
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+		parts := strings.SplitN(route, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid route %q, it should be prefix:backend", route)
+		}
+		prefix, name := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if _, ok := b.backends[name]; !ok {
+			return fmt.Errorf("backend %q of route %q is not configured", name, route)
+		}
+		routes[prefix] = name
+	}
+
+	b.lock.Lock()
+	b.routes = routes
+	b.lock.Unlock()
+	return nil
+}
+
+func (b *routingBackend) setLookup(lookup func(repoID string) string) {
+	b.lock.Lock()
+	b.lookup = lookup
+	b.lock.Unlock()
+}
+
+// resolve returns the backend currently owning repoID.
+func (b *routingBackend) resolve(repoID string) storageBackend {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if b.lookup != nil {
+		if backend, ok := b.backends[b.lookup(repoID)]; ok {
+			return backend
+		}
+	}
+
+	name := b.defaultName
+	matched := -1
+	for prefix, routeName := range b.routes {
+		if len(prefix) > matched && strings.HasPrefix(repoID, prefix) {
+			name = routeName
+			matched = len(prefix)
+		}
+	}
+	return b.backends[name]
+}
+
+func (b *routingBackend) unwrap() []storageBackend {
+	names := make([]string, 0, len(b.backends))
+	for name := range b.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	backends := make([]storageBackend, 0, len(names))
+	for _, name := range names {
+		backends = append(backends, b.backends[name])
+	}
+	return backends
+}
+
+func (b *routingBackend) read(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	return b.resolve(repoID).read(ctx, repoID, objID, w)
+}
+
+func (b *routingBackend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	return b.resolve(repoID).write(ctx, repoID, objID, r, sync)
+}
+
+func (b *routingBackend) exists(repoID string, objID string) (bool, error) {
+	return b.resolve(repoID).exists(repoID, objID)
+}
+
+func (b *routingBackend) stat(repoID string, objID string) (int64, error) {
+	return b.resolve(repoID).stat(repoID, objID)
+}
+
+func (b *routingBackend) delete(repoID string, objID string) error {
+	return b.resolve(repoID).delete(repoID, objID)
+}
+
+func (b *routingBackend) list(repoID string, fn func(objID string) error) error {
+	return b.resolve(repoID).list(repoID, fn)
+}
@@ -0,0 +1,514 @@
+// Implementation of S3 compatible storage backend.
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	// s3ExistsWorkers is the number of concurrent HEAD requests of existsMany().
+	s3ExistsWorkers = 32
+	// s3DeleteBatchSize is the maximum number of keys of a DeleteObjects request.
+	s3DeleteBatchSize = 1000
+	// s3MaxPutSize is the size up to which objects of known size are
+	// uploaded with a single PutObject request.
+	s3MaxPutSize = 64 * 1024 * 1024
+)
+
+type s3Backend struct {
+	bucket   string
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	buffers  *bufferPool
+}
+
+func init() {
+	RegisterBackend("s3", func(conf map[string]string) (storageBackend, error) {
+		backend, err := newS3Backend(conf)
+		if err != nil {
+			return nil, err
+		}
+		return backend, nil
+	})
+}
+
+// newS3Backend creates a S3 backend from a backend section of seafile.conf:
+//
+//	[block_backend]
+//	type = s3
+//	bucket = seafile-blocks
+//	key_id = <access key>
+//	key = <secret key>
+//	host = minio.example.com:9000
+//	aws_region = us-east-1
+//	path_style_request = true
+//	use_https = true
+//	part_size = 16MB
+//	upload_concurrency = 5
+//
+// host is optional and defaults to the AWS endpoint of aws_region.
+// Objects larger than part_size are uploaded in parts, with at most
+// upload_concurrency parts uploaded concurrently.
+func newS3Backend(conf map[string]string) (*s3Backend, error) {
+	bucket := conf["bucket"]
+	if bucket == "" {
+		return nil, fmt.Errorf("bucket of s3 backend must be specified")
+	}
+
+	region := conf["aws_region"]
+	if region == "" {
+		region = "us-east-1"
+	}
+	awsConf := aws.NewConfig().WithRegion(region)
+
+	if conf["key_id"] != "" || conf["key"] != "" {
+		awsConf = awsConf.WithCredentials(credentials.NewStaticCredentials(conf["key_id"], conf["key"], ""))
+	}
+	if host := conf["host"]; host != "" {
+		scheme := "https://"
+		if useHTTPS, err := strconv.ParseBool(conf["use_https"]); err == nil && !useHTTPS {
+			scheme = "http://"
+		}
+		awsConf = awsConf.WithEndpoint(scheme + host)
+	}
+	if pathStyle, err := strconv.ParseBool(conf["path_style_request"]); err == nil {
+		awsConf = awsConf.WithS3ForcePathStyle(pathStyle)
+	}
+
+	sess, err := session.NewSession(awsConf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 session: %w", err)
+	}
+
+	partSize := int64(s3manager.DefaultUploadPartSize)
+	if partSizeStr := conf["part_size"]; partSizeStr != "" {
+		partSize, err = parseSize(partSizeStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid part_size of s3 backend: %w", err)
+		}
+		if partSize < s3manager.MinUploadPartSize {
+			return nil, fmt.Errorf("part_size of s3 backend must be at least %d bytes", s3manager.MinUploadPartSize)
+		}
+	}
+	concurrency := s3manager.DefaultUploadConcurrency
+	if concurrencyStr := conf["upload_concurrency"]; concurrencyStr != "" {
+		concurrency, err = strconv.Atoi(concurrencyStr)
+		if err != nil || concurrency <= 0 {
+			return nil, fmt.Errorf("invalid upload_concurrency of s3 backend: %s", concurrencyStr)
+		}
+	}
+
+	buffers, err := bufferPoolFromConf(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	backend := new(s3Backend)
+	backend.bucket = bucket
+	backend.buffers = buffers
+	backend.client = s3.New(sess)
+	backend.uploader = s3manager.NewUploaderWithClient(backend.client, func(u *s3manager.Uploader) {
+		u.PartSize = partSize
+		u.Concurrency = concurrency
+		// Abort the multipart upload if any part fails, so no orphaned parts are left.
+		u.LeavePartsOnError = false
+	})
+	return backend, nil
+}
+
+func (b *s3Backend) key(repoID string, objID string) *string {
+	return aws.String(repoID + "/" + objID)
+}
+
+// isS3NotFound checks whether err means the key doesn't exist.
+func isS3NotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchBucket {
+		return false
+	}
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusNotFound {
+		return true
+	}
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return true
+	}
+	return false
+}
+
+// mapS3Error maps a S3 error onto the errors of this package.
+func mapS3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	if isS3NotFound(err) {
+		return ErrObjectNotExist
+	}
+
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		switch code := reqErr.StatusCode(); {
+		case code == http.StatusUnauthorized || code == http.StatusForbidden:
+			return &Error{ErrPermission, err}
+		case code >= http.StatusInternalServerError:
+			return &Error{ErrBackendUnavailable, err}
+		}
+		return err
+	}
+	// Requests that never got a response, e.g. connection refused.
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.ErrCodeRequestError {
+		return &Error{ErrBackendUnavailable, err}
+	}
+	return err
+}
+
+func (b *s3Backend) read(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    b.key(repoID, objID),
+	}
+	output, err := b.client.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return mapS3Error(err)
+	}
+	defer output.Body.Close()
+
+	_, err = b.buffers.copy(ctx, w, output.Body)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// open returns the body of a GetObject response.
+func (b *s3Backend) open(ctx context.Context, repoID string, objID string) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    b.key(repoID, objID),
+	}
+	output, err := b.client.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return nil, mapS3Error(err)
+	}
+	return output.Body, nil
+}
+
+// write uploads small objects with a single PutObject. Larger objects are
+// split into parts which are uploaded concurrently, then the multipart
+// upload is completed, or aborted if any part fails.
+func (b *s3Backend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(b.bucket),
+		Key:    b.key(repoID, objID),
+		Body:   r,
+	}
+	_, err := b.uploader.UploadWithContext(ctx, input)
+	if err != nil {
+		return mapS3Error(err)
+	}
+
+	return nil
+}
+
+// writeSized uploads objects up to s3MaxPutSize with a single PutObject
+// request. The content is read into a buffer of its exact size, as the
+// request body must be seekable to be signed.
+func (b *s3Backend) writeSized(ctx context.Context, repoID string, objID string, r io.Reader, size int64, sync bool) error {
+	if size > s3MaxPutSize {
+		return b.write(ctx, repoID, objID, r, sync)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	// Reach the end of r so content longer than size is reported.
+	if _, err := copyCtx(ctx, ioutil.Discard, r); err != nil {
+		return err
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(b.bucket),
+		Key:           b.key(repoID, objID),
+		Body:          bytes.NewReader(data),
+		ContentLength: aws.Int64(size),
+	}
+	_, err := b.client.PutObjectWithContext(ctx, input)
+	return mapS3Error(err)
+}
+
+// writeIfAbsent uploads objects up to s3MaxPutSize with a conditional
+// PutObject request, which S3 rejects with 412 Precondition Failed if the
+// key exists. Larger objects would need a multipart upload, so they're
+// only written if a HEAD request doesn't find them, which isn't atomic.
+func (b *s3Backend) writeIfAbsent(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) (bool, error) {
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(r, s3MaxPutSize+1))
+	if err != nil {
+		return false, err
+	}
+	if n > s3MaxPutSize {
+		_, err := b.head(ctx, repoID, objID)
+		if err == nil {
+			return false, nil
+		}
+		if !errors.Is(err, ErrObjectNotExist) {
+			return false, err
+		}
+		return true, b.write(ctx, repoID, objID, io.MultiReader(&buf, r), sync)
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(b.bucket),
+		Key:           b.key(repoID, objID),
+		Body:          bytes.NewReader(buf.Bytes()),
+		ContentLength: aws.Int64(n),
+	}
+	_, err = b.client.PutObjectWithContext(ctx, input,
+		request.WithSetRequestHeaders(map[string]string{"If-None-Match": "*"}))
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusPreconditionFailed {
+		return false, nil
+	}
+	if err != nil {
+		return false, mapS3Error(err)
+	}
+	return true, nil
+}
+
+func (b *s3Backend) head(ctx context.Context, repoID string, objID string) (*s3.HeadObjectOutput, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    b.key(repoID, objID),
+	}
+	output, err := b.client.HeadObjectWithContext(ctx, input)
+	if err != nil {
+		return nil, mapS3Error(err)
+	}
+	return output, nil
+}
+
+func (b *s3Backend) exists(repoID string, objID string) (bool, error) {
+	_, err := b.head(context.Background(), repoID, objID)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotExist) {
+			return false, nil
+		}
+		return false, existsError(err)
+	}
+	return true, nil
+}
+
+func (b *s3Backend) existsMany(repoID string, objIDs []string) (map[string]bool, error) {
+	return existsConcurrently(objIDs, s3ExistsWorkers, func(objID string) (bool, error) {
+		return b.exists(repoID, objID)
+	})
+}
+
+func (b *s3Backend) stat(repoID string, objID string) (int64, error) {
+	return b.statCtx(context.Background(), repoID, objID)
+}
+
+func (b *s3Backend) statCtx(ctx context.Context, repoID string, objID string) (int64, error) {
+	output, err := b.head(ctx, repoID, objID)
+	if err != nil {
+		return -1, err
+	}
+	return aws.Int64Value(output.ContentLength), nil
+}
+
+func (b *s3Backend) delete(repoID string, objID string) error {
+	input := &s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    b.key(repoID, objID),
+	}
+	_, err := b.client.DeleteObject(input)
+	if err != nil && !isS3NotFound(err) {
+		return mapS3Error(err)
+	}
+	return nil
+}
+
+// deleteMany deletes objects with DeleteObjects requests of up to
+// s3DeleteBatchSize keys. S3 reports missing keys as deleted.
+func (b *s3Backend) deleteMany(repoID string, objIDs []string) []error {
+	errs := make([]error, len(objIDs))
+	for start := 0; start < len(objIDs); start += s3DeleteBatchSize {
+		end := start + s3DeleteBatchSize
+		if end > len(objIDs) {
+			end = len(objIDs)
+		}
+
+		index := make(map[string]int, end-start)
+		objects := make([]*s3.ObjectIdentifier, 0, end-start)
+		for i := start; i < end; i++ {
+			key := b.key(repoID, objIDs[i])
+			index[*key] = i
+			objects = append(objects, &s3.ObjectIdentifier{Key: key})
+		}
+		input := &s3.DeleteObjectsInput{
+			Bucket: aws.String(b.bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		}
+		output, err := b.client.DeleteObjects(input)
+		if err != nil {
+			err = mapS3Error(err)
+			for i := start; i < end; i++ {
+				errs[i] = err
+			}
+			continue
+		}
+		for _, e := range output.Errors {
+			if i, ok := index[aws.StringValue(e.Key)]; ok {
+				errs[i] = fmt.Errorf("failed to delete object %s: %s: %s", objIDs[i], aws.StringValue(e.Code), aws.StringValue(e.Message))
+			}
+		}
+	}
+	return errs
+}
+
+func (b *s3Backend) list(repoID string, fn func(objID string) error) error {
+	prefix := repoID + "/"
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(prefix),
+	}
+	var fnErr error
+	err := b.client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if fnErr = fn(strings.TrimPrefix(aws.StringValue(obj.Key), prefix)); fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return mapS3Error(err)
+}
+
+// listPage uses the continuation token of S3 as the page token.
+func (b *s3Backend) listPage(repoID string, token string, limit int) ([]string, string, error) {
+	prefix := repoID + "/"
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(b.bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(int64(limit)),
+	}
+	if token != "" {
+		input.ContinuationToken = aws.String(token)
+	}
+	output, err := b.client.ListObjectsV2(input)
+	if err != nil {
+		return nil, "", mapS3Error(err)
+	}
+
+	objIDs := make([]string, 0, len(output.Contents))
+	for _, obj := range output.Contents {
+		objIDs = append(objIDs, strings.TrimPrefix(aws.StringValue(obj.Key), prefix))
+	}
+	if !aws.BoolValue(output.IsTruncated) {
+		return objIDs, "", nil
+	}
+	return objIDs, aws.StringValue(output.NextContinuationToken), nil
+}
+
+// deleteRepo deletes the objects of a repo page by page as they're listed,
+// with a DeleteObjects request per page.
+func (b *s3Backend) deleteRepo(repoID string) error {
+	prefix := repoID + "/"
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(prefix),
+	}
+	var deleteErr error
+	err := b.client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		objIDs := make([]string, 0, len(page.Contents))
+		for _, obj := range page.Contents {
+			objIDs = append(objIDs, strings.TrimPrefix(aws.StringValue(obj.Key), prefix))
+		}
+		deleteErr = deleteRepoObjects(b, repoID, objIDs)
+		return deleteErr == nil
+	})
+	if deleteErr != nil {
+		return deleteErr
+	}
+	return mapS3Error(err)
+}
+
+func (b *s3Backend) copy(srcRepoID string, dstRepoID string, objID string) error {
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(b.bucket),
+		CopySource: aws.String(url.PathEscape(b.bucket + "/" + *b.key(srcRepoID, objID))),
+		Key:        b.key(dstRepoID, objID),
+	}
+	_, err := b.client.CopyObject(input)
+	if err != nil {
+		return mapS3Error(err)
+	}
+	return nil
+}
+
+func (b *s3Backend) readRange(ctx context.Context, repoID string, objID string, offset int64, length int64, w io.Writer) error {
+	if length == 0 {
+		size, err := b.stat(repoID, objID)
+		if err != nil {
+			return err
+		}
+		return checkRange(objID, offset, size)
+	}
+
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		byteRange = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	}
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    b.key(repoID, objID),
+		Range:  aws.String(byteRange),
+	}
+	output, err := b.client.GetObjectWithContext(ctx, input)
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusRequestedRangeNotSatisfiable {
+			return rangeError(objID, offset, -1)
+		}
+		return mapS3Error(err)
+	}
+	defer output.Body.Close()
+
+	_, err = b.buffers.copy(ctx, w, output.Body)
+	return err
+}
+
+// healthCheck checks that the bucket is reachable with a HEAD request.
+func (b *s3Backend) healthCheck(ctx context.Context) error {
+	_, err := b.client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(b.bucket)})
+	if err != nil {
+		return existsError(mapS3Error(err))
+	}
+	return nil
+}
+
+// close closes the idle connections of the HTTP client.
+func (b *s3Backend) close() error {
+	if client := b.client.Config.HTTPClient; client != nil {
+		client.CloseIdleConnections()
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+// Implementation of spreading objects across multiple file system roots.
+package objstore
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// shardedBackend spreads objects across several file system roots, e.g.
+// one per mounted disk:
+//
+//	[block_backend]
+//	type = sharded
+//	roots = /mnt/disk1/seafile-data, /mnt/disk2/seafile-data
+//
+// Each object is assigned to roots by rendezvous hashing: every root is
+// ranked by a hash of the root path and the object, and the object is
+// written to the highest ranked root. The ranking of existing roots never
+// changes, so adding a root only moves the objects the new root wins,
+// roughly 1/n of them, and every other object stays where it is.
+//
+// Reads look for an object in roots in rank order, so objects assigned to
+// a newly added root are still found on their old root. They can then be
+// moved in the background at leisure: rebalancing is a matter of moving
+// each object to its highest ranked root, and it's safe to stop at any time.
+type shardedBackend struct {
+	roots   []string
+	shards  map[string]*fsBackend
+	objType string
+}
+
+func init() {
+	RegisterBackend("sharded", func(conf map[string]string) (storageBackend, error) {
+		backend, err := newShardedBackend(conf)
+		if err != nil {
+			return nil, err
+		}
+		return backend, nil
+	})
+}
+
+func newShardedBackend(conf map[string]string) (*shardedBackend, error) {
+	backend := new(shardedBackend)
+	backend.shards = make(map[string]*fsBackend)
+	backend.objType = conf["obj_type"]
+	for _, root := range strings.Split(conf["roots"], ",") {
+		root = strings.TrimSpace(root)
+		if root == "" {
+			continue
+		}
+		if _, dup := backend.shards[root]; dup {
+			return nil, fmt.Errorf("root %s of sharded backend is duplicated", root)
+		}
+		// Every shard is an fs backend configured like the sharded one,
+		// with the root as its data directory.
+		shardConf := make(map[string]string, len(conf))
+		for k, v := range conf {
+			shardConf[k] = v
+		}
+		shardConf["data_dir"] = root
+		shard, err := newFSBackendFromConf(shardConf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create shard %s: %w", root, err)
+		}
+		backend.roots = append(backend.roots, root)
+		backend.shards[root] = shard
+	}
+	if len(backend.roots) == 0 {
+		return nil, fmt.Errorf("roots of sharded backend must be specified")
+	}
+
+	return backend, nil
+}
+
+func (b *shardedBackend) unwrap() []storageBackend {
+	backends := make([]storageBackend, 0, len(b.roots))
+	for _, root := range b.roots {
+		backends = append(backends, b.shards[root])
+	}
+	return backends
+}
+
+// rank returns the shards in the order an object should be looked for,
+// the first one is where it's written.
+func (b *shardedBackend) rank(repoID string, objID string) []*fsBackend {
+	type scored struct {
+		shard *fsBackend
+		score uint64
+	}
+	scores := make([]scored, 0, len(b.roots))
+	for _, root := range b.roots {
+		sum := sha1.Sum([]byte(root + "/" + repoID + "/" + objID))
+		scores = append(scores, scored{b.shards[root], binary.BigEndian.Uint64(sum[:8])})
+	}
+	sort.Slice(scores, func(i, j int) bool { return scores[i].score > scores[j].score })
+
+	shards := make([]*fsBackend, len(scores))
+	for i, s := range scores {
+		shards[i] = s.shard
+	}
+	return shards
+}
+
+// locate returns the highest ranked shard holding the object.
+func (b *shardedBackend) locate(repoID string, objID string) (*fsBackend, int64, error) {
+	for _, shard := range b.rank(repoID, objID) {
+		size, err := shard.stat(repoID, objID)
+		if err == nil {
+			return shard, size, nil
+		}
+		if !errors.Is(err, ErrObjectNotExist) {
+			return nil, -1, err
+		}
+	}
+	return nil, -1, ErrObjectNotExist
+}
+
+func (b *shardedBackend) read(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	shard, _, err := b.locate(repoID, objID)
+	if err != nil {
+		return err
+	}
+	return shard.read(ctx, repoID, objID, w)
+}
+
+func (b *shardedBackend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	return b.rank(repoID, objID)[0].write(ctx, repoID, objID, r, sync)
+}
+
+func (b *shardedBackend) exists(repoID string, objID string) (bool, error) {
+	_, _, err := b.locate(repoID, objID)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *shardedBackend) stat(repoID string, objID string) (int64, error) {
+	_, size, err := b.locate(repoID, objID)
+	return size, err
+}
+
+// delete removes the object from every root, including stale copies left by rebalancing.
+func (b *shardedBackend) delete(repoID string, objID string) error {
+	for _, root := range b.roots {
+		err := b.shards[root].delete(repoID, objID)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// list visits each object once, on the highest ranked root holding it.
+func (b *shardedBackend) list(repoID string, fn func(objID string) error) error {
+	for _, root := range b.roots {
+		shard := b.shards[root]
+		err := shard.list(repoID, func(objID string) error {
+			for _, ranked := range b.rank(repoID, objID) {
+				if ranked == shard {
+					return fn(objID)
+				}
+				if _, err := ranked.stat(repoID, objID); err == nil {
+					return nil
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
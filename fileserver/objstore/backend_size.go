@@ -0,0 +1,158 @@
+// Implementation of storing objects in backends chosen by their size.
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// sizeRoutingBackend writes objects smaller than threshold to its small
+// backend, usually a local file system where tiny fs and commit objects
+// don't cost a request each, and the others to its large backend. The size
+// of an object decides where it's written, and as objects are immutable
+// an object is always routed the same way, so no state is kept about where
+// objects are. Objects of unknown size are buffered in memory up to the
+// threshold to find out, and streamed to the large backend once it's
+// exceeded.
+//
+// Reads, exists and stat look up an object in the small backend first, as
+// misses there are cheap, and then in the large backend. If the threshold
+// is changed, objects written before are still found in the other backend.
+//
+//	[block_backend]
+//	type = size_routing
+//	threshold = 64KB
+//	small.type = fs
+//	large.type = s3
+//	large.bucket = seafile-blocks
+type sizeRoutingBackend struct {
+	small     storageBackend
+	large     storageBackend
+	threshold int64
+}
+
+func init() {
+	RegisterBackend("size_routing", func(conf map[string]string) (storageBackend, error) {
+		backend, err := newSizeRoutingBackend(conf)
+		if err != nil {
+			return nil, err
+		}
+		return backend, nil
+	})
+}
+
+func newSizeRoutingBackend(conf map[string]string) (*sizeRoutingBackend, error) {
+	backends, err := createSubBackends(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	backend := new(sizeRoutingBackend)
+	for _, sub := range []struct {
+		name    string
+		backend *storageBackend
+	}{{"small", &backend.small}, {"large", &backend.large}} {
+		b, ok := backends[sub.name]
+		if !ok {
+			return nil, fmt.Errorf("backend %q of size routing backend is not configured", sub.name)
+		}
+		*sub.backend = b
+	}
+	backend.threshold, err = parseSize(conf["threshold"])
+	if err != nil || backend.threshold <= 0 {
+		return nil, fmt.Errorf("invalid threshold of size routing backend: %q", conf["threshold"])
+	}
+
+	return backend, nil
+}
+
+func (b *sizeRoutingBackend) unwrap() []storageBackend {
+	return []storageBackend{b.small, b.large}
+}
+
+// backends returns the backends in lookup order.
+func (b *sizeRoutingBackend) backends() []storageBackend {
+	return []storageBackend{b.small, b.large}
+}
+
+func (b *sizeRoutingBackend) read(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	err := b.small.read(ctx, repoID, objID, w)
+	if !errors.Is(err, ErrObjectNotExist) {
+		return err
+	}
+	return b.large.read(ctx, repoID, objID, w)
+}
+
+// write buffers up to threshold bytes of r to choose the backend.
+func (b *sizeRoutingBackend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	var buf bytes.Buffer
+	_, err := io.CopyN(&buf, r, b.threshold)
+	if err == io.EOF {
+		return b.small.write(ctx, repoID, objID, &buf, sync)
+	}
+	if err != nil {
+		return err
+	}
+	return b.large.write(ctx, repoID, objID, io.MultiReader(&buf, r), sync)
+}
+
+// writeSized chooses the backend without buffering.
+func (b *sizeRoutingBackend) writeSized(ctx context.Context, repoID string, objID string, r io.Reader, size int64, sync bool) error {
+	if size < b.threshold {
+		return b.small.write(ctx, repoID, objID, r, sync)
+	}
+	if large, ok := b.large.(sizedWriter); ok {
+		return large.writeSized(ctx, repoID, objID, r, size, sync)
+	}
+	return b.large.write(ctx, repoID, objID, r, sync)
+}
+
+func (b *sizeRoutingBackend) exists(repoID string, objID string) (bool, error) {
+	for _, backend := range b.backends() {
+		ret, err := backend.exists(repoID, objID)
+		if err != nil || ret {
+			return ret, err
+		}
+	}
+	return false, nil
+}
+
+func (b *sizeRoutingBackend) stat(repoID string, objID string) (int64, error) {
+	for _, backend := range b.backends() {
+		size, err := backend.stat(repoID, objID)
+		if !errors.Is(err, ErrObjectNotExist) {
+			return size, err
+		}
+	}
+	return -1, ErrObjectNotExist
+}
+
+// delete removes the object from both backends. A backend without the
+// repo isn't an error, as all of its objects may be in the other one.
+func (b *sizeRoutingBackend) delete(repoID string, objID string) error {
+	for _, backend := range b.backends() {
+		err := backend.delete(repoID, objID)
+		if err != nil && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, ErrObjectNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// list lists both backends, skipping objects of the large backend which
+// are also in the small one after a change of the threshold.
+func (b *sizeRoutingBackend) list(repoID string, fn func(objID string) error) error {
+	if err := b.small.list(repoID, fn); err != nil {
+		return err
+	}
+	return b.large.list(repoID, func(objID string) error {
+		if ret, _ := b.small.exists(repoID, objID); ret {
+			return nil
+		}
+		return fn(objID)
+	})
+}
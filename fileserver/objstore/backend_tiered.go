@@ -0,0 +1,200 @@
+// Implementation of reading through a chain of storage backends.
+package objstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// tieredBackend writes objects to its primary backend and reads them from
+// the first of its backends which has them, so objects can be moved to a
+// new backend while the old one still serves the rest. With promotion
+// enabled, an object read from a secondary backend is also written into
+// the primary, so the old backends drain as objects are read.
+//
+// It's configured with sub-backend options prefixed by their names, and
+// tiers lists the backends in read order, starting with the primary:
+//
+//	[block_backend]
+//	type = tiered
+//	tiers = new, old
+//	promote = true
+//	new.type = s3
+//	new.bucket = seafile-blocks
+//	old.type = fs
+type tieredBackend struct {
+	tiers   []storageBackend
+	promote bool
+}
+
+func init() {
+	RegisterBackend("tiered", func(conf map[string]string) (storageBackend, error) {
+		backend, err := newTieredBackend(conf)
+		if err != nil {
+			return nil, err
+		}
+		return backend, nil
+	})
+}
+
+func newTieredBackend(conf map[string]string) (*tieredBackend, error) {
+	backends, err := createSubBackends(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	backend := new(tieredBackend)
+	for _, name := range strings.Split(conf["tiers"], ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		tier, ok := backends[name]
+		if !ok {
+			return nil, fmt.Errorf("backend %q of tiered backend is not configured", name)
+		}
+		backend.tiers = append(backend.tiers, tier)
+	}
+	if len(backend.tiers) == 0 {
+		return nil, fmt.Errorf("tiers of tiered backend must be specified")
+	}
+	if promoteStr := conf["promote"]; promoteStr != "" {
+		backend.promote, err = strconv.ParseBool(promoteStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid promote of tiered backend: %w", err)
+		}
+	}
+
+	return backend, nil
+}
+
+func (b *tieredBackend) unwrap() []storageBackend {
+	return b.tiers
+}
+
+func (b *tieredBackend) primary() storageBackend {
+	return b.tiers[0]
+}
+
+func (b *tieredBackend) read(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	err := b.primary().read(ctx, repoID, objID, w)
+	if !errors.Is(err, ErrObjectNotExist) {
+		return err
+	}
+
+	for _, tier := range b.tiers[1:] {
+		if b.promote {
+			err = readPromoting(ctx, tier, b.primary(), repoID, objID, w)
+		} else {
+			err = tier.read(ctx, repoID, objID, w)
+		}
+		if !errors.Is(err, ErrObjectNotExist) {
+			return err
+		}
+	}
+	return ErrObjectNotExist
+}
+
+// readPromoting reads an object from tier into w while writing it into
+// primary. A failure of primary doesn't fail the read, and the promotion
+// is aborted if the read fails, so no partial object is left.
+func readPromoting(ctx context.Context, tier storageBackend, primary storageBackend, repoID string, objID string, w io.Writer) error {
+	if _, err := tier.stat(repoID, objID); err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := primary.write(ctx, repoID, objID, pr, false)
+		pr.CloseWithError(err)
+	}()
+
+	tee := &promoteWriter{w: w, promote: pw}
+	err := tier.read(ctx, repoID, objID, tee)
+	if err != nil {
+		pw.CloseWithError(err)
+	} else {
+		pw.Close()
+	}
+	<-done
+	return err
+}
+
+// promoteWriter writes to w and to promote, ignoring errors of promote
+// after which it stops writing to it.
+type promoteWriter struct {
+	w       io.Writer
+	promote io.Writer
+	failed  bool
+}
+
+func (p *promoteWriter) Write(data []byte) (int, error) {
+	n, err := p.w.Write(data)
+	if !p.failed {
+		if _, perr := p.promote.Write(data[:n]); perr != nil {
+			p.failed = true
+		}
+	}
+	return n, err
+}
+
+func (b *tieredBackend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	return b.primary().write(ctx, repoID, objID, r, sync)
+}
+
+func (b *tieredBackend) exists(repoID string, objID string) (bool, error) {
+	for _, tier := range b.tiers {
+		ret, err := tier.exists(repoID, objID)
+		if err != nil || ret {
+			return ret, err
+		}
+	}
+	return false, nil
+}
+
+func (b *tieredBackend) stat(repoID string, objID string) (int64, error) {
+	for _, tier := range b.tiers {
+		size, err := tier.stat(repoID, objID)
+		if !errors.Is(err, ErrObjectNotExist) {
+			return size, err
+		}
+	}
+	return -1, ErrObjectNotExist
+}
+
+// delete removes the object from every tier. A tier without the repo isn't
+// an error, as the repo may not be migrated yet.
+func (b *tieredBackend) delete(repoID string, objID string) error {
+	for _, tier := range b.tiers {
+		err := tier.delete(repoID, objID)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// list lists every tier, skipping objects already listed from an earlier tier.
+func (b *tieredBackend) list(repoID string, fn func(objID string) error) error {
+	for i, tier := range b.tiers {
+		err := tier.list(repoID, func(objID string) error {
+			for _, earlier := range b.tiers[:i] {
+				if ret, _ := earlier.exists(repoID, objID); ret {
+					return nil
+				}
+			}
+			return fn(objID)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
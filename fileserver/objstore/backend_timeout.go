@@ -0,0 +1,173 @@
+// Implementation of per-operation timeouts of storage backends.
+package objstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// ctxStatter is implemented by backends whose metadata requests can take a
+// context, so a timeout cancels the request itself.
+type ctxStatter interface {
+	statCtx(ctx context.Context, repoID string, objID string) (int64, error)
+}
+
+// timeoutBackend bounds each call to the wrapped backend, returning
+// ErrBackendTimeout when a call takes longer than its timeout. A zero
+// timeout leaves the calls of that kind unbounded.
+//
+// Writes are bounded through their context, which every backend honours by
+// discarding the partial object, so a timed out write never commits one.
+type timeoutBackend struct {
+	storageBackend
+	readTimeout   time.Duration
+	writeTimeout  time.Duration
+	existsTimeout time.Duration
+}
+
+// timeoutFromConfig wraps backend with the timeouts of the store section,
+// given as durations such as "30s":
+//
+//	[store]
+//	read_timeout = 30s
+//	write_timeout = 2m
+//	exists_timeout = 5s
+//
+// exists_timeout also bounds stat. backend is returned as is if no timeout
+// is set.
+func timeoutFromConfig(config *ini.File, backend storageBackend) (storageBackend, error) {
+	b := &timeoutBackend{storageBackend: backend}
+	timeouts := []struct {
+		key string
+		val *time.Duration
+	}{
+		{"read_timeout", &b.readTimeout},
+		{"write_timeout", &b.writeTimeout},
+		{"exists_timeout", &b.existsTimeout},
+	}
+	for _, t := range timeouts {
+		str := configValue(config, "store", t.key)
+		if str == "" {
+			continue
+		}
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s of store: %w", t.key, err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("%s of store must not be negative", t.key)
+		}
+		*t.val = d
+	}
+	if b.readTimeout == 0 && b.writeTimeout == 0 && b.existsTimeout == 0 {
+		return backend, nil
+	}
+	return b, nil
+}
+
+func (b *timeoutBackend) unwrap() []storageBackend {
+	return []storageBackend{b.storageBackend}
+}
+
+// withTimeout returns a context bounded by timeout, or ctx if timeout is zero.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// timeoutError classifies err as ErrBackendTimeout if the deadline of ctx
+// expired while parent, the context of the caller, is still live.
+func timeoutError(ctx context.Context, parent context.Context, err error) error {
+	if err == nil || ctx.Err() != context.DeadlineExceeded || parent.Err() != nil {
+		return err
+	}
+	return &Error{ErrBackendTimeout, err}
+}
+
+func (b *timeoutBackend) read(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	opCtx, cancel := withTimeout(ctx, b.readTimeout)
+	defer cancel()
+	err := b.storageBackend.read(opCtx, repoID, objID, w)
+	return timeoutError(opCtx, ctx, err)
+}
+
+func (b *timeoutBackend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	opCtx, cancel := withTimeout(ctx, b.writeTimeout)
+	defer cancel()
+	err := b.storageBackend.write(opCtx, repoID, objID, r, sync)
+	return timeoutError(opCtx, ctx, err)
+}
+
+func (b *timeoutBackend) writeSized(ctx context.Context, repoID string, objID string, r io.Reader, size int64, sync bool) error {
+	opCtx, cancel := withTimeout(ctx, b.writeTimeout)
+	defer cancel()
+	err := writeSizedTo(opCtx, b.storageBackend, repoID, objID, r, size, sync)
+	return timeoutError(opCtx, ctx, err)
+}
+
+func (b *timeoutBackend) exists(repoID string, objID string) (bool, error) {
+	if _, ok := b.storageBackend.(ctxStatter); !ok || b.existsTimeout <= 0 {
+		var ret bool
+		err := b.bounded(func() (err error) {
+			ret, err = b.storageBackend.exists(repoID, objID)
+			return err
+		})
+		return ret, err
+	}
+
+	_, err := b.stat(repoID, objID)
+	if err != nil {
+		if err == ErrObjectNotExist {
+			return false, nil
+		}
+		return false, existsError(err)
+	}
+	return true, nil
+}
+
+func (b *timeoutBackend) stat(repoID string, objID string) (int64, error) {
+	if cs, ok := b.storageBackend.(ctxStatter); ok && b.existsTimeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), b.existsTimeout)
+		defer cancel()
+		size, err := cs.statCtx(ctx, repoID, objID)
+		return size, timeoutError(ctx, context.Background(), err)
+	}
+
+	var size int64
+	err := b.bounded(func() (err error) {
+		size, err = b.storageBackend.stat(repoID, objID)
+		return err
+	})
+	return size, err
+}
+
+// bounded calls fn, which can't be cancelled, and gives up waiting for it
+// after existsTimeout. fn keeps running in the background after a timeout.
+func (b *timeoutBackend) bounded(fn func() error) error {
+	if b.existsTimeout <= 0 {
+		return fn()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	timer := time.NewTimer(b.existsTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return &Error{ErrBackendTimeout, context.DeadlineExceeded}
+	}
+}
+
+func (b *timeoutBackend) transparentFor(op string) bool {
+	return true
+}
@@ -0,0 +1,61 @@
+package objstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// defaultMaxReadBytes is the default size of the largest object ReadBytes buffers.
+const defaultMaxReadBytes = 64 * 1024 * 1024
+
+// WriteBytes writes data to an object, for small objects like commits.
+func (s *ObjectStore) WriteBytes(repoID string, objID string, data []byte, sync bool) error {
+	return s.Write(repoID, objID, bytes.NewReader(data), sync)
+}
+
+// ReadBytes returns the content of an object, for small objects like commits.
+// It fails with an error matching ErrObjectTooLarge instead of buffering an
+// object larger than max_read_bytes of the store section.
+func (s *ObjectStore) ReadBytes(repoID string, objID string) ([]byte, error) {
+	size, err := s.Stat(repoID, objID)
+	if err != nil {
+		return nil, err
+	}
+	if size > s.maxReadBytes {
+		return nil, s.tooLargeError(objID)
+	}
+
+	// The object may change between Stat and Read, so the limit is also
+	// enforced while reading.
+	w := &limitedBuffer{remain: s.maxReadBytes}
+	w.buf.Grow(int(size))
+	err = s.Read(repoID, objID, w)
+	if errors.Is(err, errLimitReached) {
+		return nil, s.tooLargeError(objID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return w.buf.Bytes(), nil
+}
+
+func (s *ObjectStore) tooLargeError(objID string) error {
+	return fmt.Errorf("%w: object %s is larger than %d bytes", ErrObjectTooLarge, objID, s.maxReadBytes)
+}
+
+var errLimitReached = errors.New("buffer limit reached")
+
+// limitedBuffer buffers up to remain bytes, and fails writes beyond them.
+type limitedBuffer struct {
+	buf    bytes.Buffer
+	remain int64
+}
+
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.remain {
+		return 0, errLimitReached
+	}
+	l.remain -= int64(len(p))
+	return l.buf.Write(p)
+}
@@ -0,0 +1,139 @@
+package objstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// backendSections maps object types to their backend section in seafile.conf.
+var backendSections = map[string]string{
+	"commit":  "commit_object_backend",
+	"commits": "commit_object_backend",
+	"fs":      "fs_object_backend",
+	"block":   "block_backend",
+	"blocks":  "block_backend",
+}
+
+// defaultBackendSection holds the backend options shared by all object
+// types. Options of the section of an object type take precedence:
+//
+//	[object_backend]
+//	type = s3
+//	bucket = seafile
+//
+//	[block_backend]
+//	bucket = seafile-blocks
+//
+// If the section of an object type sets a different type, none of the
+// shared options apply to it.
+const defaultBackendSection = "object_backend"
+
+// loadConfig loads seafile.conf in the seafileConfPath directory.
+// An empty config is returned if seafile.conf doesn't exist.
+func loadConfig(seafileConfPath string) (*ini.File, error) {
+	confFile := filepath.Join(seafileConfPath, "seafile.conf")
+	if _, err := os.Stat(confFile); os.IsNotExist(err) {
+		return ini.Empty(), nil
+	}
+	return ini.Load(confFile)
+}
+
+// backendConf returns the options in the backend section of objType,
+// merged with those of the default section. An empty map is returned if
+// neither section exists.
+func backendConf(config *ini.File, objType string) map[string]string {
+	conf := sectionConf(config, defaultBackendSection)
+
+	name, ok := backendSections[objType]
+	if !ok {
+		return conf
+	}
+	typeConf := sectionConf(config, name)
+	if t := typeConf["type"]; t != "" && t != conf["type"] {
+		return typeConf
+	}
+	for k, v := range typeConf {
+		conf[k] = v
+	}
+
+	return conf
+}
+
+// backendSection returns the section the backend of objType is configured
+// in, for error messages.
+func backendSection(config *ini.File, objType string) string {
+	if name, ok := backendSections[objType]; ok && len(sectionConf(config, name)) > 0 {
+		return name
+	}
+	return defaultBackendSection
+}
+
+// sectionConf returns the options of a section, or an empty map if it
+// doesn't exist.
+func sectionConf(config *ini.File, name string) map[string]string {
+	conf := make(map[string]string)
+	section, err := config.GetSection(name)
+	if err != nil {
+		return conf
+	}
+	for k, v := range section.KeysHash() {
+		conf[k] = v
+	}
+	return conf
+}
+
+// backendType returns the backend type configured for objType, which is
+// "fs" if not configured.
+func backendType(config *ini.File, objType string) string {
+	if t := backendConf(config, objType)["type"]; t != "" {
+		return t
+	}
+	return "fs"
+}
+
+// configValue returns the value of key in section, or "" if it's not set.
+func configValue(config *ini.File, section string, key string) string {
+	s, err := config.GetSection(section)
+	if err != nil {
+		return ""
+	}
+	k, err := s.GetKey(key)
+	if err != nil {
+		return ""
+	}
+	return k.String()
+}
+
+// parseSize parses a size like "256MB" into bytes. Supported units are
+// kb, mb, gb and tb (case-insensitive); a plain number is in bytes.
+func parseSize(sizeStr string) (int64, error) {
+	s := strings.ToLower(strings.TrimSpace(sizeStr))
+	var multiplier int64 = 1
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"kb", 1000},
+		{"mb", 1000000},
+		{"gb", 1000000000},
+		{"tb", 1000000000000},
+	}
+	for _, unit := range units {
+		if strings.HasSuffix(s, unit.suffix) {
+			multiplier = unit.multiplier
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			break
+		}
+	}
+
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", sizeStr)
+	}
+	return size * multiplier, nil
+}
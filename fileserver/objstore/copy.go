@@ -0,0 +1,85 @@
+package objstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const copyBufferSize = 32 * 1024
+
+// defaultBuffers is used by backends without a configured copy_buffer_size.
+var defaultBuffers = newBufferPool(copyBufferSize)
+
+// bufferPool reuses copy buffers of a fixed size across calls.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{size: size}
+	p.pool.New = func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return p
+}
+
+// bufferPoolFromConf returns a pool with the copy_buffer_size of a backend
+// section, or defaultBuffers if it isn't set.
+func bufferPoolFromConf(conf map[string]string) (*bufferPool, error) {
+	sizeStr := conf["copy_buffer_size"]
+	if sizeStr == "" {
+		return defaultBuffers, nil
+	}
+	size, err := parseSize(sizeStr)
+	if err != nil || size <= 0 || size > 1<<30 {
+		return nil, fmt.Errorf("invalid copy_buffer_size %q", sizeStr)
+	}
+	if size == copyBufferSize {
+		return defaultBuffers, nil
+	}
+	return newBufferPool(int(size)), nil
+}
+
+// copy copies from src to dst with a pooled buffer, like copyCtx.
+func (p *bufferPool) copy(ctx context.Context, dst io.Writer, src io.Reader) (written int64, err error) {
+	buf := p.pool.Get().(*[]byte)
+	defer p.pool.Put(buf)
+	return copyBuffer(ctx, dst, src, *buf)
+}
+
+// copyCtx copies from src to dst like io.Copy, but checks ctx between
+// chunks and aborts with ctx.Err() once the context is done.
+func copyCtx(ctx context.Context, dst io.Writer, src io.Reader) (written int64, err error) {
+	return defaultBuffers.copy(ctx, dst, src)
+}
+
+func copyBuffer(ctx context.Context, dst io.Writer, src io.Reader, buf []byte) (written int64, err error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		nr, er := src.Read(buf)
+		if nr > 0 {
+			nw, ew := dst.Write(buf[0:nr])
+			if nw > 0 {
+				written += int64(nw)
+			}
+			if ew != nil {
+				return written, ew
+			}
+			if nr != nw {
+				return written, io.ErrShortWrite
+			}
+		}
+		if er != nil {
+			if er == io.EOF {
+				return written, nil
+			}
+			return written, er
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package objstore
+
+import (
+	"context"
+	"sync"
+)
+
+// batchDeleter is implemented by backends that can delete many objects
+// more efficiently than calling delete() one by one. The returned errors
+// are aligned with objIDs, with nil for every deleted object.
+type batchDeleter interface {
+	deleteMany(repoID string, objIDs []string) []error
+}
+
+// DeleteMany removes objects from storage backends, e.g. unreachable objects
+// found by GC. Like Delete, missing objects count as deleted.
+// errs is nil if all objects are deleted, otherwise errs[i] is the error of
+// deleting objIDs[i], or nil if it was deleted.
+func (s *ObjectStore) DeleteMany(repoID string, objIDs []string) (deleted int, errs []error) {
+	_, span := s.startSpan(context.Background(), "delete_many", repoID, "")
+	defer func() {
+		span.end(firstError(errs))
+	}()
+	var res []error
+	if s.IsReadOnly() {
+		res = make([]error, len(objIDs))
+		for i := range res {
+			res[i] = ErrReadOnly
+		}
+		return 0, res
+	}
+	if b, ok := s.backend.(batchDeleter); ok {
+		res = b.deleteMany(repoID, objIDs)
+	} else {
+		res = make([]error, len(objIDs))
+		for i, objID := range objIDs {
+			res[i] = s.backend.delete(repoID, objID)
+		}
+	}
+
+	for _, err := range res {
+		if err == nil {
+			deleted++
+		}
+	}
+	if deleted == len(objIDs) {
+		return deleted, nil
+	}
+	return deleted, res
+}
+
+// deleteConcurrently calls del for every objID with at most workers
+// concurrent calls, and returns the errors aligned with objIDs.
+func deleteConcurrently(objIDs []string, workers int, del func(objID string) error) []error {
+	errs := make([]error, len(objIDs))
+	var wg sync.WaitGroup
+	indexes := make(chan int)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				errs[i] = del(objIDs[i])
+			}
+		}()
+	}
+	for i := range objIDs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return errs
+}
@@ -0,0 +1,185 @@
+package objstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trashDirName is the directory under the object directory of fs backend
+// that deleted repos are moved to before being removed.
+const trashDirName = ".trash"
+
+// repoDeleter is implemented by backends that can remove all objects of a
+// repo more efficiently than deleting them one by one.
+type repoDeleter interface {
+	deleteRepo(repoID string) error
+}
+
+// DeleteRepo removes every object of a repo, e.g. after the repo is deleted.
+// Deleting a repo without objects, or one already deleted, returns nil. If it
+// fails midway, calling it again deletes the remaining objects.
+func (s *ObjectStore) DeleteRepo(repoID string) error {
+	if s.IsReadOnly() {
+		return ErrReadOnly
+	}
+	if err := deleteRepoBackend(s.backend, repoID); err != nil {
+		return err
+	}
+	go s.emptyTrash()
+	return nil
+}
+
+// trashEmptier is implemented by backends that move deleted repos aside and
+// remove them later.
+type trashEmptier interface {
+	emptyTrash() []error
+}
+
+// emptyTrash removes the deleted repos left in the trash of every backend
+// of the store, and passes the failures to the Logger.
+func (s *ObjectStore) emptyTrash() {
+	var emptiers []trashEmptier
+	findBackend(s.backend, func(b storageBackend) bool {
+		if e, ok := b.(trashEmptier); ok {
+			emptiers = append(emptiers, e)
+		}
+		return false
+	})
+	for _, e := range emptiers {
+		for _, err := range e.emptyTrash() {
+			if s.logger != nil {
+				s.logger.Log(OpEvent{ObjType: s.ObjType, Op: "empty_trash", Err: err})
+			}
+		}
+	}
+}
+
+// deleteRepoBackend deletes a repo from every backend in the tree rooted at
+// b. A repoDeleter is responsible for the backends it wraps, and other
+// backends without inner backends delete the repo's objects one by one.
+func deleteRepoBackend(b storageBackend, repoID string) error {
+	if d, ok := b.(repoDeleter); ok {
+		return d.deleteRepo(repoID)
+	}
+	if u, ok := b.(unwrapper); ok {
+		for _, inner := range u.unwrap() {
+			if err := deleteRepoBackend(inner, repoID); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var objIDs []string
+	err := b.list(repoID, func(objID string) error {
+		objIDs = append(objIDs, objID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return deleteRepoObjects(b, repoID, objIDs)
+}
+
+// deleteRepoObjects deletes objIDs of a repo, returning the first error.
+func deleteRepoObjects(b storageBackend, repoID string, objIDs []string) error {
+	var errs []error
+	if d, ok := b.(batchDeleter); ok {
+		errs = d.deleteMany(repoID, objIDs)
+	} else {
+		errs = make([]error, len(objIDs))
+		for i, objID := range objIDs {
+			errs[i] = b.delete(repoID, objID)
+		}
+	}
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("failed to delete object %s of repo %s: %w", objIDs[i], repoID, err)
+		}
+	}
+	return nil
+}
+
+// deleteRepo drops the cached objects of the repo before deleting it.
+func (c *cachingBackend) deleteRepo(repoID string) error {
+	c.lock.Lock()
+	prefix := cacheKey(repoID, "")
+	for key, elem := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.removeElement(elem)
+		}
+	}
+	c.lock.Unlock()
+
+	return deleteRepoBackend(c.storageBackend, repoID)
+}
+
+// deleteRepo moves the directories of the repo into the trash directory,
+// so the repo disappears at once. The store removes them in the background
+// with emptyTrash, and directories left in the trash by a failed removal
+// are removed again after the next call.
+func (b *fsBackend) deleteRepo(repoID string) error {
+	if err := checkRepoID(repoID); err != nil {
+		return err
+	}
+	trashDir := path.Join(b.objDir, trashDirName)
+	if err := os.MkdirAll(trashDir, os.ModePerm); err != nil {
+		return fsError(err)
+	}
+
+	suffix := "." + strconv.FormatInt(time.Now().UnixNano(), 10)
+	repoDirs := []struct{ dir, trashName string }{
+		{path.Join(b.objDir, repoID), repoID + suffix},
+		{path.Join(b.objDir, ttlDirName, repoID), repoID + ".ttl" + suffix},
+	}
+	for _, repoDir := range repoDirs {
+		err := os.Rename(repoDir.dir, path.Join(trashDir, repoDir.trashName))
+		if err != nil && !os.IsNotExist(err) {
+			return fsError(err)
+		}
+	}
+
+	return nil
+}
+
+// emptyTrashLock keeps a single emptyTrash running at a time.
+var emptyTrashLock sync.Mutex
+
+// emptyTrash removes everything in the trash directory, and returns the
+// errors of the deleted repos it failed to remove.
+func (b *fsBackend) emptyTrash() []error {
+	emptyTrashLock.Lock()
+	defer emptyTrashLock.Unlock()
+
+	trashDir := path.Join(b.objDir, trashDirName)
+	entries, err := ioutil.ReadDir(trashDir)
+	if err != nil {
+		return nil
+	}
+	var errs []error
+	for _, entry := range entries {
+		if err := os.RemoveAll(path.Join(trashDir, entry.Name())); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove deleted repo %s: %w", entry.Name(), err))
+		}
+	}
+	return errs
+}
+
+// emptyTrash empties the trash of the cache directory, which isn't one of
+// the wrapped backends.
+func (b *diskCacheBackend) emptyTrash() []error {
+	return b.cache.emptyTrash()
+}
+
+// deleteRepo waits for queued writes before deleting the repo, so a queued
+// write of one of its objects can't recreate it afterwards.
+func (b *asyncWriteBackend) deleteRepo(repoID string) error {
+	b.wait()
+	return deleteRepoBackend(b.storageBackend, repoID)
+}
@@ -0,0 +1,96 @@
+package objstore
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by backends, which map their native errors onto them.
+// ErrObjectNotExist is returned as is, the others are wrapped in an *Error
+// keeping the native error, so they should be tested with errors.Is.
+var (
+	// ErrObjectNotExist is returned when the requested object is not found in the backend.
+	ErrObjectNotExist = errors.New("object does not exist")
+	// ErrBackendUnavailable is returned when the backend can't be reached or fails to serve the request.
+	ErrBackendUnavailable = errors.New("storage backend unavailable")
+	// ErrPermission is returned when the backend denies access to an object.
+	ErrPermission = errors.New("permission denied by storage backend")
+	// ErrBackendTimeout is returned when the backend doesn't complete a request within its timeout.
+	ErrBackendTimeout = errors.New("storage backend timed out")
+	// ErrNoSpace is returned when the backend has no space or quota left for a write.
+	ErrNoSpace = errors.New("no space left on storage backend")
+)
+
+// Error is a native backend error classified as one of the errors above.
+// errors.Is matches it with Kind, and errors.As can retrieve the native error.
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v: %v", e.Kind, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// existsError classifies an error which prevented checking whether an
+// object exists: it's ErrBackendUnavailable unless already classified.
+func existsError(err error) error {
+	if errors.Is(err, ErrPermission) || errors.Is(err, ErrBackendUnavailable) || errors.Is(err, ErrBackendTimeout) {
+		return err
+	}
+	return &Error{ErrBackendUnavailable, err}
+}
+
+// ErrOutOfRange is returned when a read starts beyond the end of an object.
+var ErrOutOfRange = errors.New("offset out of object range")
+
+// ErrQuotaExceeded is returned when a write would exceed the quota of the repo.
+var ErrQuotaExceeded = errors.New("repo quota exceeded")
+
+// ErrStopIteration can be returned by the callback of ListIter to stop
+// iterating early. It's never returned to the caller of ListIter.
+var ErrStopIteration = errors.New("stop iteration")
+
+// ErrInvalidObjectID is returned when a repo or object ID can't be safely
+// mapped onto a storage path.
+var ErrInvalidObjectID = errors.New("invalid repo or object id")
+
+// ErrObjectTooLarge is returned when an object is too large to be buffered in memory.
+var ErrObjectTooLarge = errors.New("object too large")
+
+// ErrSizeMismatch is returned when the content of a sized write is shorter
+// or longer than its size, e.g. an upload truncated by the client. It's
+// the caller's error, so it's never retried.
+var ErrSizeMismatch = errors.New("object size mismatch")
+
+// ErrNotSupported is returned when no storage backend provides an operation.
+var ErrNotSupported = errors.New("operation not supported by storage backend")
+
+// ErrReadOnly is returned by writes and deletes while the object store is read-only.
+var ErrReadOnly = errors.New("object store is read-only")
+
+// ErrChecksumMismatch is returned when an object's content doesn't hash to its ID.
+var ErrChecksumMismatch = errors.New("object checksum mismatch")
+
+// ChecksumError reports the expected and actual hash of a corrupt object.
+// It matches ErrChecksumMismatch with errors.Is.
+type ChecksumError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%v: expected %s, got %s", ErrChecksumMismatch, e.Expected, e.Actual)
+}
+
+func (e *ChecksumError) Unwrap() error {
+	return ErrChecksumMismatch
+}
@@ -0,0 +1,51 @@
+package objstore
+
+import (
+	"sync"
+)
+
+// batchExister is implemented by backends that can check many objects
+// more efficiently than calling exists() one by one.
+type batchExister interface {
+	existsMany(repoID string, objIDs []string) (map[string]bool, error)
+}
+
+// existsConcurrently calls exists for every objID with at most workers
+// concurrent calls. The result has an entry for every objID; objects whose
+// check failed are reported as false and the first error is returned.
+func existsConcurrently(objIDs []string, workers int, exists func(objID string) (bool, error)) (map[string]bool, error) {
+	res := make(map[string]bool, len(objIDs))
+	for _, objID := range objIDs {
+		res[objID] = false
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	ids := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for objID := range ids {
+				ret, err := exists(objID)
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+				} else {
+					res[objID] = ret
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, objID := range objIDs {
+		ids <- objID
+	}
+	close(ids)
+	wg.Wait()
+
+	return res, firstErr
+}
@@ -0,0 +1,84 @@
+package objstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+)
+
+// exporter is implemented by backends that can read objects while walking
+// a repo, instead of looking each listed object up again.
+type exporter interface {
+	export(ctx context.Context, repoID string, fn func(objID string, r io.Reader) error) error
+}
+
+// Export calls fn with the ID and content of every object in a repo, e.g.
+// to back it up. The reader is only valid until fn returns, when it's
+// closed. The fs backend reads the files as it walks the repo directory,
+// and others fetch each object as it's listed. Objects deleted during the
+// walk are skipped. Iteration stops at the first error returned by fn,
+// which is returned unless it's ErrStopIteration.
+func (s *ObjectStore) Export(repoID string, fn func(objID string, r io.Reader) error) error {
+	var err error
+	if b, ok := s.backend.(exporter); ok {
+		err = b.export(context.Background(), repoID, fn)
+	} else {
+		err = s.backend.list(repoID, func(objID string) error {
+			rc, err := s.Open(repoID, objID)
+			if errors.Is(err, ErrObjectNotExist) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+			return fn(objID, rc)
+		})
+	}
+	if err == ErrStopIteration {
+		return nil
+	}
+	return err
+}
+
+func (b *fsBackend) export(ctx context.Context, repoID string, fn func(objID string, r io.Reader) error) error {
+	if err := checkRepoID(repoID); err != nil {
+		return err
+	}
+	dirs, err := b.layout.objectDirs(path.Join(b.objDir, repoID))
+	if err != nil {
+		return fsError(err)
+	}
+
+	for _, dir := range dirs {
+		entries, err := readObjectDir(dir.path)
+		if err != nil {
+			return fsError(err)
+		}
+		for _, entry := range entries {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := exportFile(path.Join(dir.path, entry.Name()), dir.prefix+entry.Name(), fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// exportFile calls fn with the content of the object file at p.
+func exportFile(p string, objID string, fn func(objID string, r io.Reader) error) error {
+	fd, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fsError(err)
+	}
+	defer fd.Close()
+	return fn(objID, fd)
+}
@@ -0,0 +1,125 @@
+package objstore
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sync"
+	"sync/atomic"
+)
+
+// HashAlgo is a hash algorithm computing object IDs, which are the hex
+// encoded hashes of object contents. Backends store objects by their ID
+// string, so objects of either algorithm can live in the same store.
+type HashAlgo string
+
+// Supported hash algorithms of object IDs.
+const (
+	HashSHA1   HashAlgo = "sha1"
+	HashSHA256 HashAlgo = "sha256"
+)
+
+// hashAlgo holds the HashAlgo of new object IDs.
+var hashAlgo atomic.Value
+
+func init() {
+	hashAlgo.Store(HashSHA1)
+}
+
+// SetHashAlgo sets the algorithm computing new object IDs, SHA1 by
+// default. It's also set by hash_algo of the store section of seafile.conf.
+func SetHashAlgo(algo HashAlgo) error {
+	if algo.idLength() == 0 {
+		return fmt.Errorf("unsupported hash algorithm %q", algo)
+	}
+	hashAlgo.Store(algo)
+	return nil
+}
+
+// configuredAlgo is the HashAlgo set by hash_algo of seafile.conf, which
+// is shared by all object stores.
+var configuredAlgo struct {
+	sync.Mutex
+	algo HashAlgo
+}
+
+// configureHashAlgo sets the algorithm configured by hash_algo. It's only
+// set by the first object store created with it, so creating more stores
+// doesn't reset an algorithm set by SetHashAlgo since, and stores
+// configured with different algorithms are rejected.
+func configureHashAlgo(algo HashAlgo) error {
+	if algo.idLength() == 0 {
+		return fmt.Errorf("unsupported hash algorithm %q", algo)
+	}
+	configuredAlgo.Lock()
+	defer configuredAlgo.Unlock()
+	if configuredAlgo.algo != "" {
+		if configuredAlgo.algo != algo {
+			return fmt.Errorf("hash algorithm %q conflicts with %q of another object store", algo, configuredAlgo.algo)
+		}
+		return nil
+	}
+	configuredAlgo.algo = algo
+	return SetHashAlgo(algo)
+}
+
+// GetHashAlgo returns the algorithm computing new object IDs.
+func GetHashAlgo() HashAlgo {
+	return hashAlgo.Load().(HashAlgo)
+}
+
+// New returns a hash computing object IDs with the algorithm.
+func (a HashAlgo) New() hash.Hash {
+	if a == HashSHA256 {
+		return sha256.New()
+	}
+	return sha1.New()
+}
+
+// idLength returns the length of object IDs of the algorithm, or 0 if
+// it's not supported.
+func (a HashAlgo) idLength() int {
+	switch a {
+	case HashSHA1:
+		return 2 * sha1.Size
+	case HashSHA256:
+		return 2 * sha256.Size
+	}
+	return 0
+}
+
+// ComputeID returns the object ID of data with the current HashAlgo.
+func ComputeID(data []byte) string {
+	return GetHashAlgo().computeID(data)
+}
+
+func (a HashAlgo) computeID(data []byte) string {
+	h := a.New()
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// isHashID reports whether objID looks like the hex encoded hash of a
+// supported algorithm.
+func isHashID(objID string) bool {
+	if len(objID) != HashSHA1.idLength() && len(objID) != HashSHA256.idLength() {
+		return false
+	}
+	_, err := hex.DecodeString(objID)
+	return err == nil
+}
+
+// hashForID returns the algorithm computing objID, told by its length, so
+// objects created before switching algorithms are still verified. IDs of
+// other lengths are assumed to be of the current algorithm.
+func hashForID(objID string) HashAlgo {
+	switch len(objID) {
+	case HashSHA1.idLength():
+		return HashSHA1
+	case HashSHA256.idLength():
+		return HashSHA256
+	}
+	return GetHashAlgo()
+}
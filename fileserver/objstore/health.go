@@ -0,0 +1,101 @@
+package objstore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// healthRepoID and healthObjID name an object which never exists. Checking
+// its existence probes backends without a cheaper health check.
+const (
+	healthRepoID = "00000000-0000-0000-0000-000000000000"
+	healthObjID  = "0000000000000000000000000000000000000000"
+)
+
+// healthChecker is implemented by backends with a lightweight probe.
+type healthChecker interface {
+	healthCheck(ctx context.Context) error
+}
+
+// BackendType returns the configured type of the backend, e.g. "fs" or "s3".
+func (s *ObjectStore) BackendType() string {
+	return s.backendType
+}
+
+// HealthCheck probes the backends and returns nil if they're reachable.
+// It returns an error matching ErrBackendUnavailable once ctx is done, even
+// if a probe is still blocked, so it's safe to poll with a deadline.
+func (s *ObjectStore) HealthCheck(ctx context.Context) error {
+	if s.backend == nil {
+		return &Error{ErrBackendUnavailable, fmt.Errorf("%s object store has no backend", s.ObjType)}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- checkBackend(ctx, s.backend)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return &Error{ErrBackendUnavailable, ctx.Err()}
+	}
+}
+
+// probeTimeout bounds the probe of the backends made by New.
+const probeTimeout = 30 * time.Second
+
+// probeBackend checks that the backends are reachable, and that objects can
+// be written to the file systems of fs backends if writable is set.
+func probeBackend(b storageBackend, writable bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	if err := checkBackend(ctx, b); err != nil {
+		return err
+	}
+	if writable {
+		return checkWritable(b)
+	}
+	return nil
+}
+
+// checkWritable creates and removes a file in the object directory of every
+// fs backend in the tree rooted at b.
+func checkWritable(b storageBackend) error {
+	if fs, ok := b.(*fsBackend); ok {
+		f, err := ioutil.TempFile(fs.objDir, ".probe.")
+		if err != nil {
+			return fsError(err)
+		}
+		f.Close()
+		return os.Remove(f.Name())
+	}
+	if u, ok := b.(unwrapper); ok {
+		for _, inner := range u.unwrap() {
+			if err := checkWritable(inner); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkBackend probes every backend in the tree rooted at b.
+func checkBackend(ctx context.Context, b storageBackend) error {
+	if c, ok := b.(healthChecker); ok {
+		return c.healthCheck(ctx)
+	}
+	if u, ok := b.(unwrapper); ok {
+		for _, inner := range u.unwrap() {
+			if err := checkBackend(ctx, inner); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	_, err := b.exists(healthRepoID, healthObjID)
+	return err
+}
@@ -0,0 +1,165 @@
+package objstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// fsLayout is the way fs backend arranges the objects of a repo under the
+// repo's directory.
+type fsLayout string
+
+const (
+	// layoutSharded stores objects as <repoID>/<first 2 chars>/<rest>,
+	// keeping directories small. It's the default.
+	layoutSharded fsLayout = "sharded"
+	// layoutFlat stores objects as <repoID>/<objID>, for file systems
+	// which handle deep nesting badly.
+	layoutFlat fsLayout = "flat"
+)
+
+func parseLayout(layout string) (fsLayout, error) {
+	switch fsLayout(layout) {
+	case "", layoutSharded:
+		return layoutSharded, nil
+	case layoutFlat:
+		return layoutFlat, nil
+	}
+	return "", fmt.Errorf("unknown layout %q of fs backend", layout)
+}
+
+// objectPath returns the path of an object in repoDir.
+func (l fsLayout) objectPath(repoDir string, objID string) string {
+	if l == layoutFlat {
+		return path.Join(repoDir, objID)
+	}
+	return path.Join(repoDir, objID[:2], objID[2:])
+}
+
+// objectDir is a directory holding objects, whose IDs are prefix followed
+// by their file names.
+type objectDir struct {
+	path   string
+	prefix string
+}
+
+// objectDirs returns the directories of repoDir holding objects, sorted by
+// their prefix. A missing repoDir has none.
+func (l fsLayout) objectDirs(repoDir string) ([]objectDir, error) {
+	if l == layoutFlat {
+		if _, err := os.Stat(repoDir); err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return []objectDir{{repoDir, ""}}, nil
+	}
+
+	shards, err := ioutil.ReadDir(repoDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var dirs []objectDir
+	for _, shard := range shards {
+		if shard.IsDir() && len(shard.Name()) == 2 {
+			dirs = append(dirs, objectDir{path.Join(repoDir, shard.Name()), shard.Name()})
+		}
+	}
+	return dirs, nil
+}
+
+// readObjectDir returns the entries of dir which are objects, skipping
+// directories and hidden files such as temp files. A missing dir is empty.
+func readObjectDir(dir string) ([]os.FileInfo, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	objects := entries[:0]
+	for _, entry := range entries {
+		if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			objects = append(objects, entry)
+		}
+	}
+	return objects, nil
+}
+
+// ReshardRepo moves the objects of a repo stored by fs backends into
+// layout, which is "sharded" or "flat". Objects of a repo are only found in
+// the layout configured with layout of the store section, so to switch
+// layouts, stop the fileserver, reshard every repo, then change the
+// configuration. Resharding a repo already in layout does nothing, and an
+// interrupted resharding is finished by calling ReshardRepo again.
+func (s *ObjectStore) ReshardRepo(repoID string, layout string) error {
+	if s.IsReadOnly() {
+		return ErrReadOnly
+	}
+	l, err := parseLayout(layout)
+	if err != nil {
+		return err
+	}
+	return reshardBackend(s.backend, repoID, l)
+}
+
+// reshardBackend reshards the repo in every fs backend of the tree rooted at b.
+func reshardBackend(b storageBackend, repoID string, layout fsLayout) error {
+	if fs, ok := b.(*fsBackend); ok {
+		return fs.reshardRepo(repoID, layout)
+	}
+	if u, ok := b.(unwrapper); ok {
+		for _, inner := range u.unwrap() {
+			if err := reshardBackend(inner, repoID, layout); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *fsBackend) reshardRepo(repoID string, layout fsLayout) error {
+	if err := checkRepoID(repoID); err != nil {
+		return err
+	}
+	from := layoutSharded
+	if layout == layoutSharded {
+		from = layoutFlat
+	}
+
+	for _, repoDir := range []string{path.Join(b.objDir, repoID), path.Join(b.objDir, ttlDirName, repoID)} {
+		dirs, err := from.objectDirs(repoDir)
+		if err != nil {
+			return fsError(err)
+		}
+		for _, dir := range dirs {
+			entries, err := readObjectDir(dir.path)
+			if err != nil {
+				return fsError(err)
+			}
+			for _, entry := range entries {
+				objID := dir.prefix + entry.Name()
+				dst := layout.objectPath(repoDir, objID)
+				if err := b.mkdirAll(path.Dir(dst)); err != nil {
+					return fsError(err)
+				}
+				if err := os.Rename(path.Join(dir.path, entry.Name()), dst); err != nil {
+					return fsError(err)
+				}
+			}
+			// Shard directories left with temp files are kept.
+			if dir.path != repoDir {
+				os.Remove(dir.path)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package objstore
+
+import (
+	"context"
+	"path"
+	"sync"
+)
+
+// parallelLister is implemented by backends that can list a repo's objects
+// with concurrent workers.
+type parallelLister interface {
+	listParallel(ctx context.Context, repoID string, workers int, fn func(objID string) error) error
+}
+
+// ListParallel calls fn for every object in a repo like ListIter, using up
+// to workers concurrent goroutines, so fn must be safe for concurrent use.
+// Every object existing during the whole walk is visited exactly once;
+// objects created or deleted meanwhile may or may not be visited.
+// The first error returned by fn stops the walk and is returned unless
+// it's ErrStopIteration. Backends that can't list in parallel call fn from
+// a single goroutine.
+func (s *ObjectStore) ListParallel(repoID string, workers int, fn func(objID string) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	var err error
+	if b, ok := s.backend.(parallelLister); ok && workers > 1 {
+		err = b.listParallel(context.Background(), repoID, workers, fn)
+	} else {
+		err = s.backend.list(repoID, fn)
+	}
+	if err == ErrStopIteration {
+		return nil
+	}
+	return err
+}
+
+// listParallel hands out the object directories of a repo to workers. Each
+// directory is read by a single worker, so no object is visited twice.
+func (b *fsBackend) listParallel(ctx context.Context, repoID string, workers int, fn func(objID string) error) error {
+	if err := checkRepoID(repoID); err != nil {
+		return err
+	}
+	dirs, err := b.layout.objectDirs(path.Join(b.objDir, repoID))
+	if err != nil {
+		return fsError(err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var once sync.Once
+	var firstErr error
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	var wg sync.WaitGroup
+	dirCh := make(chan objectDir)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for dir := range dirCh {
+				if err := b.listShard(ctx, dir, fn); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, dir := range dirs {
+		select {
+		case dirCh <- dir:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(dirCh)
+	wg.Wait()
+
+	if firstErr == nil {
+		return ctx.Err()
+	}
+	return firstErr
+}
+
+func (b *fsBackend) listShard(ctx context.Context, dir objectDir, fn func(objID string) error) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	entries, err := readObjectDir(dir.path)
+	if err != nil {
+		return fsError(err)
+	}
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err := fn(dir.prefix + entry.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package objstore
+
+import "time"
+
+// Logger receives the object store operations to log, so callers can log
+// them with their own logging library. It's called on the goroutine of the
+// operation once it's done, so it should return quickly.
+type Logger interface {
+	Log(e OpEvent)
+}
+
+// OpEvent describes an object store operation. Op is one of "read",
+// "read_range", "open", "write", "write_if_absent", "write_from_file",
+// "write_many", "exists", "stat", "delete", "delete_many", "copy" or
+// "move", or "empty_trash" for a deleted repo that failed to be removed in
+// the background. ObjID is empty for operations on many objects, and
+// RepoID is the destination repo of copies and moves. Err of a batch is
+// the error of its first failed object.
+type OpEvent struct {
+	ObjType  string
+	Op       string
+	RepoID   string
+	ObjID    string
+	Duration time.Duration
+	// Bytes is the size of the content read or written.
+	Bytes int64
+	// Err is the error of a failed operation, nil if it succeeded.
+	Err error
+}
+
+// SetLogger sets the logger which failed operations are passed to, e.g. to
+// audit or trace slow and failing operations. If verbose is set, every
+// operation is passed. A nil logger disables logging, which then costs
+// nothing. It must be set before the store is used.
+func (s *ObjectStore) SetLogger(logger Logger, verbose bool) {
+	s.logger = logger
+	s.logVerbose = verbose
+}
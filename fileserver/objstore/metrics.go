@@ -0,0 +1,122 @@
+package objstore
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	opDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "seafile_objstore_op_duration_seconds",
+		Help:    "Duration of object store operations.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"obj_type", "operation"})
+
+	opErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "seafile_objstore_errors_total",
+		Help: "Number of failed object store operations.",
+	}, []string{"obj_type", "operation"})
+
+	inflightOps = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "seafile_objstore_inflight_ops",
+		Help: "Number of backend operations in progress, limited by max_concurrent_ops.",
+	}, []string{"obj_type"})
+
+	limitWait = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "seafile_objstore_limit_wait_seconds_total",
+		Help: "Total time operations waited for a slot under max_concurrent_ops.",
+	}, []string{"obj_type"})
+
+	rateLimitWait = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "seafile_objstore_rate_limit_wait_seconds_total",
+		Help: "Total time operations waited under the rate limits of the store section.",
+	}, []string{"obj_type", "operation"})
+)
+
+// expvarStats publishes cumulative counters of each object type on
+// /debug/vars, for deployments without Prometheus:
+//
+//	"seafile_objstore": {"blocks": {"reads": 10, "read_errors": 0, "bytes_out": 1024, ...}}
+var (
+	expvarStats = expvar.NewMap("seafile_objstore")
+	expvarLock  sync.Mutex
+)
+
+// expvarCounter returns the counter name of objType, creating it if needed.
+// Object stores of the same type share their counters.
+func expvarCounter(objType string, name string) *expvar.Int {
+	expvarLock.Lock()
+	defer expvarLock.Unlock()
+
+	stats, ok := expvarStats.Get(objType).(*expvar.Map)
+	if !ok {
+		stats = new(expvar.Map).Init()
+		expvarStats.Set(objType, stats)
+	}
+	counter, ok := stats.Get(name).(*expvar.Int)
+	if !ok {
+		counter = new(expvar.Int)
+		stats.Set(name, counter)
+	}
+	return counter
+}
+
+// Collectors returns the Prometheus collectors of object store metrics,
+// to be registered by the fileserver.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{opDuration, opErrors, inflightOps, limitWait, rateLimitWait}
+}
+
+// opMetrics holds the metrics of an operation on an object type.
+// They're resolved once per object store so that observing an operation
+// doesn't need to look up labels.
+type opMetrics struct {
+	duration prometheus.Observer
+	errors   prometheus.Counter
+	calls    *expvar.Int
+	failures *expvar.Int
+}
+
+type storeMetrics struct {
+	read   opMetrics
+	write  opMetrics
+	exists opMetrics
+	// bytesIn and bytesOut count the bytes written to and read from objects.
+	bytesIn  *expvar.Int
+	bytesOut *expvar.Int
+}
+
+// newOpMetrics returns the metrics of an operation, which is counted in
+// expvar as calls and its failures as operation+"_errors", e.g. reads and
+// read_errors.
+func newOpMetrics(objType string, operation string, calls string) opMetrics {
+	return opMetrics{
+		duration: opDuration.WithLabelValues(objType, operation),
+		errors:   opErrors.WithLabelValues(objType, operation),
+		calls:    expvarCounter(objType, calls),
+		failures: expvarCounter(objType, operation+"_errors"),
+	}
+}
+
+func newStoreMetrics(objType string) *storeMetrics {
+	m := new(storeMetrics)
+	m.read = newOpMetrics(objType, "read", "reads")
+	m.write = newOpMetrics(objType, "write", "writes")
+	m.exists = newOpMetrics(objType, "exists", "exists")
+	m.bytesIn = expvarCounter(objType, "bytes_in")
+	m.bytesOut = expvarCounter(objType, "bytes_out")
+	return m
+}
+
+// observe records an operation started at start and failed if err isn't nil.
+func (m opMetrics) observe(start time.Time, err error) {
+	m.duration.Observe(time.Since(start).Seconds())
+	m.calls.Add(1)
+	if err != nil {
+		m.errors.Inc()
+		m.failures.Add(1)
+	}
+}
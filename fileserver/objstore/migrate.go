@@ -0,0 +1,261 @@
+package objstore
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"sort"
+	"sync"
+)
+
+// migrateBatchSize is the number of objects checked in dst by one ExistsMany call.
+const migrateBatchSize = 1000
+
+// migrateSampleSize is the number of missing objects listed by a dry run.
+const migrateSampleSize = 20
+
+// MigrateOptions controls Migrate.
+type MigrateOptions struct {
+	// Workers is the number of objects migrated concurrently, 1 if not positive.
+	Workers int
+	// DeleteAfterCopy removes objects from src once they're verified in dst.
+	DeleteAfterCopy bool
+	// Progress is called after each object is processed, if not nil.
+	// It may be called concurrently from multiple workers.
+	Progress func(done int, total int)
+	// DryRun only finds the objects missing in dst, without writing or
+	// deleting anything. Their number is returned as copied.
+	DryRun bool
+	// Report is filled by a dry run, if not nil.
+	Report *MigrateReport
+}
+
+// MigrateReport describes what a migration would copy.
+type MigrateReport struct {
+	// Missing is the number of objects missing in dst.
+	Missing int
+	// Bytes is the total size of the missing objects in src.
+	Bytes int64
+	// Sample holds the smallest IDs of missing objects in sorted order,
+	// so runs against unchanged backends report the same objects.
+	Sample []string
+}
+
+// Migrate copies the objects of a repo from src to dst.
+// Objects already in dst are skipped, so an interrupted migration can be
+// resumed by running it again. Every copied object is read back from dst
+// and compared with the content read from src. It stops at the first
+// error and returns it along with the counts so far.
+func Migrate(src *ObjectStore, dst *ObjectStore, repoID string, opts MigrateOptions) (copied int, skipped int, err error) {
+	objIDs, err := src.List(repoID)
+	if err != nil {
+		return 0, 0, err
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	if opts.DryRun {
+		return migrateDryRun(src, dst, repoID, objIDs, workers, opts)
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	done := 0
+	finish := func(isCopied bool, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return
+		}
+		if isCopied {
+			copied++
+		} else {
+			skipped++
+		}
+		done++
+		if opts.Progress != nil {
+			opts.Progress(done, len(objIDs))
+		}
+	}
+	failed := func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return firstErr != nil
+	}
+
+	type job struct {
+		objID   string
+		present bool
+	}
+	jobs := make(chan job)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if failed() {
+					continue
+				}
+				finish(!j.present, migrateObject(src, dst, repoID, j.objID, j.present, opts.DeleteAfterCopy))
+			}
+		}()
+	}
+
+	for start := 0; start < len(objIDs) && !failed(); start += migrateBatchSize {
+		end := start + migrateBatchSize
+		if end > len(objIDs) {
+			end = len(objIDs)
+		}
+		present, err := dst.ExistsMany(repoID, objIDs[start:end])
+		if err != nil {
+			finish(false, err)
+			break
+		}
+		for _, objID := range objIDs[start:end] {
+			jobs <- job{objID, present[objID]}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr == nil {
+		firstErr = dst.Sync()
+	}
+	return copied, skipped, firstErr
+}
+
+// migrateDryRun finds the objects missing in dst with ExistsMany and adds
+// up their sizes in src, reporting progress as each object is checked.
+func migrateDryRun(src *ObjectStore, dst *ObjectStore, repoID string, objIDs []string, workers int, opts MigrateOptions) (missing int, present int, err error) {
+	var missingIDs []string
+	for start := 0; start < len(objIDs); start += migrateBatchSize {
+		end := start + migrateBatchSize
+		if end > len(objIDs) {
+			end = len(objIDs)
+		}
+		exists, err := dst.ExistsMany(repoID, objIDs[start:end])
+		if err != nil {
+			return len(missingIDs), present, err
+		}
+		for _, objID := range objIDs[start:end] {
+			if exists[objID] {
+				present++
+				if opts.Progress != nil {
+					opts.Progress(present, len(objIDs))
+				}
+			} else {
+				missingIDs = append(missingIDs, objID)
+			}
+		}
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	var bytes int64
+	done := present
+	ids := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for objID := range ids {
+				size, err := src.Stat(repoID, objID)
+				lock.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				bytes += size
+				done++
+				if err == nil && opts.Progress != nil {
+					opts.Progress(done, len(objIDs))
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, objID := range missingIDs {
+		ids <- objID
+	}
+	close(ids)
+	wg.Wait()
+	if firstErr != nil {
+		return len(missingIDs), present, firstErr
+	}
+
+	if opts.Report != nil {
+		sort.Strings(missingIDs)
+		sample := missingIDs
+		if len(sample) > migrateSampleSize {
+			sample = sample[:migrateSampleSize]
+		}
+		*opts.Report = MigrateReport{
+			Missing: len(missingIDs),
+			Bytes:   bytes,
+			Sample:  append([]string(nil), sample...),
+		}
+	}
+	return len(missingIDs), present, nil
+}
+
+// migrateObject copies an object to dst unless it's present, and then
+// deletes it from src if deleteAfterCopy is set.
+func migrateObject(src *ObjectStore, dst *ObjectStore, repoID string, objID string, present bool, deleteAfterCopy bool) error {
+	var checksum string
+	var err error
+	if present {
+		if !deleteAfterCopy {
+			return nil
+		}
+		// Don't delete the only good copy if dst has a different one.
+		checksum, err = objectChecksum(src, repoID, objID)
+	} else {
+		checksum, err = copyWithChecksum(src, dst, repoID, objID)
+	}
+	if err != nil {
+		return err
+	}
+
+	actual, err := objectChecksum(dst, repoID, objID)
+	if err != nil {
+		return err
+	}
+	if actual != checksum {
+		return &ChecksumError{Expected: checksum, Actual: actual}
+	}
+
+	if deleteAfterCopy {
+		return src.Delete(repoID, objID)
+	}
+	return nil
+}
+
+// copyWithChecksum streams an object from src to dst, returning the SHA1 of its content.
+func copyWithChecksum(src *ObjectStore, dst *ObjectStore, repoID string, objID string) (string, error) {
+	h := sha1.New()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(src.Read(repoID, objID, io.MultiWriter(pw, h)))
+	}()
+	err := dst.Write(repoID, objID, pr, false)
+	pr.CloseWithError(err)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// objectChecksum returns the SHA1 of an object's content.
+func objectChecksum(s *ObjectStore, repoID string, objID string) (string, error) {
+	h := sha1.New()
+	err := s.Read(repoID, objID, h)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,69 @@
+package objstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmapMaxSize is the size above which objects are read regularly even if
+// use_mmap is set, as mapping them isn't cheaper than streaming them.
+const mmapMaxSize = 16 * 1024 * 1024
+
+// readMmap writes the content of fd into w from a memory map of the file.
+// It returns false if the file can't be mapped, in which case nothing has
+// been written and the caller should read it regularly.
+//
+// The mapping is bounded to the size of the file when it's opened. Objects
+// are immutable, but if the file is truncated anyway, the fault of reading
+// a page past its end is turned into an error instead of crashing. Only
+// faults copying out of the mapping are, so the mapping is copied to w in
+// chunks of a pooled buffer.
+func readMmap(ctx context.Context, fd *os.File, w io.Writer) (ok bool, err error) {
+	info, err := fd.Stat()
+	if err != nil || info.Size() == 0 || info.Size() > mmapMaxSize {
+		return false, nil
+	}
+	data, err := unix.Mmap(int(fd.Fd()), 0, int(info.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return false, nil
+	}
+	defer unix.Munmap(data)
+
+	buf := defaultBuffers.pool.Get().(*[]byte)
+	defer defaultBuffers.pool.Put(buf)
+	for len(data) > 0 {
+		if err := ctx.Err(); err != nil {
+			return true, err
+		}
+		n, err := copyMapped(fd.Name(), *buf, data)
+		if err != nil {
+			return true, err
+		}
+		if _, err := w.Write((*buf)[:n]); err != nil {
+			return true, err
+		}
+		data = data[n:]
+	}
+	return true, nil
+}
+
+// copyMapped copies the start of the mapping of the file name into buf.
+func copyMapped(name string, buf []byte, data []byte) (n int, err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			rerr, isRuntime := r.(runtime.Error)
+			if !isRuntime {
+				panic(r)
+			}
+			err = &Error{ErrBackendUnavailable, fmt.Errorf("object file %s changed while mapped: %v", name, rerr)}
+		}
+	}()
+	return copy(buf, data), nil
+}
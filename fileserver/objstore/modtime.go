@@ -0,0 +1,101 @@
+package objstore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// modTimer is implemented by backends that know when objects were written.
+type modTimer interface {
+	modTime(repoID string, objID string) (time.Time, error)
+}
+
+// ModTime returns when an object was last written. As objects are
+// immutable, that's when it was first written unless it was deleted in
+// between, so List and ModTime can find objects that haven't been written
+// for a while, e.g. to move them to cheaper storage. It returns
+// ErrObjectNotExist if the object is missing.
+func (s *ObjectStore) ModTime(repoID string, objID string) (time.Time, error) {
+	return modTimeBackend(s.backend, repoID, objID)
+}
+
+// modTimeBackend asks the backends in the tree rooted at b in turn until
+// one of them finds the object. Decorators don't change when objects were
+// written, so they're looked through.
+func modTimeBackend(b storageBackend, repoID string, objID string) (time.Time, error) {
+	if m, ok := b.(modTimer); ok {
+		return m.modTime(repoID, objID)
+	}
+	u, ok := b.(unwrapper)
+	if !ok {
+		return time.Time{}, ErrNotSupported
+	}
+	err := ErrNotSupported
+	for _, inner := range u.unwrap() {
+		var t time.Time
+		t, err = modTimeBackend(inner, repoID, objID)
+		if !errors.Is(err, ErrObjectNotExist) && !errors.Is(err, ErrNotSupported) {
+			return t, err
+		}
+	}
+	return time.Time{}, err
+}
+
+// modTime returns the modification time of an object file. That of objects
+// with TTL is their expiry time, so the time of its change is returned,
+// which is when the expiry was set.
+func (b *fsBackend) modTime(repoID string, objID string) (time.Time, error) {
+	if err := checkIDs(repoID, objID); err != nil {
+		return time.Time{}, err
+	}
+	info, err := os.Stat(b.objectPath(repoID, objID))
+	if err == nil {
+		return info.ModTime(), nil
+	}
+	if !os.IsNotExist(err) {
+		return time.Time{}, fsError(err)
+	}
+
+	info, err = b.statObject(repoID, objID)
+	if err != nil {
+		return time.Time{}, objectError(err)
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Ctim.Sec, st.Ctim.Nsec), nil
+	}
+	return info.ModTime(), nil
+}
+
+func (b *s3Backend) modTime(repoID string, objID string) (time.Time, error) {
+	output, err := b.head(context.Background(), repoID, objID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return aws.TimeValue(output.LastModified), nil
+}
+
+func (b *gcsBackend) modTime(repoID string, objID string) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gcsRPCTimeout)
+	defer cancel()
+	attrs, err := b.object(repoID, objID).Attrs(ctx)
+	if err != nil {
+		return time.Time{}, mapGCSError(err)
+	}
+	return attrs.Updated, nil
+}
+
+func (b *azureBackend) modTime(repoID string, objID string) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), azureRPCTimeout)
+	defer cancel()
+	props, err := b.blob(repoID, objID).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return time.Time{}, mapAzureError(err)
+	}
+	return props.LastModified(), nil
+}
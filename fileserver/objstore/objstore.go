@@ -3,7 +3,14 @@
 package objstore
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 // ObjectStore is a container to access storage backend
@@ -11,46 +18,623 @@ type ObjectStore struct {
 	// can be "commit", "fs", or "block"
 	ObjType string
 	backend storageBackend
+	// directory of seafile.conf, for reloading configuration
+	confPath    string
+	backendType string
+	metrics     *storeMetrics
+	quota       QuotaChecker
+	// readOnly is 1 when writes and deletes are rejected, accessed atomically.
+	readOnly int32
+	// maxReadBytes is the size of the largest object ReadBytes buffers.
+	maxReadBytes int64
+	// tempFileMaxAge is the age after which CleanupTempFiles removes temp files.
+	tempFileMaxAge time.Duration
+	// closed is 1 once Close is called, accessed atomically.
+	closed int32
+	// verifyOnWrite makes writes of blocks check their content hashes to the object ID.
+	verifyOnWrite bool
+	// logger is passed failed operations, and all of them if logVerbose is set.
+	logger     Logger
+	logVerbose bool
 }
 
 // storageBackend is the interface implemented by storage backends.
 // An object store may have one or multiple storage backends.
 type storageBackend interface {
 	// Read an object from backend and write the contents into w.
-	read(repoID string, objID string, w io.Writer) (err error)
+	// The read is aborted with ctx.Err() when ctx is done.
+	read(ctx context.Context, repoID string, objID string, w io.Writer) (err error)
 	// Write the contents from r to the object.
-	write(repoID string, objID string, r io.Reader, sync bool) (err error)
+	// The write is aborted with ctx.Err() when ctx is done.
+	write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) (err error)
 	// exists checks whether an object exists.
 	exists(repoID string, objID string) (res bool, err error)
-	// stat calculates an object's size
+	// stat calculates an object's size.
+	// It returns ErrObjectNotExist if the object is missing.
 	stat(repoID string, objID string) (res int64, err error)
+	// delete removes an object. Deleting a missing object is not an error.
+	delete(repoID string, objID string) (err error)
+	// list calls fn for every object of a repo, and stops at the first error returned by fn.
+	list(repoID string, fn func(objID string) error) (err error)
 }
 
 // New returns a new object store for a given type of objects.
 // objType can be "commit", "fs", or "block".
-func New(seafileConfPath string, seafileDataDir string, objType string) *ObjectStore {
+// The backend is chosen by the type option of the object type's backend
+// section in seafile.conf, or of the object_backend section shared by all
+// types, it's the file system if not configured.
+// The object store starts read-only if read_only of the store section is true,
+// and max_read_bytes of the section limits the size of objects ReadBytes reads.
+// Writes of blocks are rejected with ErrChecksumMismatch unless their content
+// hashes to the block ID if verify_on_write of the section is true.
+//
+// The backend is probed before New returns, so a missing or unwritable data
+// directory or an unreachable object store fails at startup rather than on
+// the first request.
+func New(seafileConfPath string, seafileDataDir string, objType string) (*ObjectStore, error) {
 	obj := new(ObjectStore)
 	obj.ObjType = objType
-	obj.backend, _ = newFSBackend(seafileDataDir, objType)
-	return obj
+	obj.confPath = seafileConfPath
+	obj.metrics = newStoreMetrics(objType)
+	obj.maxReadBytes = defaultMaxReadBytes
+	backend, err := newBackend(seafileConfPath, seafileDataDir, objType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s object store: %w", objType, err)
+	}
+	obj.backend = backend
+	if config, err := loadConfig(seafileConfPath); err == nil {
+		obj.backendType = backendType(config, objType)
+		readOnly, _ := strconv.ParseBool(configValue(config, "store", "read_only"))
+		obj.SetReadOnly(readOnly)
+		if size, err := parseSize(configValue(config, "store", "max_read_bytes")); err == nil && size > 0 {
+			obj.maxReadBytes = size
+		}
+		if age, err := time.ParseDuration(configValue(config, "store", "temp_file_max_age")); err == nil {
+			obj.tempFileMaxAge = age
+		}
+		if algo := configValue(config, "store", "hash_algo"); algo != "" {
+			if err := configureHashAlgo(HashAlgo(algo)); err != nil {
+				closeBackend(obj.backend)
+				return nil, fmt.Errorf("invalid hash_algo of store: %w", err)
+			}
+		}
+		verify, _ := strconv.ParseBool(configValue(config, "store", "verify_on_write"))
+		obj.verifyOnWrite = verify && isBlockType(objType)
+	}
+
+	if err := probeBackend(obj.backend, !obj.IsReadOnly()); err != nil {
+		closeBackend(obj.backend)
+		return nil, fmt.Errorf("%s object store is not usable: %w", objType, err)
+	}
+	return obj, nil
+}
+
+func newBackend(seafileConfPath string, seafileDataDir string, objType string) (storageBackend, error) {
+	config, err := loadConfig(seafileConfPath)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := backendConf(config, objType)
+	conf["obj_type"] = objType
+	if conf["data_dir"] == "" {
+		conf["data_dir"] = seafileDataDir
+	}
+	if conf["copy_buffer_size"] == "" {
+		conf["copy_buffer_size"] = configValue(config, "store", "copy_buffer_size")
+	}
+	if conf["layout"] == "" {
+		conf["layout"] = configValue(config, "store", "layout")
+	}
+	if conf["use_mmap"] == "" {
+		conf["use_mmap"] = configValue(config, "store", "use_mmap")
+	}
+	for _, key := range []string{"dir_mode", "file_mode", "create_data_dir"} {
+		if conf[key] == "" {
+			conf[key] = configValue(config, "store", key)
+		}
+	}
+
+	backend, err := createBackend(backendType(config, objType), conf)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend of %s objects in [%s] of seafile.conf: %w", objType, backendSection(config, objType), err)
+	}
+
+	// Each attempt of a retried write checks that its object is visible.
+	backend, err = readbackFromConfig(config, backendType(config, objType), backend)
+	if err != nil {
+		return nil, err
+	}
+
+	// Timeouts bound the backend calls themselves, not the wait for a slot
+	// of the limit.
+	backend, err = timeoutFromConfig(config, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	// The limit applies to each attempt, so retries wait for their backoff
+	// without holding a slot.
+	if maxOpsStr := configValue(config, "store", "max_concurrent_ops"); maxOpsStr != "" {
+		maxOps, err := strconv.ParseInt(maxOpsStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_concurrent_ops of store: %w", err)
+		}
+		if maxOps > 0 {
+			backend = newLimitingBackend(backend, maxOps, objType)
+		}
+	}
+
+	// Waiting under the rate limits doesn't hold a slot of the limit, and
+	// every attempt of a retried operation counts against the rates.
+	backend, err = rateLimitFromConfig(config, objType, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	if retriesStr := configValue(config, "store", "max_retries"); retriesStr != "" {
+		maxRetries, err := strconv.Atoi(retriesStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_retries of store: %w", err)
+		}
+		if maxRetries > 0 {
+			backend = newRetryingBackend(backend, maxRetries)
+		}
+	}
+
+	// Cache misses are fetched with retries, and cached objects stay
+	// encrypted on the local disk.
+	backend, err = diskCacheFromConfig(config, backendType(config, objType), objType, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	// Queued objects are already compressed and encrypted, so they take
+	// less memory.
+	backend, err = asyncWriteFromConfig(config, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	// Objects are compressed before they're encrypted, as ciphertext doesn't compress.
+	backend, err = encryptionFromConfig(config, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isBlockType(objType) {
+		compress, _ := strconv.ParseBool(configValue(config, "store", "compress_objects"))
+		if compress {
+			level := 3
+			if levelStr := configValue(config, "store", "compression_level"); levelStr != "" {
+				if level, err = strconv.Atoi(levelStr); err != nil {
+					return nil, fmt.Errorf("invalid compression_level of store: %w", err)
+				}
+			}
+			backend, err = newCompressingBackend(backend, level)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if objType == "fs" {
+		if sizeStr := configValue(config, "fs_object_cache", "size"); sizeStr != "" {
+			size, err := parseSize(sizeStr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size of fs_object_cache: %w", err)
+			}
+			if size > 0 {
+				backend = newCachingBackend(backend, size)
+			}
+		}
+	}
+
+	return negativeCacheFromConfig(config, backend)
 }
 
 //Read data from storage backends.
 func (s *ObjectStore) Read(repoID string, objID string, w io.Writer) (err error) {
-	return s.backend.read(repoID, objID, w)
+	return s.ReadCtx(context.Background(), repoID, objID, w)
+}
+
+// ReadCtx reads data from storage backends and aborts when ctx is done.
+func (s *ObjectStore) ReadCtx(ctx context.Context, repoID string, objID string, w io.Writer) (err error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "read", repoID, objID)
+	// The bytes read are counted once for the span and bytes_out, with a
+	// pooled writer for reads that aren't traced or logged.
+	var cw *countingWriter
+	if span != nil {
+		span.writer(w)
+		cw = span.cw
+	} else {
+		cw = getCountingWriter(w)
+		defer putCountingWriter(cw)
+	}
+	err = s.backend.read(ctx, repoID, objID, cw)
+	span.end(err)
+	s.metrics.read.observe(start, err)
+	s.metrics.bytesOut.Add(cw.n)
+	return err
 }
 
 //Write data to storage backends.
 func (s *ObjectStore) Write(repoID string, objID string, r io.Reader, sync bool) (err error) {
-	return s.backend.write(repoID, objID, r, sync)
+	return s.WriteCtx(context.Background(), repoID, objID, r, sync)
+}
+
+// WriteCtx writes data to storage backends and aborts when ctx is done.
+// An aborted write never leaves a partial object behind.
+func (s *ObjectStore) WriteCtx(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) (err error) {
+	return s.WriteWithOptions(ctx, repoID, objID, r, WriteOptions{Sync: sync})
+}
+
+// WriteOptions controls how WriteWithOptions writes an object.
+type WriteOptions struct {
+	// Sync makes the object durable before the write returns.
+	Sync bool
+	// SkipIfExists returns without writing if the object already exists.
+	// Objects are content-addressed, so an existing object already has the
+	// same contents. The reader is left unconsumed when the write is skipped.
+	SkipIfExists bool
+	// DrainOnSkip reads the reader to the end when the write is skipped,
+	// for callers that rely on the reader being fully consumed, e.g. to
+	// compute a checksum while writing.
+	DrainOnSkip bool
+}
+
+// WriteWithOptions writes data to storage backends like WriteCtx, with the
+// behaviour controlled by opts.
+func (s *ObjectStore) WriteWithOptions(ctx context.Context, repoID string, objID string, r io.Reader, opts WriteOptions) (err error) {
+	return s.write(ctx, repoID, objID, r, -1, opts)
+}
+
+// write writes an object of size bytes, or of unknown size if size is negative.
+func (s *ObjectStore) write(ctx context.Context, repoID string, objID string, r io.Reader, size int64, opts WriteOptions) (err error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "write", repoID, objID)
+	defer func() {
+		span.end(err)
+	}()
+	r = span.reader(r)
+	if s.IsReadOnly() {
+		s.metrics.write.observe(start, ErrReadOnly)
+		return ErrReadOnly
+	}
+	if opts.SkipIfExists {
+		exists, err := s.backend.exists(repoID, objID)
+		if err != nil {
+			s.metrics.write.observe(start, err)
+			return err
+		}
+		if exists {
+			if opts.DrainOnSkip {
+				_, err = copyCtx(ctx, ioutil.Discard, r)
+			}
+			s.metrics.write.observe(start, err)
+			return err
+		}
+	}
+	if s.quota != nil {
+		r, err = checkQuota(s.quota, repoID, r)
+		if err != nil {
+			s.metrics.write.observe(start, err)
+			return err
+		}
+	}
+	cr, r := countReader(r)
+	defer func() {
+		s.metrics.bytesIn.Add(cr.n)
+	}()
+	r = s.verifyingReader(objID, r)
+	if size >= 0 {
+		r = newExactReader(r, objID, size)
+		if b, ok := s.backend.(sizedWriter); ok {
+			err = b.writeSized(ctx, repoID, objID, r, size, opts.Sync)
+			s.metrics.write.observe(start, err)
+			return err
+		}
+	}
+	err = s.backend.write(ctx, repoID, objID, r, opts.Sync)
+	s.metrics.write.observe(start, err)
+	return err
 }
 
 //Check whether object exists.
 func (s *ObjectStore) Exists(repoID string, objID string) (res bool, err error) {
-	return s.backend.exists(repoID, objID)
+	return s.ExistsCtx(context.Background(), repoID, objID)
+}
+
+// ExistsCtx checks whether object exists like Exists, tracing the check as
+// part of the span in ctx.
+func (s *ObjectStore) ExistsCtx(ctx context.Context, repoID string, objID string) (res bool, err error) {
+	start := time.Now()
+	_, span := s.startSpan(ctx, "exists", repoID, objID)
+	res, err = s.backend.exists(repoID, objID)
+	span.end(err)
+	s.metrics.exists.observe(start, err)
+	return res, err
 }
 
 // Stat calculates object size.
+// It returns ErrObjectNotExist if the object is not found.
 func (s *ObjectStore) Stat(repoID string, objID string) (res int64, err error) {
-	return s.backend.stat(repoID, objID)
+	_, span := s.startSpan(context.Background(), "stat", repoID, objID)
+	res, err = s.backend.stat(repoID, objID)
+	span.end(err)
+	return res, err
+}
+
+// Delete removes an object from storage backends.
+// It's safe to delete an object that doesn't exist.
+func (s *ObjectStore) Delete(repoID string, objID string) (err error) {
+	_, span := s.startSpan(context.Background(), "delete", repoID, objID)
+	defer func() {
+		span.end(err)
+	}()
+	if s.IsReadOnly() {
+		return ErrReadOnly
+	}
+	return s.backend.delete(repoID, objID)
+}
+
+// SetReadOnly switches the object store into or out of read-only mode, e.g.
+// for taking a snapshot of the storage. While read-only, writes and deletes
+// fail with ErrReadOnly without reaching the backend; reads are unaffected.
+// Operations already in progress when it's called aren't interrupted.
+func (s *ObjectStore) SetReadOnly(readOnly bool) {
+	var v int32
+	if readOnly {
+		v = 1
+	}
+	atomic.StoreInt32(&s.readOnly, v)
+}
+
+// IsReadOnly reports whether the object store is in read-only mode.
+func (s *ObjectStore) IsReadOnly() bool {
+	return atomic.LoadInt32(&s.readOnly) == 1
+}
+
+// Sync makes objects written with sync=false durable, so bulk imports can
+// write without per-object fsync and then call Sync once at the end.
+//
+// When Sync returns nil, every object whose Write returned before Sync was
+// called survives a crash. Objects written concurrently with Sync have no
+// such guarantee. Until Sync is called, a crash may lose objects written
+// with sync=false, and on file systems that don't order renames after data
+// it may leave them empty. It's a no-op for object-store backends, which
+// persist objects before write returns.
+func (s *ObjectStore) Sync() error {
+	return syncBackend(s.backend)
+}
+
+// Close releases the resources held by storage backends, such as idle
+// connections. It should be called on shutdown, after which the object
+// store must not be used. Calling Close more than once does nothing.
+func (s *ObjectStore) Close() error {
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		return nil
+	}
+	return closeBackend(s.backend)
+}
+
+// ExistsMany checks whether each of objIDs exists.
+// The result contains an entry for every requested objID.
+func (s *ObjectStore) ExistsMany(repoID string, objIDs []string) (map[string]bool, error) {
+	return existsManyBackend(s.backend, repoID, objIDs)
+}
+
+// existsManyBackend checks objects in a batch with the batchExister of b,
+// looking through transparent decorators, or else one by one through b.
+func existsManyBackend(b storageBackend, repoID string, objIDs []string) (map[string]bool, error) {
+	found := findCapability(b, "exists_many", func(b storageBackend) bool {
+		_, ok := b.(batchExister)
+		return ok
+	})
+	if found != nil {
+		return found.(batchExister).existsMany(repoID, objIDs)
+	}
+
+	res := make(map[string]bool, len(objIDs))
+	var firstErr error
+	for _, objID := range objIDs {
+		ret, err := b.exists(repoID, objID)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		res[objID] = ret && err == nil
+	}
+	return res, firstErr
+}
+
+// List returns the IDs of all objects in a repo.
+func (s *ObjectStore) List(repoID string) ([]string, error) {
+	var objIDs []string
+	err := s.ListIter(repoID, func(objID string) error {
+		objIDs = append(objIDs, objID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objIDs, nil
+}
+
+// ListIter calls fn for every object in a repo without holding all IDs in memory.
+// Iteration stops at the first error returned by fn, which is returned
+// unless it's ErrStopIteration.
+func (s *ObjectStore) ListIter(repoID string, fn func(objID string) error) error {
+	err := s.backend.list(repoID, fn)
+	if err == ErrStopIteration {
+		return nil
+	}
+	return err
+}
+
+// copier is implemented by backends that can copy objects between repos
+// without passing the content through the object store.
+type copier interface {
+	copy(srcRepoID string, dstRepoID string, objID string) error
+}
+
+// Copy copies an object from srcRepoID to dstRepoID.
+// It returns ErrObjectNotExist if the source object doesn't exist.
+func (s *ObjectStore) Copy(srcRepoID string, dstRepoID string, objID string) (err error) {
+	_, span := s.startSpan(context.Background(), "copy", dstRepoID, objID)
+	defer func() {
+		span.end(err)
+	}()
+	if s.IsReadOnly() {
+		return ErrReadOnly
+	}
+	return copyBackend(s.backend, srcRepoID, dstRepoID, objID)
+}
+
+// copyBackend copies an object server-side with the copier of b, looking
+// through transparent decorators, or else through b.
+func copyBackend(b storageBackend, srcRepoID string, dstRepoID string, objID string) error {
+	found := findCapability(b, "copy", func(b storageBackend) bool {
+		_, ok := b.(copier)
+		return ok
+	})
+	if found != nil {
+		return found.(copier).copy(srcRepoID, dstRepoID, objID)
+	}
+	return copyObject(b, b, srcRepoID, dstRepoID, objID)
+}
+
+// mover is implemented by backends that can move objects between repos
+// natively, e.g. by renaming files.
+type mover interface {
+	move(srcRepoID string, dstRepoID string, objID string) error
+}
+
+// Move moves an object from srcRepoID to dstRepoID. Backends without a
+// native move copy the object, server-side if possible, then delete the
+// source. An existing destination object has the same content, so it's
+// replaced and the source is still removed. It returns ErrObjectNotExist if
+// the source object doesn't exist.
+func (s *ObjectStore) Move(srcRepoID string, dstRepoID string, objID string) (err error) {
+	_, span := s.startSpan(context.Background(), "move", dstRepoID, objID)
+	defer func() {
+		span.end(err)
+	}()
+	if s.IsReadOnly() {
+		return ErrReadOnly
+	}
+	if srcRepoID == dstRepoID {
+		_, err := s.backend.stat(srcRepoID, objID)
+		return err
+	}
+	return moveBackend(s.backend, srcRepoID, dstRepoID, objID)
+}
+
+// moveBackend moves an object with the mover of b, looking through
+// transparent decorators, or else copies it and deletes the source.
+func moveBackend(b storageBackend, srcRepoID string, dstRepoID string, objID string) error {
+	found := findCapability(b, "move", func(b storageBackend) bool {
+		_, ok := b.(mover)
+		return ok
+	})
+	if found != nil {
+		return found.(mover).move(srcRepoID, dstRepoID, objID)
+	}
+
+	if err := copyBackend(b, srcRepoID, dstRepoID, objID); err != nil {
+		return err
+	}
+	return b.delete(srcRepoID, objID)
+}
+
+// copyObject streams an object from src backend to dst backend.
+// The write is aborted if reading fails, so no partial object is left in dst.
+func copyObject(src storageBackend, dst storageBackend, srcRepoID string, dstRepoID string, objID string) error {
+	if _, err := src.stat(srcRepoID, objID); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(src.read(ctx, srcRepoID, objID, pw))
+	}()
+	err := dst.write(ctx, dstRepoID, objID, pr, false)
+	pr.CloseWithError(err)
+	return err
+}
+
+func (s *ObjectStore) routingBackend() (*routingBackend, error) {
+	b := findBackend(s.backend, func(b storageBackend) bool {
+		_, ok := b.(*routingBackend)
+		return ok
+	})
+	if b == nil {
+		return nil, fmt.Errorf("%s object store doesn't use routing backend", s.ObjType)
+	}
+	return b.(*routingBackend), nil
+}
+
+// SetRoutingFunc sets a function returning the name of the backend owning a repo.
+// It takes precedence over the routes in seafile.conf, which are used when
+// lookup returns a name that isn't configured. It fails if the object store
+// doesn't use routing backend.
+func (s *ObjectStore) SetRoutingFunc(lookup func(repoID string) string) error {
+	b, err := s.routingBackend()
+	if err != nil {
+		return err
+	}
+	b.setLookup(lookup)
+	return nil
+}
+
+// ReloadRouting reloads the routes of routing backend from seafile.conf.
+// Operations started after it returns are resolved with the new routes.
+// Only routes are reloaded, adding backends requires a restart.
+func (s *ObjectStore) ReloadRouting() error {
+	b, err := s.routingBackend()
+	if err != nil {
+		return err
+	}
+	config, err := loadConfig(s.confPath)
+	if err != nil {
+		return err
+	}
+	return b.setRoutes(backendConf(config, s.ObjType)["routes"])
+}
+
+// repoStatter is implemented by backends that can sum up object sizes of a
+// repo more efficiently than stat-ing listed objects one by one.
+type repoStatter interface {
+	repoStats(repoID string) (objectCount int64, totalBytes int64, err error)
+}
+
+// RepoStats returns the number and total size of objects stored for a repo.
+// It's safe to call concurrently with writes and deletes; objects removed
+// during the walk are skipped.
+func (s *ObjectStore) RepoStats(repoID string) (objectCount int64, totalBytes int64, err error) {
+	found := findCapability(s.backend, "repo_stats", func(b storageBackend) bool {
+		_, ok := b.(repoStatter)
+		return ok
+	})
+	if found != nil {
+		return found.(repoStatter).repoStats(repoID)
+	}
+
+	err = s.backend.list(repoID, func(objID string) error {
+		size, err := s.backend.stat(repoID, objID)
+		if err != nil {
+			if errors.Is(err, ErrObjectNotExist) {
+				return nil
+			}
+			return err
+		}
+		objectCount++
+		totalBytes += size
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return objectCount, totalBytes, nil
 }
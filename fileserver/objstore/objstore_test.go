@@ -1,10 +1,33 @@
 package objstore
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/ini.v1"
 )
 
 const (
@@ -15,6 +38,15 @@ const (
 	objID           = "0401fc662e3bc87a41f299a907c056aaf8322a27"
 )
 
+func newTestStore(t *testing.T, dataDir string, objType string) *ObjectStore {
+	t.Helper()
+	store, err := New(seafileConfPath, dataDir, objType)
+	if err != nil {
+		t.Fatalf("Failed to create object store : %v\n", err)
+	}
+	return store
+}
+
 func createFile() error {
 	outputFile, err := os.OpenFile(testFile, os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
@@ -66,7 +98,7 @@ func testWrite(t *testing.T) {
 	}
 	defer inputFile.Close()
 
-	bend := New(seafileConfPath, seafileDataDir, "commit")
+	bend := newTestStore(t, seafileDataDir, "commit")
 	bend.Write(repoID, objID, inputFile, true)
 }
 
@@ -77,7 +109,7 @@ func testRead(t *testing.T) {
 	}
 	defer outputFile.Close()
 
-	bend := New(seafileConfPath, seafileDataDir, "commit")
+	bend := newTestStore(t, seafileDataDir, "commit")
 	err = bend.Read(repoID, objID, outputFile)
 	if err != nil {
 		t.Errorf("Failed to read backend : %s\n", err)
@@ -85,12 +117,17 @@ func testRead(t *testing.T) {
 }
 
 func testExists(t *testing.T) {
-	bend := New(seafileConfPath, seafileDataDir, "commit")
+	bend := newTestStore(t, seafileDataDir, "commit")
 	ret, _ := bend.Exists(repoID, objID)
 	if !ret {
 		t.Errorf("File is not exist\n")
 	}
 
+	size, err := bend.Stat(repoID, objID)
+	if err != nil || size != 130 {
+		t.Errorf("Failed to stat object : %d, %v\n", size, err)
+	}
+
 	filePath := path.Join(seafileDataDir, "storage", "commit", repoID, objID[:2], objID[2:])
 	fileInfo, _ := os.Stat(filePath)
 	if fileInfo.Size() != 130 {
@@ -98,8 +135,2911 @@ func testExists(t *testing.T) {
 	}
 }
 
+func testReadVerified(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "blocks")
+	content := []byte("hello world!\n")
+	checksum := sha1.Sum(content)
+	id := hex.EncodeToString(checksum[:])
+	err := bend.Write(repoID, id, bytes.NewReader(content), false)
+	if err != nil {
+		t.Errorf("Failed to write object : %v\n", err)
+	}
+	defer bend.Delete(repoID, id)
+	if err := bend.Write(repoID, objID, strings.NewReader("corrupt"), false); err != nil {
+		t.Errorf("Failed to write object : %v\n", err)
+	}
+	defer bend.Delete(repoID, objID)
+
+	var buf bytes.Buffer
+	err = bend.ReadVerified(repoID, id, &buf)
+	if err != nil || !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("Failed to read verified object : %v\n", err)
+	}
+
+	buf.Reset()
+	err = bend.ReadVerified(repoID, objID, &buf)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Reading corrupt object should fail with ErrChecksumMismatch, got %v\n", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Corrupt object content shouldn't be written.\n")
+	}
+
+	// Commit and fs objects aren't stored under the hash of their content.
+	commits := newTestStore(t, seafileDataDir, "commit")
+	if err := commits.ReadVerified(repoID, id, &buf); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Verifying a commit object should fail with ErrNotSupported, got %v\n", err)
+	}
+}
+
+func testExistsMany(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	missingID := "ffffffffffffffffffffffffffffffffffffffff"
+	res, err := bend.ExistsMany(repoID, []string{objID, missingID})
+	if err != nil {
+		t.Errorf("Failed to check objects : %v\n", err)
+	}
+	if len(res) != 2 || !res[objID] || res[missingID] {
+		t.Errorf("Unexpected result of ExistsMany : %v\n", res)
+	}
+}
+
+func testList(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	objIDs, err := bend.List(repoID)
+	if err != nil {
+		t.Errorf("Failed to list objects : %v\n", err)
+	}
+	found := false
+	for _, id := range objIDs {
+		if id == objID {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Object %s is not listed in %v\n", objID, objIDs)
+	}
+
+	count := 0
+	err = bend.ListIter(repoID, func(objID string) error {
+		count++
+		return ErrStopIteration
+	})
+	if err != nil || count != 1 {
+		t.Errorf("Failed to stop iteration : %d, %v\n", count, err)
+	}
+}
+
+func testCopy(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	dstRepoID := "c0dcbc35-7fd2-4d1a-9b51-4e1b5a98e3e1"
+	err := bend.Copy(repoID, dstRepoID, objID)
+	if err != nil {
+		t.Errorf("Failed to copy object : %v\n", err)
+	}
+	size, _ := bend.Stat(dstRepoID, objID)
+	if size != 130 {
+		t.Errorf("Copied object has wrong size %d.\n", size)
+	}
+
+	missingID := "ffffffffffffffffffffffffffffffffffffffff"
+	err = bend.Copy(repoID, dstRepoID, missingID)
+	if err != ErrObjectNotExist {
+		t.Errorf("Copying missing object should fail with ErrObjectNotExist, got %v\n", err)
+	}
+	if ret, _ := bend.Exists(dstRepoID, missingID); ret {
+		t.Errorf("Copying missing object shouldn't create destination.\n")
+	}
+}
+
+func testSync(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	err := bend.Sync()
+	if err != nil {
+		t.Errorf("Failed to sync object store : %v\n", err)
+	}
+}
+
+func testRepoStats(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	count, total, err := bend.RepoStats(repoID)
+	if err != nil || count < 1 || total < 130 {
+		t.Errorf("Unexpected repo stats : %d objects, %d bytes, %v\n", count, total, err)
+	}
+
+	cached := &ObjectStore{ObjType: "commit", backend: newCachingBackend(bend.backend, 1<<20)}
+	cachedCount, cachedTotal, err := cached.RepoStats(repoID)
+	if err != nil || cachedCount != count || cachedTotal != total {
+		t.Errorf("Repo stats from listing differs : %d objects, %d bytes, %v\n", cachedCount, cachedTotal, err)
+	}
+}
+
+func testDelete(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	err := bend.Delete(repoID, objID)
+	if err != nil {
+		t.Errorf("Failed to delete object : %v\n", err)
+	}
+
+	ret, err := bend.Exists(repoID, objID)
+	if ret || err != nil {
+		t.Errorf("Object still exists after delete : %v\n", err)
+	}
+
+	_, err = bend.Stat(repoID, objID)
+	if err != ErrObjectNotExist {
+		t.Errorf("Stat on deleted object should return ErrObjectNotExist, got %v\n", err)
+	}
+
+	err = bend.Delete(repoID, objID)
+	if err != nil {
+		t.Errorf("Failed to delete missing object : %v\n", err)
+	}
+
+	err = bend.Delete("a57c9d34-2e03-4b4c-8b81-bd20fa0d4785", objID)
+	if err == nil {
+		t.Errorf("Deleting object of a missing repo should fail.\n")
+	}
+}
+
 func TestObjStore(t *testing.T) {
 	testWrite(t)
 	testRead(t)
 	testExists(t)
+	testExistsMany(t)
+	testReadVerified(t)
+	testList(t)
+	testCopy(t)
+	testSync(t)
+	testRepoStats(t)
+	testDelete(t)
+}
+
+func TestWriteCtxCanceled(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	id := "1c2a4e9d0b3f7e6a5d8c9b0a1f2e3d4c5b6a7980"
+	err := bend.WriteCtx(ctx, repoID, id, bytes.NewReader([]byte("hello world!\n")), false)
+	if err != context.Canceled {
+		t.Errorf("Write with canceled context should fail with context.Canceled, got %v\n", err)
+	}
+
+	ret, _ := bend.Exists(repoID, id)
+	if ret {
+		t.Errorf("Canceled write shouldn't create the object.\n")
+	}
+}
+
+func TestUnknownBackend(t *testing.T) {
+	_, err := createBackend("nosuch", map[string]string{})
+	if err == nil || !strings.Contains(err.Error(), "fs") || !strings.Contains(err.Error(), "s3") {
+		t.Errorf("Unknown backend type should list available types, got %v\n", err)
+	}
+}
+
+func TestCachingBackend(t *testing.T) {
+	fsBend, err := newFSBackend(seafileDataDir, "fs")
+	if err != nil {
+		t.Fatalf("Failed to create fs backend : %v\n", err)
+	}
+	cache := newCachingBackend(fsBend, 20)
+	ctx := context.Background()
+
+	ids := []string{"1111111111111111111111111111111111111111", "2222222222222222222222222222222222222222"}
+	for _, id := range ids {
+		err := cache.write(ctx, repoID, id, bytes.NewReader([]byte("0123456789ab")), false)
+		if err != nil {
+			t.Errorf("Failed to write object : %v\n", err)
+		}
+		var buf bytes.Buffer
+		err = cache.read(ctx, repoID, id, &buf)
+		if err != nil || buf.String() != "0123456789ab" {
+			t.Errorf("Failed to read object : %v\n", err)
+		}
+	}
+
+	if _, ok := cache.get(cacheKey(repoID, ids[0])); ok {
+		t.Errorf("Least recently used object should be evicted.\n")
+	}
+	if _, ok := cache.get(cacheKey(repoID, ids[1])); !ok {
+		t.Errorf("Recently read object should be cached.\n")
+	}
+	if cache.size != 12 {
+		t.Errorf("Cache size should be 12, got %d.\n", cache.size)
+	}
+}
+
+// flakyBackend fails the first failures reads with a connection reset.
+type flakyBackend struct {
+	storageBackend
+	failures int
+}
+
+func (b *flakyBackend) read(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	if b.failures > 0 {
+		b.failures--
+		w.Write([]byte("hello"))
+		return syscall.ECONNRESET
+	}
+	return b.storageBackend.read(ctx, repoID, objID, w)
+}
+
+func TestRetryingBackend(t *testing.T) {
+	fsBend, err := newFSBackend(seafileDataDir, "commit")
+	if err != nil {
+		t.Fatalf("Failed to create fs backend : %v\n", err)
+	}
+	id := "3333333333333333333333333333333333333333"
+	content := "hello world!\n"
+	err = fsBend.write(context.Background(), repoID, id, strings.NewReader(content), false)
+	if err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+
+	retry := newRetryingBackend(&flakyBackend{fsBend, 2}, 2)
+	var buf bytes.Buffer
+	err = retry.read(context.Background(), repoID, id, &buf)
+	if err != nil || buf.String() != content {
+		t.Errorf("Failed to read object after retries : %q, %v\n", buf.String(), err)
+	}
+
+	retry = newRetryingBackend(&flakyBackend{fsBend, 3}, 2)
+	err = retry.read(context.Background(), repoID, id, ioutil.Discard)
+	if err != syscall.ECONNRESET {
+		t.Errorf("Read should fail after max retries, got %v\n", err)
+	}
+
+	if IsRetryable(ErrObjectNotExist) {
+		t.Errorf("ErrObjectNotExist shouldn't be retryable.\n")
+	}
+	for _, err := range []error{ErrInvalidObjectID, ErrQuotaExceeded, &ChecksumError{objID, id}, ErrReadOnly} {
+		if IsRetryable(fmt.Errorf("write: %w", err)) {
+			t.Errorf("Caller error %v shouldn't be retryable.\n", err)
+		}
+	}
+
+	// A write which consumed part of content that can't be rewound fails
+	// with its own error.
+	body := struct{ io.Reader }{strings.NewReader("not rewindable")}
+	retry = newRetryingBackend(&flakyWriteBackend{fsBend, 1}, 2)
+	err = retry.write(context.Background(), repoID, id, body, false)
+	if err != syscall.ECONNRESET {
+		t.Errorf("Write of content that can't be rewound should fail with its error, got %v\n", err)
+	}
+}
+
+// slowBackend counts concurrent reads, each of which takes a while.
+type slowBackend struct {
+	storageBackend
+	mu      sync.Mutex
+	current int
+	max     int
+}
+
+func (b *slowBackend) read(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	b.mu.Lock()
+	b.current++
+	if b.current > b.max {
+		b.max = b.current
+	}
+	b.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	b.mu.Lock()
+	b.current--
+	b.mu.Unlock()
+	return nil
+}
+
+func TestLimitingBackend(t *testing.T) {
+	slow := &slowBackend{}
+	bend := newLimitingBackend(slow, 2, "commit")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bend.read(context.Background(), repoID, objID, ioutil.Discard)
+		}()
+	}
+	wg.Wait()
+	if slow.max != 2 {
+		t.Errorf("%d reads ran concurrently, expected 2\n", slow.max)
+	}
+
+	// Fill the slots, so the next read waits until its context is done.
+	bend.acquire(context.Background())
+	bend.acquire(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := bend.read(ctx, repoID, objID, ioutil.Discard)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Waiting read should fail with the context error, got %v\n", err)
+	}
+	bend.release()
+	bend.release()
+}
+
+func TestRoutingBackend(t *testing.T) {
+	conf := map[string]string{
+		"obj_type":      "commit",
+		"data_dir":      seafileDataDir,
+		"default":       "hot",
+		"routes":        "b1f2:cold",
+		"hot.type":      "fs",
+		"cold.type":     "fs",
+		"cold.data_dir": path.Join(seafileDataDir, "cold"),
+	}
+	route, err := newRoutingBackend(conf)
+	if err != nil {
+		t.Fatalf("Failed to create routing backend : %v\n", err)
+	}
+	if route.resolve(repoID) != route.backends["cold"] {
+		t.Errorf("Repo %s should be routed to cold backend.\n", repoID)
+	}
+
+	err = route.setRoutes("")
+	if err != nil {
+		t.Errorf("Failed to reset routes : %v\n", err)
+	}
+	if route.resolve(repoID) != route.backends["hot"] {
+		t.Errorf("Repo %s should be routed to default backend.\n", repoID)
+	}
+
+	route.setLookup(func(repoID string) string { return "cold" })
+	if route.resolve(repoID) != route.backends["cold"] {
+		t.Errorf("Repo %s should be routed by lookup function.\n", repoID)
+	}
+
+	if err := route.setRoutes("b1f2:nosuch"); err == nil {
+		t.Errorf("Route to unknown backend should fail.\n")
+	}
+}
+
+func TestTieredBackend(t *testing.T) {
+	conf := map[string]string{
+		"obj_type":     "commit",
+		"tiers":        "new, old",
+		"promote":      "true",
+		"new.data_dir": path.Join(seafileDataDir, "new"),
+		"old.data_dir": path.Join(seafileDataDir, "old"),
+	}
+	bend, err := newTieredBackend(conf)
+	if err != nil {
+		t.Fatalf("Failed to create tiered backend : %v\n", err)
+	}
+	primary, old := bend.tiers[0], bend.tiers[1]
+
+	id := "7a7a7a7a7a7a7a7a7a7a7a7a7a7a7a7a7a7a7a7a"
+	err = old.write(context.Background(), repoID, id, strings.NewReader("old content"), false)
+	if err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+	if ret, _ := bend.exists(repoID, id); !ret {
+		t.Errorf("Object of the secondary backend should exist.\n")
+	}
+
+	var buf bytes.Buffer
+	err = bend.read(context.Background(), repoID, id, &buf)
+	if err != nil || buf.String() != "old content" {
+		t.Errorf("Failed to read object from the secondary backend : %v\n", err)
+	}
+	if ret, _ := primary.exists(repoID, id); !ret {
+		t.Errorf("Object read from the secondary backend should be promoted.\n")
+	}
+
+	newID := "7b7b7b7b7b7b7b7b7b7b7b7b7b7b7b7b7b7b7b7b"
+	err = bend.write(context.Background(), repoID, newID, strings.NewReader("new content"), false)
+	if err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+	if ret, _ := old.exists(repoID, newID); ret {
+		t.Errorf("Objects should only be written to the primary backend.\n")
+	}
+
+	var listed []string
+	bend.list(repoID, func(objID string) error {
+		listed = append(listed, objID)
+		return nil
+	})
+	if len(listed) != 2 {
+		t.Errorf("Objects in both tiers should be listed once, got %v\n", listed)
+	}
+
+	bend.delete(repoID, id)
+	if ret, _ := bend.exists(repoID, id); ret {
+		t.Errorf("Object should be deleted from every tier.\n")
+	}
+}
+
+func TestCompressingBackend(t *testing.T) {
+	fsBend, err := newFSBackend(seafileDataDir, "fs")
+	if err != nil {
+		t.Fatalf("Failed to create fs backend : %v\n", err)
+	}
+	comp, err := newCompressingBackend(fsBend, 3)
+	if err != nil {
+		t.Fatalf("Failed to create compressing backend : %v\n", err)
+	}
+	ctx := context.Background()
+	content := strings.Repeat("hello world!\n", 100)
+
+	id := "4444444444444444444444444444444444444444"
+	err = comp.write(ctx, repoID, id, strings.NewReader(content), false)
+	if err != nil {
+		t.Errorf("Failed to write object : %v\n", err)
+	}
+	stored, _ := fsBend.stat(repoID, id)
+	if stored >= int64(len(content)) {
+		t.Errorf("Object isn't compressed, stored size is %d.\n", stored)
+	}
+	size, err := comp.stat(repoID, id)
+	if err != nil || size != int64(len(content)) {
+		t.Errorf("Stat should return uncompressed size, got %d, %v\n", size, err)
+	}
+
+	var buf bytes.Buffer
+	err = comp.read(ctx, repoID, id, &buf)
+	if err != nil || buf.String() != content {
+		t.Errorf("Failed to read compressed object : %v\n", err)
+	}
+}
+
+func TestCompressionDetection(t *testing.T) {
+	fsBend, err := newFSBackend(seafileDataDir, "fs")
+	if err != nil {
+		t.Fatalf("Failed to create fs backend : %v\n", err)
+	}
+	ctx := context.Background()
+	content := strings.Repeat("hello world!\n", 100)
+
+	// Objects written before compression was enabled, including one
+	// shorter than the header.
+	before := map[string]string{
+		"4545454545454545454545454545454545454545": content,
+		"4646464646464646464646464646464646464646": "short",
+		"4747474747474747474747474747474747474747": "",
+	}
+	for id, data := range before {
+		err := fsBend.write(ctx, repoID, id, strings.NewReader(data), false)
+		if err != nil {
+			t.Fatalf("Failed to write object : %v\n", err)
+		}
+	}
+
+	comp, err := newCompressingBackend(fsBend, 3)
+	if err != nil {
+		t.Fatalf("Failed to create compressing backend : %v\n", err)
+	}
+	after := map[string]string{"4848484848484848484848484848484848484848": content}
+	for id, data := range after {
+		err := comp.write(ctx, repoID, id, strings.NewReader(data), false)
+		if err != nil {
+			t.Fatalf("Failed to write object : %v\n", err)
+		}
+	}
+
+	for _, objects := range []map[string]string{before, after} {
+		for id, data := range objects {
+			var buf bytes.Buffer
+			err := comp.read(ctx, repoID, id, &buf)
+			if err != nil || buf.String() != data {
+				t.Errorf("Failed to read object %s : %v\n", id, err)
+			}
+			size, err := comp.stat(repoID, id)
+			if err != nil || size != int64(len(data)) {
+				t.Errorf("stat(%s) = %d, %v, expected %d\n", id, size, err, len(data))
+			}
+		}
+	}
+
+	err = comp.read(ctx, repoID, "4949494949494949494949494949494949494949", ioutil.Discard)
+	if err != ErrObjectNotExist {
+		t.Errorf("Reading a missing object should fail with ErrObjectNotExist, got %v\n", err)
+	}
+}
+
+func TestEncryptingBackend(t *testing.T) {
+	fsBend, err := newFSBackend(seafileDataDir, "commit")
+	if err != nil {
+		t.Fatalf("Failed to create fs backend : %v\n", err)
+	}
+	key := bytes.Repeat([]byte{1}, encryptKeySize)
+	bend, err := newEncryptingBackend(fsBend, map[uint32][]byte{1: key}, 1)
+	if err != nil {
+		t.Fatalf("Failed to create encrypting backend : %v\n", err)
+	}
+
+	id := "7878787878787878787878787878787878787878"
+	content := strings.Repeat("secret content ", 100)
+	err = bend.write(context.Background(), repoID, id, strings.NewReader(content), false)
+	if err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+
+	var stored bytes.Buffer
+	fsBend.read(context.Background(), repoID, id, &stored)
+	if !isEncrypted(stored.Bytes()) || strings.Contains(stored.String(), "secret") {
+		t.Errorf("Object should be stored encrypted.\n")
+	}
+
+	var buf bytes.Buffer
+	err = bend.read(context.Background(), repoID, id, &buf)
+	if err != nil || buf.String() != content {
+		t.Errorf("Failed to read encrypted object : %v\n", err)
+	}
+	size, err := bend.stat(repoID, id)
+	if err != nil || size != int64(len(content)) {
+		t.Errorf("stat() = %d, %v, expected %d\n", size, err, len(content))
+	}
+
+	// An object sealed for another ID fails authentication.
+	otherID := "7979797979797979797979797979797979797979"
+	fsBend.write(context.Background(), repoID, otherID, bytes.NewReader(stored.Bytes()), false)
+	err = bend.read(context.Background(), repoID, otherID, ioutil.Discard)
+	if err == nil {
+		t.Errorf("Reading an object stored under another ID should fail.\n")
+	}
+
+	// Rotating keys keeps old objects readable.
+	rotated, err := newEncryptingBackend(fsBend, map[uint32][]byte{1: key, 2: bytes.Repeat([]byte{2}, encryptKeySize)}, 2)
+	if err != nil {
+		t.Fatalf("Failed to create encrypting backend : %v\n", err)
+	}
+	buf.Reset()
+	err = rotated.read(context.Background(), repoID, id, &buf)
+	if err != nil || buf.String() != content {
+		t.Errorf("Failed to read object encrypted with an old key : %v\n", err)
+	}
+}
+
+func TestMove(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	dstRepo := "0e6d60e2-0c4d-4f6e-9c4a-0cf86bd1e5ae"
+	// The caching backend has no native move and copies the object.
+	cached := &ObjectStore{ObjType: "commit", backend: newCachingBackend(bend.backend, 1<<20), metrics: bend.metrics}
+	for i, store := range []*ObjectStore{bend, cached} {
+		id := fmt.Sprintf("7c%038d", i)
+		err := store.Write(repoID, id, strings.NewReader("content"), false)
+		if err != nil {
+			t.Fatalf("Failed to write object : %v\n", err)
+		}
+		// The destination already exists.
+		err = store.Write(dstRepo, id, strings.NewReader("content"), false)
+		if err != nil {
+			t.Fatalf("Failed to write object : %v\n", err)
+		}
+
+		err = store.Move(repoID, dstRepo, id)
+		if err != nil {
+			t.Errorf("Failed to move object : %v\n", err)
+		}
+		if ret, _ := store.Exists(repoID, id); ret {
+			t.Errorf("Source object still exists after move.\n")
+		}
+		var buf bytes.Buffer
+		err = store.Read(dstRepo, id, &buf)
+		if err != nil || buf.String() != "content" {
+			t.Errorf("Failed to read moved object : %v\n", err)
+		}
+
+		err = store.Move(repoID, dstRepo, id)
+		if !errors.Is(err, ErrObjectNotExist) {
+			t.Errorf("Moving a missing object should fail with ErrObjectNotExist, got %v\n", err)
+		}
+	}
+}
+
+func TestReadBytes(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	id := "7d7d7d7d7d7d7d7d7d7d7d7d7d7d7d7d7d7d7d7d"
+	err := bend.WriteBytes(repoID, id, []byte("content"), false)
+	if err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+
+	data, err := bend.ReadBytes(repoID, id)
+	if err != nil || string(data) != "content" {
+		t.Errorf("ReadBytes() = %q, %v, expected %q\n", data, err, "content")
+	}
+
+	bend.maxReadBytes = 3
+	_, err = bend.ReadBytes(repoID, id)
+	if !errors.Is(err, ErrObjectTooLarge) {
+		t.Errorf("Reading an object over the limit should fail with ErrObjectTooLarge, got %v\n", err)
+	}
+}
+
+func TestCleanupTempFiles(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	id := "7e7e7e7e7e7e7e7e7e7e7e7e7e7e7e7e7e7e7e7e"
+	err := bend.Write(repoID, id, strings.NewReader("content"), false)
+	if err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+
+	shardDir := path.Join(seafileDataDir, "storage", "commit", repoID, id[:2])
+	stale := path.Join(shardDir, "."+id+".tmp.123")
+	fresh := path.Join(shardDir, "."+id+".tmp.456")
+	for _, p := range []string{stale, fresh} {
+		if err := ioutil.WriteFile(p, []byte("partial"), 0644); err != nil {
+			t.Fatalf("Failed to create temp file : %v\n", err)
+		}
+	}
+	old := time.Now().Add(-2 * defaultTempFileMaxAge)
+	os.Chtimes(stale, old, old)
+
+	removed, err := bend.CleanupTempFiles(repoID)
+	if err != nil || removed != 1 {
+		t.Errorf("CleanupTempFiles() = %d, %v, expected 1 removed file\n", removed, err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("Stale temp file should be removed.\n")
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("Young temp file should be kept : %v\n", err)
+	}
+	if ret, _ := bend.Exists(repoID, id); !ret {
+		t.Errorf("Object should be kept.\n")
+	}
+	os.Remove(fresh)
+}
+
+func TestObjectWriter(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "block")
+	id := "7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f"
+	w, err := bend.NewWriter(repoID, id, false)
+	if err != nil {
+		t.Fatalf("Failed to create writer : %v\n", err)
+	}
+	for _, chunk := range []string{"hello ", "world", "!"} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Errorf("Failed to write chunk : %v\n", err)
+		}
+	}
+	if ret, _ := bend.Exists(repoID, id); ret {
+		t.Errorf("Object shouldn't be visible before Close.\n")
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("Failed to close writer : %v\n", err)
+	}
+	var buf bytes.Buffer
+	err = bend.Read(repoID, id, &buf)
+	if err != nil || buf.String() != "hello world!" {
+		t.Errorf("Failed to read object written by writer : %v\n", err)
+	}
+
+	abortedID := "8080808080808080808080808080808080808080"
+	w, err = bend.NewWriter(repoID, abortedID, false)
+	if err != nil {
+		t.Fatalf("Failed to create writer : %v\n", err)
+	}
+	w.Write([]byte("partial"))
+	w.Abort()
+	if ret, _ := bend.Exists(repoID, abortedID); ret {
+		t.Errorf("Aborted object shouldn't exist.\n")
+	}
+}
+
+func TestReadRange(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	id := "5555555555555555555555555555555555555555"
+	err := bend.Write(repoID, id, strings.NewReader("0123456789"), false)
+	if err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+
+	cases := []struct {
+		offset, length int64
+		expected       string
+	}{
+		{0, -1, "0123456789"},
+		{2, 3, "234"},
+		{8, 10, "89"},
+		{9, -1, "9"},
+	}
+	// The caching backend doesn't support range reads and uses the fallback.
+	cached := &ObjectStore{ObjType: "commit", backend: newCachingBackend(bend.backend, 1<<20)}
+	for _, store := range []*ObjectStore{bend, cached} {
+		for _, c := range cases {
+			var buf bytes.Buffer
+			err := store.ReadRange(repoID, id, c.offset, c.length, &buf)
+			if err != nil || buf.String() != c.expected {
+				t.Errorf("ReadRange(%d, %d) = %q, %v, expected %q\n", c.offset, c.length, buf.String(), err, c.expected)
+			}
+		}
+
+		err = store.ReadRange(repoID, id, 10, -1, ioutil.Discard)
+		if !errors.Is(err, ErrOutOfRange) {
+			t.Errorf("Reading past the end should fail with ErrOutOfRange, got %v\n", err)
+		}
+	}
+}
+
+func TestOpenReaderAt(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	id := "5656565656565656565656565656565656565656"
+	content := strings.Repeat("0123456789", 10000)
+	err := bend.Write(repoID, id, strings.NewReader(content), false)
+	if err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+
+	// The caching backend has no native reader and issues range reads.
+	cached := &ObjectStore{ObjType: "commit", backend: newCachingBackend(bend.backend, 1<<20)}
+	for _, store := range []*ObjectStore{bend, cached} {
+		r, err := store.OpenReaderAt(repoID, id)
+		if err != nil {
+			t.Fatalf("Failed to open object : %v\n", err)
+		}
+		for _, off := range []int64{0, 5, 70000, 99995} {
+			for _, size := range []int{3, readAheadSize + 10} {
+				p := make([]byte, size)
+				n, err := r.ReadAt(p, off)
+				expected := content[off:]
+				if len(expected) > size {
+					expected = expected[:size]
+				}
+				if string(p[:n]) != expected {
+					t.Errorf("ReadAt(%d, %d) returned wrong content\n", off, size)
+				}
+				if n < size && err != io.EOF {
+					t.Errorf("Short ReadAt(%d, %d) should return io.EOF, got %v\n", off, size, err)
+				}
+			}
+		}
+		r.Close()
+	}
+
+	_, err = cached.OpenReaderAt(repoID, "5757575757575757575757575757575757575757")
+	if !errors.Is(err, ErrObjectNotExist) {
+		t.Errorf("Opening a missing object should fail with ErrObjectNotExist, got %v\n", err)
+	}
+}
+
+// failingReader returns err after n bytes of content.
+type failingReader struct {
+	n   int
+	err error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, r.err
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	for i := range p {
+		p[i] = 'a'
+	}
+	r.n -= len(p)
+	return len(p), nil
+}
+
+func TestPartialWrite(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	id := "6666666666666666666666666666666666666666"
+	readErr := errors.New("connection lost")
+	err := bend.Write(repoID, id, &failingReader{100, readErr}, true)
+	if err != readErr {
+		t.Errorf("Write should fail with reader error, got %v\n", err)
+	}
+
+	if ret, _ := bend.Exists(repoID, id); ret {
+		t.Errorf("Failed write shouldn't create the object.\n")
+	}
+	shardDir := path.Join(seafileDataDir, "storage", "commit", repoID, id[:2])
+	entries, _ := ioutil.ReadDir(shardDir)
+	if len(entries) != 0 {
+		t.Errorf("Failed write should remove temp file, found %d files.\n", len(entries))
+	}
+}
+
+// limitQuota allows writes up to limit bytes.
+type limitQuota struct {
+	limit int64
+}
+
+func (q limitQuota) Allow(repoID string, addBytes int64) (bool, error) {
+	return addBytes <= q.limit, nil
+}
+
+func TestSkipIfExists(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	id := "6767676767676767676767676767676767676767"
+	err := bend.Write(repoID, id, strings.NewReader("content"), false)
+	if err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+
+	// The reader fails if it's read, so the write must be skipped.
+	opts := WriteOptions{SkipIfExists: true}
+	r := &failingReader{0, errors.New("reader consumed")}
+	err = bend.WriteWithOptions(context.Background(), repoID, id, r, opts)
+	if err != nil {
+		t.Errorf("Writing an existing object should be skipped : %v\n", err)
+	}
+
+	opts.DrainOnSkip = true
+	sr := strings.NewReader("content")
+	err = bend.WriteWithOptions(context.Background(), repoID, id, sr, opts)
+	if err != nil || sr.Len() != 0 {
+		t.Errorf("Skipped write should drain the reader, %d bytes left : %v\n", sr.Len(), err)
+	}
+
+	newID := "6868686868686868686868686868686868686868"
+	err = bend.WriteWithOptions(context.Background(), repoID, newID, strings.NewReader("new"), opts)
+	if err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+	if ret, _ := bend.Exists(repoID, newID); !ret {
+		t.Errorf("Missing object should be written.\n")
+	}
+}
+
+func TestDeleteMany(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	// The caching backend has no batch delete and uses the fallback.
+	cached := &ObjectStore{ObjType: "commit", backend: newCachingBackend(bend.backend, 1<<20), metrics: bend.metrics}
+	for _, store := range []*ObjectStore{bend, cached} {
+		ids := []string{
+			"7070707070707070707070707070707070707070",
+			"7171717171717171717171717171717171717171",
+			"7272727272727272727272727272727272727272",
+		}
+		for _, id := range ids[:2] {
+			err := store.Write(repoID, id, strings.NewReader(id), false)
+			if err != nil {
+				t.Fatalf("Failed to write object : %v\n", err)
+			}
+		}
+
+		// The last object is missing, which counts as deleted.
+		deleted, errs := store.DeleteMany(repoID, ids)
+		if deleted != len(ids) || errs != nil {
+			t.Errorf("DeleteMany() = %d, %v, expected %d deleted objects\n", deleted, errs, len(ids))
+		}
+		for _, id := range ids {
+			if ret, _ := store.Exists(repoID, id); ret {
+				t.Errorf("Object %s still exists after DeleteMany.\n", id)
+			}
+		}
+
+		deleted, errs = store.DeleteMany("no-such-repo", ids[:1])
+		if deleted != 0 || len(errs) != 1 || errs[0] == nil {
+			t.Errorf("Deleting from a missing repo should fail, got %d, %v\n", deleted, errs)
+		}
+	}
+}
+
+func TestCopyBufferSize(t *testing.T) {
+	pool, err := bufferPoolFromConf(map[string]string{"copy_buffer_size": "1mb"})
+	if err != nil || pool.size != 1000000 {
+		t.Errorf("copy_buffer_size should be parsed, got %v\n", err)
+	}
+	pool, err = bufferPoolFromConf(map[string]string{})
+	if err != nil || pool != defaultBuffers {
+		t.Errorf("Default buffers should be used without copy_buffer_size.\n")
+	}
+	_, err = bufferPoolFromConf(map[string]string{"copy_buffer_size": "0"})
+	if err == nil {
+		t.Errorf("Zero copy_buffer_size should be rejected.\n")
+	}
+}
+
+func benchmarkWrite(b *testing.B, bufferSize int, objectSize int) {
+	bend, err := newFSBackend(seafileDataDir, "bench")
+	if err != nil {
+		b.Fatalf("Failed to create backend : %v\n", err)
+	}
+	bend.buffers = newBufferPool(bufferSize)
+	content := bytes.Repeat([]byte("a"), objectSize)
+	id := "7373737373737373737373737373737373737373"
+	b.SetBytes(int64(objectSize))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := bend.write(context.Background(), repoID, id, bytes.NewReader(content), false)
+		if err != nil {
+			b.Fatalf("Failed to write object : %v\n", err)
+		}
+		err = bend.read(context.Background(), repoID, id, ioutil.Discard)
+		if err != nil {
+			b.Fatalf("Failed to read object : %v\n", err)
+		}
+	}
+}
+
+func BenchmarkCopy32KBuffer4KObject(b *testing.B) { benchmarkWrite(b, 32*1024, 4*1024) }
+func BenchmarkCopy1MBuffer4KObject(b *testing.B)  { benchmarkWrite(b, 1024*1024, 4*1024) }
+func BenchmarkCopy32KBuffer8MObject(b *testing.B) { benchmarkWrite(b, 32*1024, 8*1024*1024) }
+func BenchmarkCopy1MBuffer8MObject(b *testing.B)  { benchmarkWrite(b, 1024*1024, 8*1024*1024) }
+
+func TestReadOnly(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	id := "7474747474747474747474747474747474747474"
+	err := bend.Write(repoID, id, strings.NewReader("content"), false)
+	if err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+
+	bend.SetReadOnly(true)
+	newID := "7575757575757575757575757575757575757575"
+	err = bend.Write(repoID, newID, strings.NewReader("content"), false)
+	if err != ErrReadOnly {
+		t.Errorf("Write should fail with ErrReadOnly, got %v\n", err)
+	}
+	if ret, _ := bend.Exists(repoID, newID); ret {
+		t.Errorf("Object shouldn't be written in read-only mode.\n")
+	}
+	err = bend.Delete(repoID, id)
+	if err != ErrReadOnly {
+		t.Errorf("Delete should fail with ErrReadOnly, got %v\n", err)
+	}
+	var buf bytes.Buffer
+	err = bend.Read(repoID, id, &buf)
+	if err != nil || buf.String() != "content" {
+		t.Errorf("Read should work in read-only mode : %v\n", err)
+	}
+
+	bend.SetReadOnly(false)
+	err = bend.Delete(repoID, id)
+	if err != nil {
+		t.Errorf("Delete should work after leaving read-only mode : %v\n", err)
+	}
+}
+
+func TestWriteWithTTL(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "block")
+	liveID := "7676767676767676767676767676767676767676"
+	expiredID := "7777777777777777777777777777777777777777"
+	err := bend.WriteWithTTL(repoID, liveID, strings.NewReader("live"), time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to write object with TTL : %v\n", err)
+	}
+	err = bend.WriteWithTTL(repoID, expiredID, strings.NewReader("expired"), -time.Second)
+	if err != nil {
+		t.Fatalf("Failed to write object with TTL : %v\n", err)
+	}
+
+	var buf bytes.Buffer
+	err = bend.Read(repoID, liveID, &buf)
+	if err != nil || buf.String() != "live" {
+		t.Errorf("Failed to read unexpired object : %v\n", err)
+	}
+	if ret, err := bend.Exists(repoID, expiredID); ret || err != nil {
+		t.Errorf("Expired object should not exist : %v\n", err)
+	}
+	err = bend.Read(repoID, expiredID, ioutil.Discard)
+	if err != ErrObjectNotExist {
+		t.Errorf("Reading an expired object should fail with ErrObjectNotExist, got %v\n", err)
+	}
+
+	purged, err := bend.PurgeExpired(repoID)
+	if err != nil || purged != 1 {
+		t.Errorf("PurgeExpired() = %d, %v, expected 1 purged object\n", purged, err)
+	}
+	if ret, _ := bend.Exists(repoID, liveID); !ret {
+		t.Errorf("Unexpired object should not be purged.\n")
+	}
+	err = bend.Delete(repoID, liveID)
+	if err != nil {
+		t.Errorf("Failed to delete object with TTL : %v\n", err)
+	}
+	if ret, _ := bend.Exists(repoID, liveID); ret {
+		t.Errorf("Object with TTL still exists after delete.\n")
+	}
+}
+
+func TestListParallel(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "fs")
+	repo := "6f0e2bf5-447b-4b7c-8d0b-3a22d7e1c9a1"
+	expected := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("%02x%038d", i, i)
+		expected[id] = true
+		err := bend.Write(repo, id, strings.NewReader(id), false)
+		if err != nil {
+			t.Fatalf("Failed to write object : %v\n", err)
+		}
+	}
+
+	var mu sync.Mutex
+	visited := make(map[string]int)
+	err := bend.ListParallel(repo, 8, func(objID string) error {
+		mu.Lock()
+		visited[objID]++
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Failed to list objects : %v\n", err)
+	}
+	for id := range expected {
+		if visited[id] != 1 {
+			t.Errorf("Object %s is visited %d times\n", id, visited[id])
+		}
+	}
+	if len(visited) != len(expected) {
+		t.Errorf("Visited %d objects, expected %d\n", len(visited), len(expected))
+	}
+
+	walkErr := errors.New("walk failed")
+	err = bend.ListParallel(repo, 8, func(objID string) error {
+		return walkErr
+	})
+	if err != walkErr {
+		t.Errorf("ListParallel should return the error of fn, got %v\n", err)
+	}
+}
+
+// hangingBackend never answers existence checks, like an unreachable server.
+type hangingBackend struct {
+	storageBackend
+	release chan struct{}
+}
+
+func (b *hangingBackend) exists(repoID string, objID string) (bool, error) {
+	<-b.release
+	return false, nil
+}
+
+func TestHealthCheck(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	if bend.BackendType() != "fs" {
+		t.Errorf("BackendType() = %q, expected fs\n", bend.BackendType())
+	}
+	err := bend.HealthCheck(context.Background())
+	if err != nil {
+		t.Errorf("Health check of fs backend failed : %v\n", err)
+	}
+
+	hanging := &hangingBackend{bend.backend, make(chan struct{})}
+	defer close(hanging.release)
+	store := &ObjectStore{ObjType: "commit", backend: hanging}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = store.HealthCheck(ctx)
+	if !errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("Health check of a hanging backend should fail with ErrBackendUnavailable, got %v\n", err)
+	}
+}
+
+func TestInvalidObjectID(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	cases := []struct {
+		repoID, objID string
+	}{
+		{"../" + repoID, objID},
+		{"..", objID},
+		{"/etc", objID},
+		{repoID + "\x00", objID},
+		{repoID, "../../../../etc/passwd"},
+		{repoID, "/etc/passwd"},
+		{repoID, "04/../../x"},
+		{repoID, objID + "\x00"},
+	}
+	for _, c := range cases {
+		err := bend.Write(c.repoID, c.objID, strings.NewReader("content"), false)
+		if !errors.Is(err, ErrInvalidObjectID) {
+			t.Errorf("Write(%q, %q) should fail with ErrInvalidObjectID, got %v\n", c.repoID, c.objID, err)
+		}
+		err = bend.Read(c.repoID, c.objID, ioutil.Discard)
+		if !errors.Is(err, ErrInvalidObjectID) {
+			t.Errorf("Read(%q, %q) should fail with ErrInvalidObjectID, got %v\n", c.repoID, c.objID, err)
+		}
+		_, err = bend.Exists(c.repoID, c.objID)
+		if !errors.Is(err, ErrInvalidObjectID) {
+			t.Errorf("Exists(%q, %q) should fail with ErrInvalidObjectID, got %v\n", c.repoID, c.objID, err)
+		}
+		err = bend.Delete(c.repoID, c.objID)
+		if !errors.Is(err, ErrInvalidObjectID) {
+			t.Errorf("Delete(%q, %q) should fail with ErrInvalidObjectID, got %v\n", c.repoID, c.objID, err)
+		}
+	}
+
+	_, err := bend.List("../" + repoID)
+	if !errors.Is(err, ErrInvalidObjectID) {
+		t.Errorf("List of an invalid repo should fail with ErrInvalidObjectID, got %v\n", err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	bend.SetQuotaChecker(limitQuota{10})
+	defer bend.SetQuotaChecker(nil)
+
+	id := "7777777777777777777777777777777777777777"
+	err := bend.Write(repoID, id, strings.NewReader("hello world!\n"), false)
+	if err != ErrQuotaExceeded {
+		t.Errorf("Write over quota should fail with ErrQuotaExceeded, got %v\n", err)
+	}
+
+	err = bend.Write(repoID, id, &failingReader{20, io.EOF}, false)
+	if err != ErrQuotaExceeded {
+		t.Errorf("Streaming write over quota should fail with ErrQuotaExceeded, got %v\n", err)
+	}
+	if ret, _ := bend.Exists(repoID, id); ret {
+		t.Errorf("Write over quota shouldn't create the object.\n")
+	}
+
+	err = bend.Write(repoID, id, &failingReader{5, io.EOF}, false)
+	if err != nil {
+		t.Errorf("Write within quota failed : %v\n", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	srcRepoID := "d4e5f6a7-1b2c-4d3e-8f9a-0b1c2d3e4f5a"
+	src := newTestStore(t, seafileDataDir, "commit")
+	dst := newTestStore(t, path.Join(seafileDataDir, "migrated"), "commit")
+	ids := []string{
+		"8888888888888888888888888888888888888881",
+		"8888888888888888888888888888888888888882",
+		"8888888888888888888888888888888888888883",
+	}
+	for _, id := range ids {
+		err := src.Write(srcRepoID, id, strings.NewReader("content of "+id), false)
+		if err != nil {
+			t.Fatalf("Failed to write object : %v\n", err)
+		}
+	}
+	err := dst.Write(srcRepoID, ids[0], strings.NewReader("content of "+ids[0]), false)
+	if err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+
+	var report MigrateReport
+	dryRun := MigrateOptions{Workers: 2, DeleteAfterCopy: true, DryRun: true, Report: &report}
+	missing, _, err := Migrate(src, dst, srcRepoID, dryRun)
+	size := int64(len("content of ") + len(ids[1]))
+	if err != nil || missing != 2 || report.Bytes != 2*size || len(report.Sample) != 2 || report.Sample[0] != ids[1] {
+		t.Errorf("Unexpected dry run result : missing %d, report %+v, %v\n", missing, report, err)
+	}
+	if ret, _ := dst.Exists(srcRepoID, ids[1]); ret {
+		t.Errorf("Dry run shouldn't copy objects.\n")
+	}
+
+	progress := 0
+	opts := MigrateOptions{Workers: 2, DeleteAfterCopy: true, Progress: func(done, total int) { progress = done }}
+	copied, skipped, err := Migrate(src, dst, srcRepoID, opts)
+	if err != nil || copied != 2 || skipped != 1 || progress != 3 {
+		t.Errorf("Unexpected migration result : copied %d, skipped %d, progress %d, %v\n", copied, skipped, progress, err)
+	}
+
+	for _, id := range ids {
+		var buf bytes.Buffer
+		if err := dst.Read(srcRepoID, id, &buf); err != nil || buf.String() != "content of "+id {
+			t.Errorf("Object %s isn't migrated : %v\n", id, err)
+		}
+	}
+	left, _ := src.List(srcRepoID)
+	if len(left) != 0 {
+		t.Errorf("Migrated objects should be deleted from source, %d left.\n", len(left))
+	}
+}
+
+func TestShardedBackend(t *testing.T) {
+	roots := []string{path.Join(seafileDataDir, "disk1"), path.Join(seafileDataDir, "disk2")}
+	conf := map[string]string{"obj_type": "blocks", "roots": strings.Join(roots[:1], ",")}
+	sharded, err := newShardedBackend(conf)
+	if err != nil {
+		t.Fatalf("Failed to create sharded backend : %v\n", err)
+	}
+	ctx := context.Background()
+	var ids []string
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("%040x", i)
+		ids = append(ids, id)
+		err := sharded.write(ctx, repoID, id, strings.NewReader(id), false)
+		if err != nil {
+			t.Fatalf("Failed to write object : %v\n", err)
+		}
+	}
+
+	// Objects written before adding a root must still be readable.
+	conf["roots"] = strings.Join(roots, ",")
+	sharded, err = newShardedBackend(conf)
+	if err != nil {
+		t.Fatalf("Failed to create sharded backend : %v\n", err)
+	}
+	for _, id := range ids {
+		var buf bytes.Buffer
+		if err := sharded.read(ctx, repoID, id, &buf); err != nil || buf.String() != id {
+			t.Errorf("Failed to read object %s : %v\n", id, err)
+		}
+	}
+
+	// Move objects to their new roots and check each is listed once.
+	moved := 0
+	for _, id := range ids {
+		if shard := sharded.rank(repoID, id)[0]; shard != sharded.shards[roots[0]] {
+			if err := shard.write(ctx, repoID, id, strings.NewReader(id), false); err != nil {
+				t.Fatalf("Failed to move object : %v\n", err)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved == len(ids) {
+		t.Errorf("Adding a root should move some objects, moved %d of %d\n", moved, len(ids))
+	}
+	listed := 0
+	err = sharded.list(repoID, func(objID string) error {
+		listed++
+		return nil
+	})
+	if err != nil || listed != len(ids) {
+		t.Errorf("Each object should be listed once, listed %d of %d : %v\n", listed, len(ids), err)
+	}
+
+	// Shards are configured like fs backends.
+	conf = map[string]string{"obj_type": "blocks", "roots": strings.Join(roots, ","),
+		"layout": "flat", "use_mmap": "true", "dir_mode": "0750", "file_mode": "0640"}
+	sharded, err = newShardedBackend(conf)
+	if err != nil {
+		t.Fatalf("Failed to create sharded backend : %v\n", err)
+	}
+	for _, root := range roots {
+		shard := sharded.shards[root]
+		if shard.layout != layoutFlat || !shard.useMmap || shard.dirMode != 0750 || shard.fileMode != 0640 {
+			t.Errorf("Shard %s should be configured like an fs backend.\n", root)
+		}
+	}
+	conf["file_mode"] = "0999"
+	if _, err := newShardedBackend(conf); err == nil {
+		t.Errorf("Invalid file_mode of shards should be rejected.\n")
+	}
+}
+
+func TestBackendError(t *testing.T) {
+	native := &os.PathError{Op: "open", Path: "/data", Err: syscall.EIO}
+	err := fsError(native)
+	if !errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("EIO should be classified as ErrBackendUnavailable, got %v\n", err)
+	}
+	var pathErr *os.PathError
+	if !errors.As(err, &pathErr) || pathErr != native {
+		t.Errorf("Native error should be retrievable with errors.As.\n")
+	}
+	if !errors.Is(fsError(os.ErrPermission), ErrPermission) {
+		t.Errorf("Permission error should be classified as ErrPermission.\n")
+	}
+}
+
+// trickleReader returns one byte at a time, each after a delay.
+type trickleReader struct {
+	n     int
+	delay time.Duration
+}
+
+func (r *trickleReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.delay)
+	r.n--
+	p[0] = 'x'
+	return 1, nil
+}
+
+func TestTimeoutBackend(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	timeoutObjID := "7a1e3c5d9b2f4a6c8e0d1b3f5a7c9e1d3b5f7a9c"
+	timeout := &timeoutBackend{storageBackend: bend.backend, writeTimeout: 30 * time.Millisecond}
+
+	err := timeout.write(context.Background(), repoID, timeoutObjID, &trickleReader{n: 100, delay: 5 * time.Millisecond}, false)
+	if !errors.Is(err, ErrBackendTimeout) {
+		t.Errorf("Slow write should time out, got %v\n", err)
+	}
+	if ret, _ := bend.backend.exists(repoID, timeoutObjID); ret {
+		t.Errorf("Timed out write shouldn't leave an object.\n")
+	}
+
+	hanging := &hangingBackend{bend.backend, make(chan struct{})}
+	defer close(hanging.release)
+	timeout = &timeoutBackend{storageBackend: hanging, existsTimeout: 30 * time.Millisecond}
+	_, err = timeout.exists(repoID, objID)
+	if !errors.Is(err, ErrBackendTimeout) {
+		t.Errorf("Hanging exists should time out, got %v\n", err)
+	}
+	if !IsRetryable(err) {
+		t.Errorf("Timeout should be retryable.\n")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "blocks")
+	verifyRepoID := "5c0e8b1a-3f47-4d2e-9a61-2b7d4e8f0c13"
+	for _, content := range []string{"first", "second", "third"} {
+		sum := sha1.Sum([]byte(content))
+		if err := bend.Write(verifyRepoID, hex.EncodeToString(sum[:]), strings.NewReader(content), false); err != nil {
+			t.Fatalf("Failed to write object : %v\n", err)
+		}
+	}
+	if err := bend.Write(verifyRepoID, objID, strings.NewReader("rotten"), false); err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+
+	var failed []string
+	checked, corrupt, err := bend.Verify(verifyRepoID, func(objID string, err error) {
+		if !errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("Unexpected error of object %s : %v\n", objID, err)
+		}
+		failed = append(failed, objID)
+	})
+	if err != nil {
+		t.Fatalf("Failed to verify repo : %v\n", err)
+	}
+	if checked != 4 || corrupt != 1 || len(failed) != 1 || failed[0] != objID {
+		t.Errorf("Expected 4 checked and %s corrupt, got %d checked and %v corrupt\n", objID, checked, failed)
+	}
+
+	fsObjs := newTestStore(t, seafileDataDir, "fs")
+	if _, _, err := fsObjs.Verify(verifyRepoID, func(string, error) {}); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Verifying fs objects should fail with ErrNotSupported, got %v\n", err)
+	}
+}
+
+func TestListPage(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	pageRepoID := "9e4b7c2d-1a85-4f36-b0d9-6c3e5a7f8b21"
+	var ids []string
+	for i := 0; i < 5; i++ {
+		sum := sha1.Sum([]byte(fmt.Sprintf("page-object-%d", i)))
+		id := hex.EncodeToString(sum[:])
+		if err := bend.Write(pageRepoID, id, strings.NewReader(id), false); err != nil {
+			t.Fatalf("Failed to write object : %v\n", err)
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	listers := map[string]func(token string) ([]string, string, error){
+		"fs": func(token string) ([]string, string, error) {
+			return bend.ListPage(pageRepoID, token, 2)
+		},
+		"fallback": func(token string) ([]string, string, error) {
+			return listPageFallback(bend.backend, pageRepoID, token, 2)
+		},
+	}
+	for name, listPage := range listers {
+		var listed []string
+		token := ""
+		for pages := 0; pages < 10; pages++ {
+			page, next, err := listPage(token)
+			if err != nil {
+				t.Fatalf("Failed to list page with %s : %v\n", name, err)
+			}
+			if len(page) > 2 {
+				t.Errorf("Page of %s has %d objects, more than the limit\n", name, len(page))
+			}
+			listed = append(listed, page...)
+			if next == "" {
+				break
+			}
+			token = next
+		}
+		if strings.Join(listed, ",") != strings.Join(ids, ",") {
+			t.Errorf("Pages of %s should list %v, got %v\n", name, ids, listed)
+		}
+	}
+}
+
+func TestMmapRead(t *testing.T) {
+	fs, err := newFSBackend(seafileDataDir, "commit")
+	if err != nil {
+		t.Fatalf("Failed to create fs backend : %v\n", err)
+	}
+	fs.useMmap = true
+	ctx := context.Background()
+
+	content := strings.Repeat("mapped object ", 1000)
+	if err := fs.write(ctx, repoID, objID, strings.NewReader(content), false); err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+	var buf bytes.Buffer
+	if err := fs.read(ctx, repoID, objID, &buf); err != nil || buf.String() != content {
+		t.Errorf("Mapped read returned %d bytes instead of %d : %v\n", buf.Len(), len(content), err)
+	}
+
+	// Panics of the writer aren't taken for faults of the mapping.
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Panic of the writer should be passed on.\n")
+			}
+		}()
+		fs.read(ctx, repoID, objID, &panickingWriter{})
+	}()
+
+	// Empty files can't be mapped and are read regularly.
+	if err := fs.write(ctx, repoID, objID, strings.NewReader(""), false); err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+	buf.Reset()
+	if err := fs.read(ctx, repoID, objID, &buf); err != nil || buf.Len() != 0 {
+		t.Errorf("Empty object read returned %d bytes : %v\n", buf.Len(), err)
+	}
+}
+
+// panickingWriter dereferences a nil pointer on its first write, so a
+// panic recovered by mistake can be told from one passed on.
+type panickingWriter struct {
+	n       *int
+	written bool
+}
+
+func (w *panickingWriter) Write(p []byte) (int, error) {
+	if !w.written {
+		w.written = true
+		*w.n += len(p)
+	}
+	return len(p), nil
+}
+
+func TestWriteSized(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	sizedObjID := "3d6f9a2c5e8b1d4f7a0c3e6b9d2f5a8c1e4b7d0f"
+	content := "sized content"
+
+	for _, size := range []int64{int64(len(content)) - 1, int64(len(content)) + 1} {
+		err := bend.WriteSized(repoID, sizedObjID, strings.NewReader(content), size, false)
+		if err == nil {
+			t.Errorf("Write of %d bytes with size %d should fail.\n", len(content), size)
+		}
+		if ret, _ := bend.Exists(repoID, sizedObjID); ret {
+			t.Errorf("Write with wrong size %d shouldn't leave an object.\n", size)
+		}
+	}
+
+	for _, size := range []int64{int64(len(content)), -1} {
+		err := bend.WriteSized(repoID, sizedObjID, strings.NewReader(content), size, false)
+		if err != nil {
+			t.Errorf("Failed to write object with size %d : %v\n", size, err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := bend.Read(repoID, sizedObjID, &buf); err != nil || buf.String() != content {
+		t.Errorf("Read %q instead of %q : %v\n", buf.String(), content, err)
+	}
+	bend.Delete(repoID, sizedObjID)
+}
+
+func TestNullBackend(t *testing.T) {
+	bend, err := createBackend("null", map[string]string{"payload_size": "1KB", "exists": "true"})
+	if err != nil {
+		t.Fatalf("Failed to create null backend : %v\n", err)
+	}
+	ctx := context.Background()
+
+	r := strings.NewReader("discarded")
+	if err := bend.write(ctx, repoID, objID, r, false); err != nil || r.Len() != 0 {
+		t.Errorf("Write should consume the whole reader, %d bytes left : %v\n", r.Len(), err)
+	}
+	var buf bytes.Buffer
+	if err := bend.read(ctx, repoID, objID, &buf); err != nil || buf.Len() != 1000 {
+		t.Errorf("Read should return the 1KB payload, got %d bytes : %v\n", buf.Len(), err)
+	}
+	if ret, err := bend.exists(repoID, objID); err != nil || !ret {
+		t.Errorf("Exists should return the configured result : %v\n", err)
+	}
+
+	bend, _ = createBackend("null", map[string]string{})
+	if err := bend.read(ctx, repoID, objID, &buf); err != ErrObjectNotExist {
+		t.Errorf("Read without payload should return ErrObjectNotExist, got %v\n", err)
+	}
+}
+
+// closingBackend counts how often it's closed.
+type closingBackend struct {
+	storageBackend
+	closes int
+}
+
+func (b *closingBackend) close() error {
+	b.closes++
+	return nil
+}
+
+func TestClose(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	closing := &closingBackend{storageBackend: bend.backend}
+	store := &ObjectStore{ObjType: "commit", backend: newRetryingBackend(closing, 1), metrics: bend.metrics}
+
+	for i := 0; i < 2; i++ {
+		if err := store.Close(); err != nil {
+			t.Errorf("Failed to close object store : %v\n", err)
+		}
+	}
+	if closing.closes != 1 {
+		t.Errorf("Backend should be closed once, closed %d times\n", closing.closes)
+	}
+}
+
+func TestDeleteRepo(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	deletedRepoID := "d2a7f4c1-8e3b-4b5a-96c0-7f1e2d3c4b5a"
+	for i := 0; i < 3; i++ {
+		sum := sha1.Sum([]byte(fmt.Sprintf("deleted-object-%d", i)))
+		if err := bend.Write(deletedRepoID, hex.EncodeToString(sum[:]), strings.NewReader("deleted"), false); err != nil {
+			t.Fatalf("Failed to write object : %v\n", err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := bend.DeleteRepo(deletedRepoID); err != nil {
+			t.Errorf("Failed to delete repo : %v\n", err)
+		}
+	}
+	n := 0
+	bend.ListIter(deletedRepoID, func(objID string) error {
+		n++
+		return nil
+	})
+	if n != 0 {
+		t.Errorf("Deleted repo still has %d objects\n", n)
+	}
+
+	// Backends without a native deletion delete objects one by one.
+	null, _ := createBackend("null", map[string]string{})
+	if err := deleteRepoBackend(null, deletedRepoID); err != nil {
+		t.Errorf("Failed to delete repo without objects : %v\n", err)
+	}
+}
+
+func TestHashAlgo(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "blocks")
+	fs, ok := bend.backend.(*fsBackend)
+	if !ok {
+		t.Fatalf("Blocks should be stored in fs backend.\n")
+	}
+	defer SetHashAlgo(HashSHA1)
+
+	for _, algo := range []HashAlgo{HashSHA1, HashSHA256} {
+		if err := SetHashAlgo(algo); err != nil {
+			t.Fatalf("Failed to set hash algorithm %s : %v\n", algo, err)
+		}
+		content := []byte("hashed with " + string(algo))
+		id := ComputeID(content)
+		if len(id) != algo.idLength() {
+			t.Errorf("ID of %s should be %d long, got %s\n", algo, algo.idLength(), id)
+		}
+		if err := bend.Write(repoID, id, bytes.NewReader(content), false); err != nil {
+			t.Fatalf("Failed to write object : %v\n", err)
+		}
+		defer bend.Delete(repoID, id)
+		if _, err := os.Stat(path.Join(fs.objDir, repoID, id[:2], id[2:])); err != nil {
+			t.Errorf("Object %s should be stored in its shard directory : %v\n", id, err)
+		}
+
+		// Objects are verified by the length of their ID whatever the current algorithm.
+		SetHashAlgo(HashSHA1)
+		var buf bytes.Buffer
+		if err := bend.ReadVerified(repoID, id, &buf); err != nil || !bytes.Equal(buf.Bytes(), content) {
+			t.Errorf("Failed to verify object of %s : %v\n", algo, err)
+		}
+	}
+
+	if err := SetHashAlgo("md5"); err == nil {
+		t.Errorf("Unsupported hash algorithm should be rejected.\n")
+	}
+}
+
+func TestServeObject(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	content := "served object content"
+	if err := bend.Write(repoID, objID, strings.NewReader(content), false); err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+
+	tests := []struct {
+		header string
+		value  string
+		status int
+		body   string
+	}{
+		{"", "", http.StatusOK, content},
+		{"If-None-Match", `"` + objID + `"`, http.StatusNotModified, ""},
+		{"If-None-Match", `"other"`, http.StatusOK, content},
+		{"Range", "bytes=7-12", http.StatusPartialContent, content[7:13]},
+		{"Range", "bytes=-7", http.StatusPartialContent, content[len(content)-7:]},
+		{"Range", "bytes=100-", http.StatusRequestedRangeNotSatisfiable, ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+		rec := httptest.NewRecorder()
+		rec.Header().Set("Cache-Control", "max-age=3600")
+		sent, err := bend.ServeObject(rec, req, repoID, objID)
+		if err != nil {
+			t.Errorf("Failed to serve object with %s %s : %v\n", test.header, test.value, err)
+			continue
+		}
+		if rec.Code != test.status || rec.Body.String() != test.body {
+			t.Errorf("With %s %s expected %d %q, got %d %q\n", test.header, test.value,
+				test.status, test.body, rec.Code, rec.Body.String())
+		}
+		if sent != int64(len(test.body)) {
+			t.Errorf("With %s %s expected %d bytes sent, got %d\n", test.header, test.value, len(test.body), sent)
+		}
+		if rec.Header().Get("Cache-Control") != "max-age=3600" {
+			t.Errorf("Cache-Control of the caller should be kept, got %s\n", rec.Header().Get("Cache-Control"))
+		}
+		if rec.Header().Get("ETag") != `"`+objID+`"` {
+			t.Errorf("ETag should be the object ID, got %s\n", rec.Header().Get("ETag"))
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	_, err := bend.ServeObject(httptest.NewRecorder(), req, repoID, "ffffffffffffffffffffffffffffffffffffffff")
+	if err != ErrObjectNotExist {
+		t.Errorf("Serving a missing object should return ErrObjectNotExist, got %v\n", err)
+	}
+}
+
+// failingBackend fails every write.
+type failingBackend struct {
+	storageBackend
+}
+
+func (b *failingBackend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	return errors.New("disk on fire")
+}
+
+func TestAsyncWriteBackend(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	async := newAsyncWriteBackend(bend.backend, 2, 2)
+	defer async.close()
+	ctx := context.Background()
+
+	var ids []string
+	for i := 0; i < 10; i++ {
+		content := fmt.Sprintf("queued-object-%d", i)
+		sum := sha1.Sum([]byte(content))
+		id := hex.EncodeToString(sum[:])
+		if err := async.write(ctx, repoID, id, strings.NewReader(content), false); err != nil {
+			t.Fatalf("Failed to queue object : %v\n", err)
+		}
+		var buf bytes.Buffer
+		if err := async.read(ctx, repoID, id, &buf); err != nil || buf.String() != content {
+			t.Errorf("Queued object should be readable, got %q : %v\n", buf.String(), err)
+		}
+		ids = append(ids, id)
+	}
+	if err := async.sync(); err != nil {
+		t.Fatalf("Failed to sync queued writes : %v\n", err)
+	}
+	for _, id := range ids {
+		if ret, _ := bend.backend.exists(repoID, id); !ret {
+			t.Errorf("Object %s should be written after sync.\n", id)
+		}
+	}
+
+	failing := newAsyncWriteBackend(&failingBackend{bend.backend}, 2, 1)
+	defer failing.close()
+	if err := failing.write(ctx, repoID, objID, strings.NewReader("lost"), false); err != nil {
+		t.Fatalf("Failed to queue object : %v\n", err)
+	}
+	if err := failing.sync(); err == nil {
+		t.Errorf("Sync should return the error of the queued write.\n")
+	}
+	if err := failing.sync(); err != nil {
+		t.Errorf("Error should only be returned once, got %v\n", err)
+	}
+
+	// Queued writes of a deleted repo are done before it's deleted.
+	deletedRepoID := "f2b1d6c7-50a9-4e8f-9d4c-2b1a0f9d8c50"
+	gated := &gatedBackend{bend.backend, make(chan struct{})}
+	queued := newAsyncWriteBackend(gated, 10, 1)
+	defer queued.close()
+	store := &ObjectStore{ObjType: "commit", backend: queued, metrics: bend.metrics}
+	for _, id := range ids[:3] {
+		if err := queued.write(ctx, deletedRepoID, id, strings.NewReader(id), false); err != nil {
+			t.Fatalf("Failed to queue object : %v\n", err)
+		}
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(gated.gate)
+	}()
+	if err := store.DeleteRepo(deletedRepoID); err != nil {
+		t.Fatalf("Failed to delete repo : %v\n", err)
+	}
+	queued.wait()
+	for _, id := range ids[:3] {
+		if ret, _ := bend.backend.exists(deletedRepoID, id); ret {
+			t.Errorf("Queued object %s shouldn't be written after its repo is deleted.\n", id)
+		}
+	}
+}
+
+// gatedBackend holds writes until gate is closed.
+type gatedBackend struct {
+	storageBackend
+	gate chan struct{}
+}
+
+func (b *gatedBackend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	<-b.gate
+	return b.storageBackend.write(ctx, repoID, objID, r, sync)
+}
+
+func TestNegativeCache(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	ctx := context.Background()
+	missingObjID := "8b2e5f1a4c7d0e3b6a9f2c5e8d1b4a7f0c3e6d9b"
+	bend.backend.delete(repoID, missingObjID)
+	cache := newNegativeCachingBackend(bend.backend, 10, time.Minute)
+
+	if ret, err := cache.exists(repoID, missingObjID); err != nil || ret {
+		t.Fatalf("Object shouldn't exist : %v\n", err)
+	}
+	// The miss is cached, so an object written behind the cache stays missing.
+	bend.backend.write(ctx, repoID, missingObjID, strings.NewReader("behind"), false)
+	if ret, _ := cache.exists(repoID, missingObjID); ret {
+		t.Errorf("Missing object should be cached.\n")
+	}
+
+	if err := cache.write(ctx, repoID, missingObjID, strings.NewReader("written"), false); err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+	if ret, _ := cache.exists(repoID, missingObjID); !ret {
+		t.Errorf("Written object should exist right after the write.\n")
+	}
+	bend.backend.delete(repoID, missingObjID)
+
+	expiring := newNegativeCachingBackend(bend.backend, 10, time.Millisecond)
+	expiring.exists(repoID, missingObjID)
+	bend.backend.write(ctx, repoID, missingObjID, strings.NewReader("behind"), false)
+	time.Sleep(5 * time.Millisecond)
+	if ret, _ := expiring.exists(repoID, missingObjID); !ret {
+		t.Errorf("Cached miss should expire after its TTL.\n")
+	}
+	bend.backend.delete(repoID, missingObjID)
+}
+
+func TestLayout(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	sharded := bend.backend.(*fsBackend)
+	flat, err := newFSBackend(seafileDataDir, "commit")
+	if err != nil {
+		t.Fatalf("Failed to create fs backend : %v\n", err)
+	}
+	flat.layout = layoutFlat
+	layoutRepoID := "4f8a2c6e-0b3d-4e7f-a1c5-9d2b6e0f3a7c"
+	ctx := context.Background()
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		sum := sha1.Sum([]byte(fmt.Sprintf("layout-object-%d", i)))
+		id := hex.EncodeToString(sum[:])
+		if err := flat.write(ctx, layoutRepoID, id, strings.NewReader(id), false); err != nil {
+			t.Fatalf("Failed to write object : %v\n", err)
+		}
+		if _, err := os.Stat(path.Join(flat.objDir, layoutRepoID, id)); err != nil {
+			t.Errorf("Flat layout should store object at <repo>/<id> : %v\n", err)
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	listed := func(b *fsBackend) string {
+		var res []string
+		b.list(layoutRepoID, func(objID string) error {
+			res = append(res, objID)
+			return nil
+		})
+		sort.Strings(res)
+		return strings.Join(res, ",")
+	}
+	if listed(flat) != strings.Join(ids, ",") {
+		t.Errorf("Flat layout should list %v, got %s\n", ids, listed(flat))
+	}
+
+	if err := bend.ReshardRepo(layoutRepoID, "sharded"); err != nil {
+		t.Fatalf("Failed to reshard repo : %v\n", err)
+	}
+	if listed(flat) != "" || listed(sharded) != strings.Join(ids, ",") {
+		t.Errorf("Resharded repo should only be listed in sharded layout.\n")
+	}
+	var buf bytes.Buffer
+	if err := sharded.read(ctx, layoutRepoID, ids[0], &buf); err != nil || buf.String() != ids[0] {
+		t.Errorf("Failed to read resharded object : %v\n", err)
+	}
+
+	if err := bend.ReshardRepo(layoutRepoID, "flat"); err != nil {
+		t.Fatalf("Failed to reshard repo : %v\n", err)
+	}
+	if listed(flat) != strings.Join(ids, ",") || listed(sharded) != "" {
+		t.Errorf("Repo resharded back should only be listed in flat layout.\n")
+	}
+	if err := flat.delete(layoutRepoID, ids[0]); err != nil {
+		t.Errorf("Failed to delete object in flat layout : %v\n", err)
+	}
+	if ret, _ := flat.exists(layoutRepoID, ids[0]); ret {
+		t.Errorf("Deleted object shouldn't exist in flat layout.\n")
+	}
+	if err := bend.ReshardRepo(layoutRepoID, "nested"); err == nil {
+		t.Errorf("Unknown layout should be rejected.\n")
+	}
+}
+
+func TestTracing(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	// Untraced operations don't create spans.
+	if err := bend.Write(repoID, objID, strings.NewReader("traced"), false); err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+	if n := len(recorder.Ended()); n != 0 {
+		t.Errorf("Untraced write shouldn't create spans, got %d\n", n)
+	}
+
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "request")
+	var buf bytes.Buffer
+	if err := bend.ReadCtx(ctx, repoID, objID, &buf); err != nil {
+		t.Fatalf("Failed to read object : %v\n", err)
+	}
+	err := bend.ReadCtx(ctx, repoID, "ffffffffffffffffffffffffffffffffffffffff", &buf)
+	if err != ErrObjectNotExist {
+		t.Fatalf("Missing object should return ErrObjectNotExist, got %v\n", err)
+	}
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("Expected spans of 2 reads and the request, got %d\n", len(spans))
+	}
+	read := spans[0]
+	if read.Name() != "objstore.read" || read.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("Read span should be a child of the request span, got %s\n", read.Name())
+	}
+	for _, attr := range read.Attributes() {
+		if attr.Key == "objstore.bytes" && attr.Value.AsInt64() != int64(len("traced")) {
+			t.Errorf("Read span should record %d bytes, got %d\n", len("traced"), attr.Value.AsInt64())
+		}
+	}
+	if spans[1].Status().Code != codes.Error {
+		t.Errorf("Failed read should be recorded on its span.\n")
+	}
+}
+
+func TestWriteIfAbsent(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	absentObjID := "5a8c1e4b7d0f3d6f9a2c5e8b1d4f7a0c3e6b9d2f"
+	defer bend.Delete(repoID, absentObjID)
+
+	var wg sync.WaitGroup
+	var written int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := bend.WriteIfAbsent(repoID, absentObjID, strings.NewReader(fmt.Sprintf("writer %d", i)), false)
+			if err != nil {
+				t.Errorf("Failed to write object : %v\n", err)
+			}
+			if ok {
+				atomic.AddInt32(&written, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if written != 1 {
+		t.Fatalf("Exactly one of concurrent writers should write the object, got %d\n", written)
+	}
+
+	var before bytes.Buffer
+	bend.Read(repoID, absentObjID, &before)
+	ok, err := bend.WriteIfAbsent(repoID, absentObjID, strings.NewReader("overwritten"), false)
+	if err != nil || ok {
+		t.Errorf("Write of existing object should report written=false : %v\n", err)
+	}
+	var after bytes.Buffer
+	bend.Read(repoID, absentObjID, &after)
+	if after.String() != before.String() {
+		t.Errorf("Existing object was changed from %q to %q\n", before.String(), after.String())
+	}
+}
+
+func TestBackendConfig(t *testing.T) {
+	config, err := ini.Load([]byte(`
+[object_backend]
+type = null
+payload_size = 10
+
+[block_backend]
+payload_size = 20
+
+[fs_object_backend]
+type = fs
+`))
+	if err != nil {
+		t.Fatalf("Failed to load config : %v\n", err)
+	}
+
+	if conf := backendConf(config, "commits"); conf["type"] != "null" || conf["payload_size"] != "10" {
+		t.Errorf("Commits should use the shared backend, got %v\n", conf)
+	}
+	if conf := backendConf(config, "blocks"); conf["type"] != "null" || conf["payload_size"] != "20" {
+		t.Errorf("Blocks should override the shared options, got %v\n", conf)
+	}
+	if conf := backendConf(config, "fs"); conf["type"] != "fs" || conf["payload_size"] != "" {
+		t.Errorf("Fs objects shouldn't inherit options of another backend type, got %v\n", conf)
+	}
+
+	confDir, err := ioutil.TempDir("", "objstore-conf")
+	if err != nil {
+		t.Fatalf("Failed to create config dir : %v\n", err)
+	}
+	defer os.RemoveAll(confDir)
+	err = ioutil.WriteFile(path.Join(confDir, "seafile.conf"), []byte("[block_backend]\ntype = nosuch\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write config : %v\n", err)
+	}
+	_, err = newBackend(confDir, seafileDataDir, "blocks")
+	if err == nil || !strings.Contains(err.Error(), "block_backend") || !strings.Contains(err.Error(), "nosuch") {
+		t.Errorf("Unknown backend type should name the section and type, got %v\n", err)
+	}
+}
+
+func TestReadWriteN(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	content := "counted content"
+
+	n, err := bend.WriteN(repoID, objID, strings.NewReader(content), false)
+	if err != nil || n != int64(len(content)) {
+		t.Errorf("WriteN returned %d instead of %d : %v\n", n, len(content), err)
+	}
+	var buf bytes.Buffer
+	n, err = bend.ReadN(repoID, objID, &buf)
+	if err != nil || n != int64(len(content)) || buf.String() != content {
+		t.Errorf("ReadN returned %d instead of %d : %v\n", n, len(content), err)
+	}
+	n, err = bend.ReadN(repoID, "ffffffffffffffffffffffffffffffffffffffff", &buf)
+	if err != ErrObjectNotExist || n != 0 {
+		t.Errorf("ReadN of missing object returned %d : %v\n", n, err)
+	}
+}
+
+// laggingBackend hides written objects from the first hidden exists checks
+// after each write, like an eventually consistent object store.
+type laggingBackend struct {
+	storageBackend
+	hidden int
+	left   int
+	checks int
+}
+
+func (b *laggingBackend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	b.left = b.hidden
+	return b.storageBackend.write(ctx, repoID, objID, r, sync)
+}
+
+func (b *laggingBackend) exists(repoID string, objID string) (bool, error) {
+	b.checks++
+	if b.left > 0 {
+		b.left--
+		return false, nil
+	}
+	return b.storageBackend.exists(repoID, objID)
+}
+
+func TestWriteReadback(t *testing.T) {
+	config, err := ini.Load([]byte("[store]\nverify_write_readback = true\nwrite_readback_attempts = 3\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config : %v\n", err)
+	}
+	bend := newTestStore(t, seafileDataDir, "commit")
+	if b, _ := readbackFromConfig(config, "fs", bend.backend); b != bend.backend {
+		t.Errorf("File system backends shouldn't be checked after writes.\n")
+	}
+
+	lagging := &laggingBackend{storageBackend: bend.backend, hidden: 2}
+	readback, err := readbackFromConfig(config, "s3", lagging)
+	if err != nil {
+		t.Fatalf("Failed to create readback backend : %v\n", err)
+	}
+	ctx := context.Background()
+	if err := readback.write(ctx, repoID, objID, strings.NewReader("lagging"), false); err != nil || lagging.checks != 3 {
+		t.Errorf("Write should succeed on the 3rd check, got %d checks : %v\n", lagging.checks, err)
+	}
+
+	lagging.hidden = 3
+	lagging.checks = 0
+	err = readback.write(ctx, repoID, objID, strings.NewReader("lagging"), false)
+	if !errors.Is(err, ErrBackendUnavailable) || lagging.checks != 3 {
+		t.Errorf("Write of an object that never shows up should fail after 3 checks, got %d : %v\n", lagging.checks, err)
+	}
+}
+
+func TestExpvarStats(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "expvar_test")
+	content := "counted by expvar"
+
+	if err := bend.Write(repoID, objID, strings.NewReader(content), false); err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+	var buf bytes.Buffer
+	if err := bend.Read(repoID, objID, &buf); err != nil {
+		t.Fatalf("Failed to read object : %v\n", err)
+	}
+	bend.Read(repoID, "ffffffffffffffffffffffffffffffffffffffff", &buf)
+	bend.Delete(repoID, objID)
+
+	stats, ok := expvarStats.Get("expvar_test").(*expvar.Map)
+	if !ok {
+		t.Fatalf("Counters of the object type aren't published.\n")
+	}
+	expected := map[string]int64{
+		"writes":      1,
+		"reads":       2,
+		"read_errors": 1,
+		"bytes_in":    int64(len(content)),
+		"bytes_out":   int64(len(content)),
+	}
+	for name, value := range expected {
+		if counter, ok := stats.Get(name).(*expvar.Int); !ok || counter.Value() != value {
+			t.Errorf("Counter %s should be %d, got %v\n", name, value, stats.Get(name))
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	content := "opened content"
+	if err := bend.Write(repoID, objID, strings.NewReader(content), false); err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+
+	// The pipe of other backends is tested through a decorator.
+	piped := &ObjectStore{backend: &closingBackend{storageBackend: bend.backend}, metrics: bend.metrics}
+	for _, store := range []*ObjectStore{bend, piped} {
+		r, err := store.Open(repoID, objID)
+		if err != nil {
+			t.Fatalf("Failed to open object : %v\n", err)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil || string(data) != content {
+			t.Errorf("Read %q instead of %q : %v\n", data, content, err)
+		}
+		if err := r.Close(); err != nil {
+			t.Errorf("Failed to close reader : %v\n", err)
+		}
+
+		_, err = store.Open(repoID, "ffffffffffffffffffffffffffffffffffffffff")
+		if err != ErrObjectNotExist {
+			t.Errorf("Open of missing object should return ErrObjectNotExist, got %v\n", err)
+		}
+	}
+}
+
+func TestFSModes(t *testing.T) {
+	dataDir := path.Join(seafileDataDir, "modes")
+	conf := map[string]string{"obj_type": "blocks", "data_dir": dataDir, "dir_mode": "0700", "file_mode": "0640"}
+	bend, err := createBackend("fs", conf)
+	if err != nil {
+		t.Fatalf("Failed to create fs backend : %v\n", err)
+	}
+	// The modes are set regardless of the umask.
+	oldMask := syscall.Umask(0077)
+	defer syscall.Umask(oldMask)
+
+	if err := bend.write(context.Background(), repoID, objID, strings.NewReader("private"), false); err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+	objPath := bend.(*fsBackend).objectPath(repoID, objID)
+	for p, mode := range map[string]os.FileMode{path.Dir(objPath): 0700, path.Dir(path.Dir(objPath)): 0700, objPath: 0640} {
+		info, err := os.Stat(p)
+		if err != nil || info.Mode().Perm() != mode {
+			t.Errorf("%s should have mode %o : %v\n", p, mode, err)
+		}
+	}
+
+	if _, err := createBackend("fs", map[string]string{"obj_type": "blocks", "data_dir": dataDir, "dir_mode": "rwx"}); err == nil {
+		t.Errorf("Non-octal dir_mode should be rejected.\n")
+	}
+}
+
+func TestSizeRoutingBackend(t *testing.T) {
+	conf := map[string]string{
+		"obj_type":       "blocks",
+		"data_dir":       seafileDataDir,
+		"threshold":      "10",
+		"small.type":     "fs",
+		"large.type":     "fs",
+		"large.data_dir": path.Join(seafileDataDir, "large"),
+	}
+	bend, err := newSizeRoutingBackend(conf)
+	if err != nil {
+		t.Fatalf("Failed to create size routing backend : %v\n", err)
+	}
+	ctx := context.Background()
+	smallID := "1111111111111111111111111111111111111111"
+	largeID := "2222222222222222222222222222222222222222"
+
+	if err := bend.write(ctx, repoID, smallID, strings.NewReader("small"), false); err != nil {
+		t.Fatalf("Failed to write small object : %v\n", err)
+	}
+	if err := bend.write(ctx, repoID, largeID, strings.NewReader("larger than the threshold"), false); err != nil {
+		t.Fatalf("Failed to write large object : %v\n", err)
+	}
+	if ret, _ := bend.small.exists(repoID, smallID); !ret {
+		t.Errorf("Small object should be written to the small backend.\n")
+	}
+	if ret, _ := bend.large.exists(repoID, largeID); !ret {
+		t.Errorf("Large object should be written to the large backend.\n")
+	}
+
+	var buf bytes.Buffer
+	if err := bend.read(ctx, repoID, largeID, &buf); err != nil || buf.String() != "larger than the threshold" {
+		t.Errorf("Read %q of large object : %v\n", buf.String(), err)
+	}
+	var listed []string
+	bend.list(repoID, func(objID string) error {
+		listed = append(listed, objID)
+		return nil
+	})
+	if len(listed) != 2 {
+		t.Errorf("Expected 2 listed objects, got %v\n", listed)
+	}
+	bend.delete(repoID, smallID)
+	bend.delete(repoID, largeID)
+	if ret, _ := bend.exists(repoID, largeID); ret {
+		t.Errorf("Deleted object shouldn't exist.\n")
+	}
+
+	// The small backend has no directory for a repo of large objects only.
+	largeRepoID := "b8d7f2e3-66c5-4a4b-9f0e-8d7c6b5f4e66"
+	defer deleteRepoBackend(bend, largeRepoID)
+	if err := bend.write(ctx, largeRepoID, largeID, strings.NewReader("larger than the threshold"), false); err != nil {
+		t.Fatalf("Failed to write large object : %v\n", err)
+	}
+	if err := bend.delete(largeRepoID, largeID); err != nil {
+		t.Errorf("Deleting an object of the large backend only should succeed : %v\n", err)
+	}
+	if ret, _ := bend.exists(largeRepoID, largeID); ret {
+		t.Errorf("Deleted large object shouldn't exist.\n")
+	}
+}
+
+func TestModTime(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	before := time.Now().Add(-time.Second)
+	if err := bend.Write(repoID, objID, strings.NewReader("dated"), false); err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+	mtime, err := bend.ModTime(repoID, objID)
+	if err != nil || mtime.Before(before) || mtime.After(time.Now()) {
+		t.Errorf("ModTime %v should be the time of the write : %v\n", mtime, err)
+	}
+
+	// Decorators are looked through.
+	wrapped := &ObjectStore{backend: newRetryingBackend(bend.backend, 2), metrics: bend.metrics}
+	if _, err := wrapped.ModTime(repoID, "ffffffffffffffffffffffffffffffffffffffff"); err != ErrObjectNotExist {
+		t.Errorf("ModTime of missing object should return ErrObjectNotExist, got %v\n", err)
+	}
+}
+
+// countingReadsBackend counts the reads reaching the wrapped backend.
+type countingReadsBackend struct {
+	storageBackend
+	reads int
+}
+
+func (b *countingReadsBackend) read(ctx context.Context, repoID string, objID string, w io.Writer) error {
+	b.reads++
+	return b.storageBackend.read(ctx, repoID, objID, w)
+}
+
+func TestDiskCache(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	remote := &countingReadsBackend{storageBackend: bend.backend}
+	cacheDir := path.Join(seafileDataDir, "disk-cache")
+	cache, err := newDiskCacheBackend(remote, cacheDir, "commit", 20)
+	if err != nil {
+		t.Fatalf("Failed to create disk cache : %v\n", err)
+	}
+	ctx := context.Background()
+	ids := []string{
+		"9999999999999999999999999999999999999991",
+		"9999999999999999999999999999999999999992",
+	}
+	for _, id := range ids {
+		if err := bend.Write(repoID, id, strings.NewReader("twelve bytes"), false); err != nil {
+			t.Fatalf("Failed to write object : %v\n", err)
+		}
+		defer bend.Delete(repoID, id)
+	}
+
+	for i := 0; i < 2; i++ {
+		var buf bytes.Buffer
+		if err := cache.read(ctx, repoID, ids[0], &buf); err != nil || buf.String() != "twelve bytes" {
+			t.Errorf("Read %q through disk cache : %v\n", buf.String(), err)
+		}
+	}
+	if remote.reads != 1 {
+		t.Errorf("Second read should be served from disk, got %d remote reads\n", remote.reads)
+	}
+
+	// Caching the second object exceeds the size and evicts the first.
+	cache.read(ctx, repoID, ids[1], ioutil.Discard)
+	if _, err := os.Stat(cache.cache.objectPath(repoID, ids[0])); !os.IsNotExist(err) {
+		t.Errorf("Least recently read object should be evicted : %v\n", err)
+	}
+
+	// The index is rebuilt from the cache directory.
+	reloaded, err := newDiskCacheBackend(remote, cacheDir, "commit", 20)
+	if err != nil {
+		t.Fatalf("Failed to reload disk cache : %v\n", err)
+	}
+	if _, ok := reloaded.get(repoID, ids[1]); !ok || reloaded.size != 12 {
+		t.Errorf("Cached object should be found after reloading, cache size %d\n", reloaded.size)
+	}
+}
+
+func TestNewFailsFast(t *testing.T) {
+	confDir, err := ioutil.TempDir("", "objstore-conf")
+	if err != nil {
+		t.Fatalf("Failed to create config dir : %v\n", err)
+	}
+	defer os.RemoveAll(confDir)
+	missingDir := path.Join(confDir, "missing")
+	err = ioutil.WriteFile(path.Join(confDir, "seafile.conf"), []byte("[store]\ncreate_data_dir = false\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write config : %v\n", err)
+	}
+	if _, err := New(confDir, missingDir, "commits"); err == nil {
+		t.Errorf("New should fail if the data dir is missing and can't be created.\n")
+	}
+
+	// Root can write anywhere.
+	if os.Geteuid() == 0 {
+		return
+	}
+	readOnlyDir := path.Join(confDir, "read-only")
+	os.MkdirAll(path.Join(readOnlyDir, "storage", "commits"), 0755)
+	os.Chmod(path.Join(readOnlyDir, "storage", "commits"), 0555)
+	if _, err := New(confDir, readOnlyDir, "commits"); err == nil {
+		t.Errorf("New should fail if the data dir isn't writable.\n")
+	}
+}
+
+func TestRateLimitedBackend(t *testing.T) {
+	config, err := ini.Load([]byte("[store]\nwrite_rate_limit = 20\nread_bytes_rate_limit = 100\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config : %v\n", err)
+	}
+	bend := newTestStore(t, seafileDataDir, "commit")
+	limited, err := rateLimitFromConfig(config, "commit", bend.backend)
+	if err != nil {
+		t.Fatalf("Failed to create rate limited backend : %v\n", err)
+	}
+	ctx := context.Background()
+
+	// The burst of 20 writes passes, the next 2 wait for 50ms each.
+	start := time.Now()
+	for i := 0; i < 22; i++ {
+		if err := limited.write(ctx, repoID, objID, strings.NewReader("limited"), false); err != nil {
+			t.Fatalf("Failed to write object : %v\n", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("Writes over the rate limit should wait, took %v\n", elapsed)
+	}
+
+	// Reading 7 bytes when the bucket of 100 bytes is empty waits for 70ms.
+	limited.(*rateLimitedBackend).readBytes.AllowN(time.Now(), 100)
+	cancelCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := limited.read(cancelCtx, repoID, objID, ioutil.Discard); err == nil {
+		t.Errorf("Read waiting beyond its deadline should fail.\n")
+	}
+}
+
+func TestWriteFromFile(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	staged := path.Join(seafileDataDir, "staged")
+	content := "staged upload"
+	if err := ioutil.WriteFile(staged, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write staged file : %v\n", err)
+	}
+	defer os.Remove(staged)
+	bend.Delete(repoID, objID)
+
+	// Linked by the fs backend, streamed through decorators.
+	streamed := &ObjectStore{backend: &closingBackend{storageBackend: bend.backend}, metrics: bend.metrics}
+	for _, store := range []*ObjectStore{bend, streamed} {
+		if err := store.WriteFromFile(repoID, objID, staged, true); err != nil {
+			t.Fatalf("Failed to write object from file : %v\n", err)
+		}
+		var buf bytes.Buffer
+		if err := bend.Read(repoID, objID, &buf); err != nil || buf.String() != content {
+			t.Errorf("Read %q instead of %q : %v\n", buf.String(), content, err)
+		}
+		if _, err := os.Stat(staged); err != nil {
+			t.Errorf("Staged file should be left in place : %v\n", err)
+		}
+		bend.Delete(repoID, objID)
+	}
+}
+
+func TestNoSpace(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "blocks")
+	id := "7171717171717171717171717171717171717171"
+	fs := findBackend(bend.backend, func(b storageBackend) bool { _, ok := b.(*fsBackend); return ok }).(*fsBackend)
+	objPath := fs.objectPath(repoID, id)
+
+	// The disk fills up after part of the object has been copied.
+	full := &os.PathError{Op: "write", Path: objPath, Err: syscall.ENOSPC}
+	err := bend.Write(repoID, id, &failingReader{n: 100000, err: full}, true)
+	if !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("Write on a full disk should fail with ErrNoSpace, got %v\n", err)
+	}
+	if IsRetryable(err) {
+		t.Errorf("ErrNoSpace should not be retryable.\n")
+	}
+	if exists, _ := bend.Exists(repoID, id); exists {
+		t.Errorf("No partial object should be left after ENOSPC.\n")
+	}
+	files, err := ioutil.ReadDir(path.Dir(objPath))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("Failed to read object dir : %v\n", err)
+	}
+	for _, file := range files {
+		if strings.Contains(file.Name(), ".tmp.") {
+			t.Errorf("Temp file %s should be removed after ENOSPC.\n", file.Name())
+		}
+	}
+}
+
+func TestMemStore(t *testing.T) {
+	mem := NewMemBackend()
+	store := mem.Store("commit")
+	ids := []string{"7373737373737373737373737373737373737373", "7474747474747474747474747474747474747474"}
+
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if err := store.Write(repoID, id, strings.NewReader(id), false); err != nil {
+				t.Errorf("Failed to write object %s : %v\n", id, err)
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	var buf bytes.Buffer
+	if err := store.Read(repoID, ids[0], &buf); err != nil || buf.String() != ids[0] {
+		t.Errorf("Read %q instead of %q : %v\n", buf.String(), ids[0], err)
+	}
+	if size, err := store.Stat(repoID, ids[1]); err != nil || size != int64(len(ids[1])) {
+		t.Errorf("Stat returned %d instead of %d : %v\n", size, len(ids[1]), err)
+	}
+	if listed, err := store.List(repoID); err != nil || len(listed) != 2 || listed[0] != ids[0] || listed[1] != ids[1] {
+		t.Errorf("Listed %v instead of %v : %v\n", listed, ids, err)
+	}
+	if err := store.Delete(repoID, ids[0]); err != nil {
+		t.Fatalf("Failed to delete object : %v\n", err)
+	}
+	if exists, err := store.Exists(repoID, ids[0]); err != nil || exists {
+		t.Errorf("Deleted object should not exist : %v\n", err)
+	}
+	if err := store.Read(repoID, ids[0], &buf); !errors.Is(err, ErrObjectNotExist) {
+		t.Errorf("Reading a deleted object should fail with ErrObjectNotExist, got %v\n", err)
+	}
+
+	// Only the second write from now fails, and stores nothing.
+	mem.FailOn("write", 2, ErrNoSpace)
+	for i, id := range ids {
+		err := store.Write(repoID, id, strings.NewReader(id), false)
+		if i == 1 && !errors.Is(err, ErrNoSpace) {
+			t.Errorf("Second write should fail with the injected error, got %v\n", err)
+		} else if i == 0 && err != nil {
+			t.Errorf("First write should succeed : %v\n", err)
+		}
+	}
+	if mem.Len() != 2 {
+		t.Errorf("Memory backend has %d objects instead of 2.\n", mem.Len())
+	}
+	if err := store.Write(repoID, ids[0], strings.NewReader(ids[0]), false); err != nil {
+		t.Errorf("Injected failure should only happen once : %v\n", err)
+	}
+}
+
+func TestVerifyOnWrite(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "blocks")
+	bend.verifyOnWrite = true
+	content := []byte("verified on write")
+	id := ComputeID(content)
+	defer bend.Delete(repoID, id)
+
+	if err := bend.Write(repoID, id, bytes.NewReader(content), false); err != nil {
+		t.Errorf("Write of matching content should succeed : %v\n", err)
+	}
+
+	// Written under the ID of other content, sized and not.
+	wrongID := ComputeID([]byte("other content"))
+	writes := map[string]func() error{
+		"Write":      func() error { return bend.Write(repoID, wrongID, bytes.NewReader(content), false) },
+		"WriteSized": func() error { return bend.WriteSized(repoID, wrongID, strings.NewReader(string(content)), int64(len(content)), false) },
+	}
+	for name, write := range writes {
+		var checksumErr *ChecksumError
+		err := write()
+		if !errors.As(err, &checksumErr) || checksumErr.Expected != wrongID || checksumErr.Actual != id {
+			t.Errorf("%s under the wrong ID should fail with ErrChecksumMismatch, got %v\n", name, err)
+		}
+		if exists, _ := bend.Exists(repoID, wrongID); exists {
+			t.Errorf("%s under the wrong ID should store nothing.\n", name)
+		}
+	}
+	if _, errs := bend.WriteMany(repoID, []Object{{wrongID, content}}, false); !errors.Is(errs[0], ErrChecksumMismatch) {
+		t.Errorf("WriteMany under the wrong ID should fail with ErrChecksumMismatch, got %v\n", errs[0])
+	}
+
+	// IDs which aren't hashes can't be checked.
+	if err := bend.Write(repoID, "not-a-hash", bytes.NewReader(content), false); err != nil {
+		t.Errorf("Write under an ID which isn't a hash should succeed : %v\n", err)
+	}
+	bend.Delete(repoID, "not-a-hash")
+}
+
+func TestExport(t *testing.T) {
+	exportRepoID := "e7b3c1f0-75a4-4b6f-9d2e-3b1c0a9e7f75"
+	bend := newTestStore(t, seafileDataDir, "commit")
+	defer bend.DeleteRepo(exportRepoID)
+	contents := map[string]string{
+		"7575757575757575757575757575757575757575": "first exported",
+		"7676767676767676767676767676767676767676": "second exported",
+		"7777777777777777777777777777777777777777": "third exported",
+	}
+	for id, content := range contents {
+		if err := bend.Write(exportRepoID, id, strings.NewReader(content), false); err != nil {
+			t.Fatalf("Failed to write object : %v\n", err)
+		}
+	}
+
+	// Walked by the fs backend, and listed then opened through decorators.
+	fetched := &ObjectStore{backend: &closingBackend{storageBackend: bend.backend}, metrics: bend.metrics}
+	for _, store := range []*ObjectStore{bend, fetched} {
+		exported := make(map[string]string)
+		err := store.Export(exportRepoID, func(objID string, r io.Reader) error {
+			data, err := ioutil.ReadAll(r)
+			exported[objID] = string(data)
+			return err
+		})
+		if err != nil || len(exported) != len(contents) {
+			t.Errorf("Exported %d objects instead of %d : %v\n", len(exported), len(contents), err)
+		}
+		for id, content := range contents {
+			if exported[id] != content {
+				t.Errorf("Exported %q instead of %q for %s.\n", exported[id], content, id)
+			}
+		}
+
+		stop := errors.New("backup target full")
+		calls := 0
+		err = store.Export(exportRepoID, func(objID string, r io.Reader) error {
+			calls++
+			return stop
+		})
+		if err != stop || calls != 1 {
+			t.Errorf("Export should stop at the first error of fn, got %d calls : %v\n", calls, err)
+		}
+	}
+}
+
+func TestArchiveBackend(t *testing.T) {
+	archiveRepoID := "a7c6e1d2-76b4-4f3a-8e9d-7c6b5a4e3d76"
+	conf := map[string]string{
+		"obj_type":         "blocks",
+		"data_dir":         seafileDataDir,
+		"hot.type":         "fs",
+		"hot.data_dir":     path.Join(seafileDataDir, "hot"),
+		"archive.type":     "fs",
+		"archive.data_dir": path.Join(seafileDataDir, "archive"),
+	}
+	bend, err := newArchiveBackend(conf)
+	if err != nil {
+		t.Fatalf("Failed to create archive backend : %v\n", err)
+	}
+	store := &ObjectStore{ObjType: "blocks", backend: bend, metrics: newStoreMetrics("blocks")}
+	defer store.DeleteRepo(archiveRepoID)
+	coldID := "7878787878787878787878787878787878787878"
+	warmID := "7979797979797979797979797979797979797979"
+	for _, id := range []string{coldID, warmID} {
+		if err := store.Write(archiveRepoID, id, strings.NewReader(id), false); err != nil {
+			t.Fatalf("Failed to write object : %v\n", err)
+		}
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(bend.hot.(*fsBackend).objectPath(archiveRepoID, coldID), old, old); err != nil {
+		t.Fatalf("Failed to age object : %v\n", err)
+	}
+
+	archived, err := store.ArchiveColderThan(archiveRepoID, 24*time.Hour)
+	if err != nil || archived != 1 {
+		t.Fatalf("Archived %d objects instead of 1 : %v\n", archived, err)
+	}
+	if ret, _ := bend.hot.exists(archiveRepoID, coldID); ret {
+		t.Errorf("Archived object should be removed from the hot backend.\n")
+	}
+	if ret, _ := bend.cold.exists(archiveRepoID, coldID); !ret {
+		t.Errorf("Archived object should be in the archive.\n")
+	}
+	if ret, _ := bend.hot.exists(archiveRepoID, warmID); !ret {
+		t.Errorf("Recently written object should stay in the hot backend.\n")
+	}
+	if ret, err := store.Exists(archiveRepoID, coldID); err != nil || !ret {
+		t.Errorf("Archived object should exist : %v\n", err)
+	}
+	if ids, err := store.List(archiveRepoID); err != nil || len(ids) != 2 {
+		t.Errorf("Listed %v instead of both objects : %v\n", ids, err)
+	}
+
+	// Reading restores the object into the hot backend.
+	var buf bytes.Buffer
+	if err := store.Read(archiveRepoID, coldID, &buf); err != nil || buf.String() != coldID {
+		t.Errorf("Read %q instead of %q : %v\n", buf.String(), coldID, err)
+	}
+	if ret, _ := bend.hot.exists(archiveRepoID, coldID); !ret {
+		t.Errorf("Read of an archived object should restore it.\n")
+	}
+
+	if err := store.Archive(archiveRepoID, warmID); err != nil {
+		t.Errorf("Failed to archive object : %v\n", err)
+	}
+	if err := store.Archive(archiveRepoID, warmID); err != nil {
+		t.Errorf("Archiving an archived object should do nothing : %v\n", err)
+	}
+	if err := store.Archive(archiveRepoID, "8080808080808080808080808080808080808080"); !errors.Is(err, ErrObjectNotExist) {
+		t.Errorf("Archiving a missing object should fail with ErrObjectNotExist, got %v\n", err)
+	}
+	if err := newTestStore(t, seafileDataDir, "commit").Archive(archiveRepoID, warmID); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Archiving without an archive backend should fail with ErrNotSupported, got %v\n", err)
+	}
+}
+
+// recordingLogger keeps the events it's passed.
+type recordingLogger struct {
+	mu     sync.Mutex
+	events []OpEvent
+}
+
+func (l *recordingLogger) Log(e OpEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, e)
+}
+
+func TestLogger(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "commit")
+	logger := new(recordingLogger)
+	bend.SetLogger(logger, false)
+	defer bend.SetLogger(nil, false)
+	missingID := "8181818181818181818181818181818181818181"
+
+	content := "logged"
+	if err := bend.Write(repoID, objID, strings.NewReader(content), false); err != nil {
+		t.Fatalf("Failed to write object : %v\n", err)
+	}
+	var buf bytes.Buffer
+	bend.Read(repoID, missingID, &buf)
+	if len(logger.events) != 1 {
+		t.Fatalf("Only the failed read should be logged, got %v\n", logger.events)
+	}
+	e := logger.events[0]
+	if e.Op != "read" || e.ObjType != "commit" || e.RepoID != repoID || e.ObjID != missingID || !errors.Is(e.Err, ErrObjectNotExist) {
+		t.Errorf("Logged %+v for the failed read.\n", e)
+	}
+
+	logger.events = nil
+	bend.SetLogger(logger, true)
+	if err := bend.Read(repoID, objID, &buf); err != nil {
+		t.Fatalf("Failed to read object : %v\n", err)
+	}
+	if len(logger.events) != 1 || logger.events[0].Op != "read" || logger.events[0].Bytes != int64(len(content)) ||
+		logger.events[0].Err != nil || logger.events[0].Duration <= 0 {
+		t.Errorf("Verbose logger should get the read of %d bytes, got %+v\n", len(content), logger.events)
+	}
+
+	// Every other operation is logged too.
+	loggedRepoID := "a3c2e7d8-49b0-4f9a-8e5d-3c2b1a0e9d49"
+	defer bend.DeleteRepo(loggedRepoID)
+	srcPath := path.Join(seafileDataDir, "logged-upload")
+	if err := ioutil.WriteFile(srcPath, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write file : %v\n", err)
+	}
+	defer os.Remove(srcPath)
+	ops := []struct {
+		op string
+		fn func() error
+	}{
+		{"copy", func() error { return bend.Copy(repoID, loggedRepoID, objID) }},
+		{"move", func() error { return bend.Move(loggedRepoID, repoID, objID) }},
+		{"open", func() error {
+			rc, err := bend.Open(repoID, objID)
+			if err == nil {
+				rc.Close()
+			}
+			return err
+		}},
+		{"read_range", func() error { return bend.ReadRange(repoID, objID, 1, 2, ioutil.Discard) }},
+		{"write_from_file", func() error { return bend.WriteFromFile(loggedRepoID, missingID, srcPath, false) }},
+		{"write_many", func() error {
+			_, errs := bend.WriteMany(loggedRepoID, []Object{{ObjID: missingID, Data: []byte(content)}}, false)
+			return firstError(errs)
+		}},
+		{"delete_many", func() error {
+			_, errs := bend.DeleteMany(loggedRepoID, []string{missingID})
+			return firstError(errs)
+		}},
+	}
+	for _, op := range ops {
+		logger.events = nil
+		if err := op.fn(); err != nil {
+			t.Fatalf("Failed to %s : %v\n", op.op, err)
+		}
+		found := false
+		for _, e := range logger.events {
+			found = found || e.Op == op.op
+		}
+		if !found {
+			t.Errorf("Verbose logger should get the %s, got %+v\n", op.op, logger.events)
+		}
+	}
+
+	// Without a logger, nothing is allocated for logging.
+	null := &ObjectStore{ObjType: "null", backend: &nullBackend{}, metrics: newStoreMetrics("null")}
+	if allocs := testing.AllocsPerRun(100, func() { null.Exists(repoID, objID) }); allocs != 0 {
+		t.Errorf("Exists without a logger allocated %v times.\n", allocs)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { null.Read(repoID, objID, ioutil.Discard) }); allocs != 0 {
+		t.Errorf("Read without a logger allocated %v times.\n", allocs)
+	}
+}
+
+// flakyWriteBackend consumes part of the content of the first failures
+// writes and fails them with a connection reset.
+type flakyWriteBackend struct {
+	storageBackend
+	failures int
+}
+
+func (b *flakyWriteBackend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	if b.failures > 0 {
+		b.failures--
+		r.Read(make([]byte, 4))
+		return syscall.ECONNRESET
+	}
+	return b.storageBackend.write(ctx, repoID, objID, r, sync)
+}
+
+func TestRetryWriteSized(t *testing.T) {
+	bend := newTestStore(t, seafileDataDir, "blocks")
+	id := "8282828282828282828282828282828282828282"
+	content := "retried sized write"
+	defer bend.Delete(repoID, id)
+
+	retried := &ObjectStore{backend: newRetryingBackend(&flakyWriteBackend{bend.backend, 1}, 2), metrics: bend.metrics}
+	if err := retried.WriteSized(repoID, id, strings.NewReader(content), int64(len(content)), false); err != nil {
+		t.Fatalf("Sized write should succeed when retried : %v\n", err)
+	}
+	var buf bytes.Buffer
+	if err := bend.Read(repoID, id, &buf); err != nil || buf.String() != content {
+		t.Errorf("Read %q instead of %q : %v\n", buf.String(), content, err)
+	}
+
+	// The size is still checked after rewinding.
+	retried = &ObjectStore{backend: newRetryingBackend(&flakyWriteBackend{bend.backend, 1}, 2), metrics: bend.metrics}
+	if err := retried.WriteSized(repoID, id, strings.NewReader(content), int64(len(content))+1, false); !errors.Is(err, ErrSizeMismatch) {
+		t.Errorf("Retried write of short content should fail with ErrSizeMismatch, got %v\n", err)
+	}
+
+	// Short content is the caller's error, so it's not retried.
+	counting := &countingWritesBackend{storageBackend: NewMemBackend()}
+	retried = &ObjectStore{backend: newRetryingBackend(counting, 2), metrics: bend.metrics}
+	if err := retried.WriteSized(repoID, id, strings.NewReader(content), int64(len(content))+1, false); !errors.Is(err, ErrSizeMismatch) || counting.writes != 1 {
+		t.Errorf("Short content should fail once with ErrSizeMismatch, got %d writes : %v\n", counting.writes, err)
+	}
+}
+
+type countingWritesBackend struct {
+	storageBackend
+	writes int
+}
+
+func (b *countingWritesBackend) write(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) error {
+	b.writes++
+	return b.storageBackend.write(ctx, repoID, objID, r, sync)
+}
+
+func TestWriteMany(t *testing.T) {
+	manyRepoID := "c9e8a3f4-65d6-4b5c-8a1f-9e8d7c6a5f65"
+	bend := newTestStore(t, seafileDataDir, "commit")
+	defer bend.DeleteRepo(manyRepoID)
+	objs := []Object{
+		{"8383838383838383838383838383838383838383", []byte("first of batch")},
+		{"../escaping", []byte("rejected")},
+		{"8484848484848484848484848484848484848484", []byte("second of batch")},
+	}
+
+	// Written by the fs backend in turn.
+	written, errs := bend.WriteMany(manyRepoID, objs, true)
+	if written != 2 || errs[0] != nil || errs[2] != nil || !errors.Is(errs[1], ErrInvalidObjectID) {
+		t.Errorf("Expected 2 written and the invalid ID to fail, got %d written : %v\n", written, errs)
+	}
+	for _, i := range []int{0, 2} {
+		var buf bytes.Buffer
+		if err := bend.Read(manyRepoID, objs[i].ObjID, &buf); err != nil || buf.String() != string(objs[i].Data) {
+			t.Errorf("Read %q instead of %q : %v\n", buf.String(), objs[i].Data, err)
+		}
+	}
+
+	// Written concurrently by the fallback, which fails one of the writes.
+	mem := NewMemBackend()
+	mem.FailOn("write", 2, ErrBackendUnavailable)
+	written, errs = mem.Store("commit").WriteMany(manyRepoID, objs, false)
+	failed := -1
+	for i, err := range errs {
+		if err != nil {
+			if failed >= 0 || !errors.Is(err, ErrBackendUnavailable) {
+				t.Errorf("Only one write should fail with the injected error : %v\n", errs)
+			}
+			failed = i
+		}
+	}
+	if written != 2 || failed < 0 || mem.Len() != 2 {
+		t.Errorf("Expected 2 of 3 objects written, got %d written, %d stored : %v\n", written, mem.Len(), errs)
+	}
+	if failed >= 0 {
+		if ret, _ := mem.exists(manyRepoID, objs[failed].ObjID); ret {
+			t.Errorf("Failed object %s shouldn't be stored.\n", objs[failed].ObjID)
+		}
+	}
+}
+
+func TestHashAlgoConfig(t *testing.T) {
+	confDir, err := ioutil.TempDir("", "objstore-conf")
+	if err != nil {
+		t.Fatalf("Failed to create config dir : %v\n", err)
+	}
+	defer os.RemoveAll(confDir)
+	defer func() {
+		configuredAlgo.algo = ""
+		SetHashAlgo(HashSHA1)
+	}()
+	dataDir := path.Join(confDir, "data")
+	writeConf := func(algo string) {
+		if err := ioutil.WriteFile(path.Join(confDir, "seafile.conf"), []byte("[store]\nhash_algo = "+algo+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to write config : %v\n", err)
+		}
+	}
+
+	writeConf("sha3")
+	if _, err := New(confDir, dataDir, "blocks"); err == nil {
+		t.Errorf("New should fail with an unsupported hash_algo.\n")
+	}
+	if GetHashAlgo() != HashSHA1 {
+		t.Errorf("Unsupported hash_algo shouldn't change the algorithm.\n")
+	}
+
+	writeConf("sha256")
+	if _, err := New(confDir, dataDir, "blocks"); err != nil || GetHashAlgo() != HashSHA256 {
+		t.Errorf("hash_algo should set the algorithm to sha256, got %s : %v\n", GetHashAlgo(), err)
+	}
+	// Later stores don't reset an algorithm set since.
+	SetHashAlgo(HashSHA1)
+	if _, err := New(confDir, dataDir, "fs"); err != nil || GetHashAlgo() != HashSHA1 {
+		t.Errorf("Creating another store shouldn't reset the algorithm, got %s : %v\n", GetHashAlgo(), err)
+	}
+	writeConf("sha1")
+	if _, err := New(confDir, dataDir, "commits"); err == nil {
+		t.Errorf("New should fail with a hash_algo conflicting with another store.\n")
+	}
+}
+
+// capsBackend counts the calls of the optional capabilities of the fs
+// backend reaching it.
+type capsBackend struct {
+	*fsBackend
+	sized, copies, pages, batches, stats int
+}
+
+func (b *capsBackend) writeSized(ctx context.Context, repoID string, objID string, r io.Reader, size int64, sync bool) error {
+	b.sized++
+	return b.fsBackend.write(ctx, repoID, objID, r, sync)
+}
+
+func (b *capsBackend) copy(srcRepoID string, dstRepoID string, objID string) error {
+	b.copies++
+	return b.fsBackend.copy(srcRepoID, dstRepoID, objID)
+}
+
+func (b *capsBackend) existsMany(repoID string, objIDs []string) (map[string]bool, error) {
+	b.batches++
+	return b.fsBackend.existsMany(repoID, objIDs)
+}
+
+func (b *capsBackend) repoStats(repoID string) (int64, int64, error) {
+	b.stats++
+	return b.fsBackend.repoStats(repoID)
+}
+
+func (b *capsBackend) listPage(repoID string, token string, limit int) ([]string, string, error) {
+	b.pages++
+	return b.fsBackend.listPage(repoID, token, limit)
+}
+
+func TestCapabilitiesThroughDecorators(t *testing.T) {
+	srcRepoID := "d0f9b4a5-54e7-4c6d-9b2a-0f9e8d7b6a54"
+	dstRepoID := "e1a0c5b6-43f8-4d7e-8c3b-1a0f9e8c7b43"
+	fs, err := newFSBackend(seafileDataDir, "blocks")
+	if err != nil {
+		t.Fatalf("Failed to create fs backend : %v\n", err)
+	}
+	caps := &capsBackend{fsBackend: fs}
+	neg := newNegativeCachingBackend(newLimitingBackend(newRetryingBackend(caps, 2), 4, "blocks"), 10, time.Minute)
+	store := &ObjectStore{ObjType: "blocks", backend: neg, metrics: newStoreMetrics("blocks")}
+	defer store.DeleteRepo(srcRepoID)
+	defer store.DeleteRepo(dstRepoID)
+	id := "8585858585858585858585858585858585858585"
+	content := "through decorators"
+
+	if err := store.WriteSized(srcRepoID, id, strings.NewReader(content), int64(len(content)), false); err != nil || caps.sized != 1 {
+		t.Errorf("Sized write should reach the backend, got %d sized writes : %v\n", caps.sized, err)
+	}
+
+	// The destination is remembered as missing until it's copied.
+	if ret, _ := store.Exists(dstRepoID, id); ret {
+		t.Fatalf("Object shouldn't exist in the destination repo yet.\n")
+	}
+	if err := store.Copy(srcRepoID, dstRepoID, id); err != nil || caps.copies != 1 {
+		t.Errorf("Copy should be done by the backend, got %d copies : %v\n", caps.copies, err)
+	}
+	if ret, _ := store.Exists(dstRepoID, id); !ret {
+		t.Errorf("Copied object should exist.\n")
+	}
+
+	if ids, _, err := store.ListPage(srcRepoID, "", 10); err != nil || len(ids) != 1 || caps.pages != 1 {
+		t.Errorf("Pages should be listed by the backend, got %v and %d pages : %v\n", ids, caps.pages, err)
+	}
+
+	// Missing objects of a batch are remembered by the negative cache.
+	missingID := "8787878787878787878787878787878787878787"
+	found, err := store.ExistsMany(srcRepoID, []string{id, missingID})
+	if err != nil || !found[id] || found[missingID] || caps.batches != 1 {
+		t.Errorf("Batch should be checked by the backend, got %v and %d batches : %v\n", found, caps.batches, err)
+	}
+	if found, err := store.ExistsMany(srcRepoID, []string{missingID}); err != nil || found[missingID] || caps.batches != 1 {
+		t.Errorf("Missing object of a batch should be remembered, got %v and %d batches : %v\n", found, caps.batches, err)
+	}
+
+	if count, size, err := store.RepoStats(srcRepoID); err != nil || count != 1 || size != int64(len(content)) || caps.stats != 1 {
+		t.Errorf("Repo should be summed up by the backend, got %d objects of %d bytes and %d calls : %v\n", count, size, caps.stats, err)
+	}
+
+	ttlID := "8686868686868686868686868686868686868686"
+	if err := store.WriteWithTTL(srcRepoID, ttlID, strings.NewReader("temporary"), time.Hour); err != nil {
+		t.Errorf("Objects with TTL should be written through decorators : %v\n", err)
+	}
+	if ret, _ := store.Exists(srcRepoID, ttlID); !ret {
+		t.Errorf("Object with TTL should exist.\n")
+	}
+
+	// Caches of content aren't looked through for objects with TTL.
+	cached := &ObjectStore{ObjType: "blocks", backend: newCachingBackend(caps, 1000), metrics: store.metrics}
+	if err := cached.WriteWithTTL(srcRepoID, ttlID, strings.NewReader("temporary"), time.Hour); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Objects with TTL shouldn't be written through a cache, got %v\n", err)
+	}
 }
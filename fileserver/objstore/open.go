@@ -0,0 +1,61 @@
+package objstore
+
+import (
+	"context"
+	"io"
+)
+
+// opener is implemented by backends that can return a reader over an
+// object, instead of copying it to a writer. Errors finding the object are
+// returned by open, not by the first Read.
+type opener interface {
+	open(ctx context.Context, repoID string, objID string) (io.ReadCloser, error)
+}
+
+// Open returns a reader over an object, for callers that pull the content,
+// e.g. to decompress it. It returns ErrObjectNotExist if the object is
+// missing, before anything is read. The reader must be closed to release
+// the file or connection it holds.
+func (s *ObjectStore) Open(repoID string, objID string) (rc io.ReadCloser, err error) {
+	ctx, span := s.startSpan(context.Background(), "open", repoID, objID)
+	defer func() {
+		span.end(err)
+	}()
+	if b, ok := s.backend.(opener); ok {
+		return b.open(ctx, repoID, objID)
+	}
+
+	// Other backends are read into a pipe, so a missing object is detected
+	// with stat first.
+	if _, err := s.backend.stat(repoID, objID); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(s.backend.read(ctx, repoID, objID, pw))
+	}()
+	return &pipeReadCloser{pr, cancel}, nil
+}
+
+// pipeReadCloser stops the read feeding a pipe when it's closed.
+type pipeReadCloser struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+func (p *pipeReadCloser) Close() error {
+	p.cancel()
+	return p.PipeReader.Close()
+}
+
+func (b *fsBackend) open(ctx context.Context, repoID string, objID string) (io.ReadCloser, error) {
+	if err := checkIDs(repoID, objID); err != nil {
+		return nil, err
+	}
+	fd, err := b.openObject(repoID, objID)
+	if err != nil {
+		return nil, objectError(err)
+	}
+	return fd, nil
+}
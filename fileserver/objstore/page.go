@@ -0,0 +1,93 @@
+package objstore
+
+import (
+	"path"
+	"sort"
+)
+
+// defaultPageSize is the number of objects ListPage returns if limit isn't positive.
+const defaultPageSize = 1000
+
+// pageLister is implemented by backends that can list a repo's objects page
+// by page natively.
+type pageLister interface {
+	listPage(repoID string, token string, limit int) ([]string, string, error)
+}
+
+// ListPage returns up to limit objects of a repo, starting from the position
+// encoded in token, which is empty for the first page. nextToken is passed to
+// the next call to continue the listing, and is empty after the last page.
+// Tokens are opaque and specific to the backend. Objects added or removed
+// between calls may or may not be returned, but a page never holds
+// duplicates.
+func (s *ObjectStore) ListPage(repoID string, token string, limit int) (objIDs []string, nextToken string, err error) {
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	found := findCapability(s.backend, "list_page", func(b storageBackend) bool {
+		_, ok := b.(pageLister)
+		return ok
+	})
+	if found != nil {
+		return found.(pageLister).listPage(repoID, token, limit)
+	}
+	return listPageFallback(s.backend, repoID, token, limit)
+}
+
+// listPageFallback pages through a full listing in order of object IDs, the
+// token being the last object ID returned.
+func listPageFallback(backend storageBackend, repoID string, token string, limit int) ([]string, string, error) {
+	var objIDs []string
+	err := backend.list(repoID, func(objID string) error {
+		if objID > token {
+			objIDs = append(objIDs, objID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	sort.Strings(objIDs)
+	if len(objIDs) <= limit {
+		return objIDs, "", nil
+	}
+	objIDs = objIDs[:limit]
+	return objIDs, objIDs[limit-1], nil
+}
+
+// listPage walks the object directories in order, the token being the last
+// object ID returned, so the walk resumes after it even if it's deleted.
+func (b *fsBackend) listPage(repoID string, token string, limit int) ([]string, string, error) {
+	if err := checkRepoID(repoID); err != nil {
+		return nil, "", err
+	}
+	dirs, err := b.layout.objectDirs(path.Join(b.objDir, repoID))
+	if err != nil {
+		return nil, "", fsError(err)
+	}
+
+	var objIDs []string
+	for _, dir := range dirs {
+		// Every object of an earlier shard sorts before the token.
+		if len(token) >= len(dir.prefix) && dir.prefix < token[:len(dir.prefix)] {
+			continue
+		}
+		entries, err := readObjectDir(dir.path)
+		if err != nil {
+			return nil, "", fsError(err)
+		}
+		for _, entry := range entries {
+			objID := dir.prefix + entry.Name()
+			if objID <= token {
+				continue
+			}
+			if len(objIDs) == limit {
+				return objIDs, objIDs[limit-1], nil
+			}
+			objIDs = append(objIDs, objID)
+		}
+	}
+
+	return objIDs, "", nil
+}
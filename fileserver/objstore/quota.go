@@ -0,0 +1,77 @@
+package objstore
+
+import (
+	"io"
+)
+
+// quotaCheckInterval is how often the quota is checked while streaming
+// content of unknown size.
+const quotaCheckInterval = 1 << 20
+
+// QuotaChecker decides whether a repo may store more bytes.
+type QuotaChecker interface {
+	// Allow reports whether addBytes more bytes can be written to the repo.
+	Allow(repoID string, addBytes int64) (bool, error)
+}
+
+// SetQuotaChecker sets the checker consulted before writing objects.
+// Writes that would exceed the quota fail with ErrQuotaExceeded.
+func (s *ObjectStore) SetQuotaChecker(checker QuotaChecker) {
+	s.quota = checker
+}
+
+// lengther is implemented by in-memory readers which know their remaining size.
+type lengther interface {
+	Len() int
+}
+
+// checkQuota checks the quota of a write from r. If the size of r is known
+// it's checked up front and r is returned as is, otherwise the returned
+// reader checks the quota as content is read.
+func checkQuota(checker QuotaChecker, repoID string, r io.Reader) (io.Reader, error) {
+	if l, ok := r.(lengther); ok {
+		allowed, err := checker.Allow(repoID, int64(l.Len()))
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			return nil, ErrQuotaExceeded
+		}
+		return r, nil
+	}
+	return &quotaReader{r: r, checker: checker, repoID: repoID}, nil
+}
+
+// quotaReader checks the running size against the quota every
+// quotaCheckInterval bytes and at the end of content. The write is aborted
+// with ErrQuotaExceeded as soon as the quota would be exceeded.
+type quotaReader struct {
+	r       io.Reader
+	checker QuotaChecker
+	repoID  string
+	read    int64
+	checked int64
+}
+
+func (q *quotaReader) check() error {
+	q.checked = q.read
+	allowed, err := q.checker.Allow(q.repoID, q.read)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	q.read += int64(n)
+	if err == io.EOF || q.read-q.checked >= quotaCheckInterval {
+		if qerr := q.check(); qerr != nil {
+			return 0, qerr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,98 @@
+package objstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// rangeReader is implemented by backends that can read part of an object
+// without reading the whole object.
+type rangeReader interface {
+	readRange(ctx context.Context, repoID string, objID string, offset int64, length int64, w io.Writer) error
+}
+
+// ReadRange writes length bytes of an object starting at offset into w.
+// A negative length reads to the end of the object, and a length beyond the
+// end is truncated. It returns an error matching ErrOutOfRange if offset is
+// negative or not before the end of a non-empty object.
+func (s *ObjectStore) ReadRange(repoID string, objID string, offset int64, length int64, w io.Writer) (err error) {
+	ctx, span := s.startSpan(context.Background(), "read_range", repoID, objID)
+	defer func() {
+		span.end(err)
+	}()
+	if offset < 0 {
+		return rangeError(objID, offset, -1)
+	}
+	w = span.writer(w)
+	if b, ok := s.backend.(rangeReader); ok {
+		return b.readRange(ctx, repoID, objID, offset, length, w)
+	}
+
+	size, err := s.backend.stat(repoID, objID)
+	if err != nil {
+		return err
+	}
+	if err := checkRange(objID, offset, size); err != nil {
+		return err
+	}
+	if length < 0 || offset+length > size {
+		length = size - offset
+	}
+	if length == 0 {
+		return nil
+	}
+
+	rw := &rangeWriter{w: w, skip: offset, remain: length}
+	err = s.backend.read(ctx, repoID, objID, rw)
+	if err == errRangeDone {
+		return nil
+	}
+	return err
+}
+
+func rangeError(objID string, offset int64, size int64) error {
+	return fmt.Errorf("%w: offset %d of object %s with size %d", ErrOutOfRange, offset, objID, size)
+}
+
+// checkRange checks that offset is within an object of size bytes.
+func checkRange(objID string, offset int64, size int64) error {
+	if offset < 0 || (offset >= size && !(offset == 0 && size == 0)) {
+		return rangeError(objID, offset, size)
+	}
+	return nil
+}
+
+// errRangeDone stops reading once the range is fully written.
+var errRangeDone = errors.New("range done")
+
+// rangeWriter writes remain bytes into w after skipping the first skip bytes.
+type rangeWriter struct {
+	w      io.Writer
+	skip   int64
+	remain int64
+}
+
+func (r *rangeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if r.skip >= int64(len(p)) {
+		r.skip -= int64(len(p))
+		return n, nil
+	}
+	p = p[r.skip:]
+	r.skip = 0
+
+	if int64(len(p)) > r.remain {
+		p = p[:r.remain]
+	}
+	nw, err := r.w.Write(p)
+	r.remain -= int64(nw)
+	if err != nil {
+		return nw, err
+	}
+	if r.remain == 0 {
+		return n, errRangeDone
+	}
+	return n, nil
+}
@@ -0,0 +1,141 @@
+package objstore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+)
+
+// readAheadSize is the minimum number of bytes fetched by a small ReadAt call.
+const readAheadSize = 64 * 1024
+
+// errReaderClosed is returned by ReadAt after Close.
+var errReaderClosed = errors.New("objstore: reader is closed")
+
+// ReaderAtCloser provides random access to an object.
+type ReaderAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// readerAtOpener is implemented by backends that can open an object for
+// random access natively.
+type readerAtOpener interface {
+	openReaderAt(repoID string, objID string) (ReaderAtCloser, error)
+}
+
+// OpenReaderAt opens an object for random access without reading the whole
+// object. The returned reader is safe for concurrent ReadAt calls and must be
+// closed after use.
+func (s *ObjectStore) OpenReaderAt(repoID string, objID string) (ReaderAtCloser, error) {
+	if b, ok := s.backend.(readerAtOpener); ok {
+		return b.openReaderAt(repoID, objID)
+	}
+
+	size, err := s.backend.stat(repoID, objID)
+	if err != nil {
+		return nil, err
+	}
+	return &rangeReaderAt{store: s, repoID: repoID, objID: objID, size: size}, nil
+}
+
+func (b *fsBackend) openReaderAt(repoID string, objID string) (ReaderAtCloser, error) {
+	if err := checkIDs(repoID, objID); err != nil {
+		return nil, err
+	}
+	fd, err := b.openObject(repoID, objID)
+	if err != nil {
+		return nil, objectError(err)
+	}
+	return fd, nil
+}
+
+// rangeReaderAt serves ReadAt calls with range reads. Small reads are served
+// from a read-ahead buffer, so sequential parsing doesn't issue a request
+// per call.
+type rangeReaderAt struct {
+	store  *ObjectStore
+	repoID string
+	objID  string
+	size   int64
+
+	mu     sync.Mutex
+	buf    []byte
+	bufOff int64
+	closed bool
+}
+
+func (r *rangeReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, rangeError(r.objID, off, r.size)
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	want := int64(len(p))
+	if off+want > r.size {
+		p = p[:r.size-off]
+	}
+
+	var n int
+	var err error
+	if len(p) >= readAheadSize {
+		n, err = r.fetch(p, off)
+	} else {
+		n, err = r.readBuffered(p, off)
+	}
+	if err == nil && int64(n) < want {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// fetch reads len(p) bytes at off directly into p.
+func (r *rangeReaderAt) fetch(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	closed := r.closed
+	r.mu.Unlock()
+	if closed {
+		return 0, errReaderClosed
+	}
+
+	buf := bytes.NewBuffer(p[:0])
+	err := r.store.ReadRange(r.repoID, r.objID, off, int64(len(p)), buf)
+	if err != nil {
+		return 0, err
+	}
+	return copy(p, buf.Bytes()), nil
+}
+
+func (r *rangeReaderAt) readBuffered(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, errReaderClosed
+	}
+
+	end := off + int64(len(p))
+	if off < r.bufOff || end > r.bufOff+int64(len(r.buf)) {
+		length := int64(readAheadSize)
+		if off+length > r.size {
+			length = r.size - off
+		}
+		buf := bytes.NewBuffer(make([]byte, 0, length))
+		err := r.store.ReadRange(r.repoID, r.objID, off, length, buf)
+		if err != nil {
+			return 0, err
+		}
+		r.buf = buf.Bytes()
+		r.bufOff = off
+	}
+	return copy(p, r.buf[off-r.bufOff:]), nil
+}
+
+func (r *rangeReaderAt) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	r.buf = nil
+	return nil
+}
@@ -0,0 +1,100 @@
+package objstore
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BackendFactory creates a storage backend from its section in seafile.conf.
+// Besides the options of the section, conf always contains "obj_type" and
+// "data_dir" (unless configured), set to the arguments passed to New().
+type BackendFactory func(conf map[string]string) (storageBackend, error)
+
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[string]BackendFactory)
+)
+
+// RegisterBackend makes a backend available under name, which can then be
+// selected with the type option of a backend section. Backends usually
+// register themselves in an init function of their own file, so adding one
+// doesn't require changing New(). Registering a name twice panics.
+func RegisterBackend(name string, factory BackendFactory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if factory == nil {
+		panic("objstore: RegisterBackend factory is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic("objstore: RegisterBackend called twice for backend " + name)
+	}
+	registry[name] = factory
+}
+
+// backendNames returns the sorted names of registered backends.
+func backendNames() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// createBackend calls the factory registered under name.
+func createBackend(name string, conf map[string]string) (storageBackend, error) {
+	registryLock.RLock()
+	factory, ok := registry[name]
+	registryLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown backend type %q, available types are: %s", name, strings.Join(backendNames(), ", "))
+	}
+
+	return factory(conf)
+}
+
+// createSubBackends creates the backends of a backend composed of named
+// sub-backends, whose options are prefixed by their names in conf:
+//
+//	hot.type = fs
+//	cold.type = s3
+//	cold.bucket = seafile-cold
+//
+// Sub-backends share the "obj_type" and "data_dir" of conf.
+func createSubBackends(conf map[string]string) (map[string]storageBackend, error) {
+	subConfs := make(map[string]map[string]string)
+	for key, value := range conf {
+		pos := strings.Index(key, ".")
+		if pos <= 0 {
+			continue
+		}
+		name := key[:pos]
+		if subConfs[name] == nil {
+			subConfs[name] = map[string]string{
+				"obj_type": conf["obj_type"],
+				"data_dir": conf["data_dir"],
+			}
+		}
+		subConfs[name][key[pos+1:]] = value
+	}
+
+	backends := make(map[string]storageBackend)
+	for name, subConf := range subConfs {
+		backendType := subConf["type"]
+		if backendType == "" {
+			backendType = "fs"
+		}
+		sub, err := createBackend(backendType, subConf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create backend %s: %w", name, err)
+		}
+		backends[name] = sub
+	}
+	return backends, nil
+}
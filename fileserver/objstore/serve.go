@@ -0,0 +1,125 @@
+package objstore
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ServeObject writes an object as the response to an HTTP request. The ETag
+// of the response is the object ID, and as objects are content-addressed it
+// never changes, so requests with a matching If-None-Match are answered
+// with 304 Not Modified without reading the object. A single byte range
+// requested with a Range header is served with ReadRange.
+//
+// It returns the number of bytes of the body written, e.g. for traffic
+// statistics: none for 304 Not Modified and HEAD requests, and the length
+// of the range for 206 Partial Content. Errors finding the object, such as
+// ErrObjectNotExist, are returned before anything is written, so the
+// caller can respond with its own status. Once the body is being written,
+// errors can only be logged.
+func (s *ObjectStore) ServeObject(w http.ResponseWriter, r *http.Request, repoID string, objID string) (int64, error) {
+	etag := `"` + objID + `"`
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return 0, nil
+	}
+
+	size, err := s.Stat(repoID, objID)
+	if err != nil {
+		return 0, err
+	}
+
+	header := w.Header()
+	header.Set("ETag", etag)
+	header.Set("Accept-Ranges", "bytes")
+
+	offset, length, ok := parseRange(r.Header.Get("Range"), size)
+	if !ok {
+		header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return 0, nil
+	}
+	status := http.StatusOK
+	if length != size {
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+		status = http.StatusPartialContent
+	}
+	header.Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(status)
+
+	if r.Method == http.MethodHead || length == 0 {
+		return 0, nil
+	}
+	cw := &countingWriter{w: w}
+	if status == http.StatusPartialContent {
+		err = s.ReadRange(repoID, objID, offset, length, cw)
+	} else {
+		err = s.Read(repoID, objID, cw)
+	}
+	return cw.n, err
+}
+
+// etagMatches reports whether an If-None-Match header matches etag.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRange parses the Range header of a request for an object of size
+// bytes into the range to serve, which is the whole object if there's no
+// header or it can't be parsed. Only single ranges are supported, others
+// are ignored as allowed by RFC 7233. ok is false if the range can't be
+// satisfied.
+func parseRange(rangeHeader string, size int64) (offset int64, length int64, ok bool) {
+	spec := strings.TrimPrefix(rangeHeader, "bytes=")
+	if spec == rangeHeader || strings.Contains(spec, ",") {
+		return 0, size, true
+	}
+	dash := strings.Index(spec, "-")
+	if dash < 0 {
+		return 0, size, true
+	}
+	startStr, endStr := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+
+	if startStr == "" {
+		// A suffix range of the last bytes.
+		n, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil {
+			return 0, size, true
+		}
+		if n <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true
+	}
+
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return 0, size, true
+	}
+	end := size - 1
+	if endStr != "" {
+		end, err = strconv.ParseInt(endStr, 10, 64)
+		if err != nil || end < start {
+			return 0, size, true
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return 0, 0, false
+	}
+	return start, end - start + 1, true
+}
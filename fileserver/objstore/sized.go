@@ -0,0 +1,87 @@
+package objstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// sizedWriter is implemented by backends that write an object more
+// efficiently when its size is known in advance, e.g. in a single request
+// instead of buffering it in parts.
+type sizedWriter interface {
+	writeSized(ctx context.Context, repoID string, objID string, r io.Reader, size int64, sync bool) error
+}
+
+// writeSizedTo writes an object of size bytes to b, with writeSized if b
+// has it. Decorators passing writes through use it so the size still
+// reaches the backend they wrap.
+func writeSizedTo(ctx context.Context, b storageBackend, repoID string, objID string, r io.Reader, size int64, sync bool) error {
+	if sw, ok := b.(sizedWriter); ok {
+		return sw.writeSized(ctx, repoID, objID, r, size, sync)
+	}
+	return b.write(ctx, repoID, objID, r, sync)
+}
+
+// WriteSized writes an object of size bytes to storage backends like Write,
+// letting backends which need the length upfront store it without
+// buffering. A negative size means it's unknown, which is the same as
+// Write. The write fails, leaving no object, if r doesn't hold exactly size
+// bytes.
+func (s *ObjectStore) WriteSized(repoID string, objID string, r io.Reader, size int64, sync bool) error {
+	return s.write(context.Background(), repoID, objID, r, size, WriteOptions{Sync: sync})
+}
+
+// newExactReader returns an exactReader over r. It stays seekable if r is,
+// so retried writes can still rewind it.
+func newExactReader(r io.Reader, objID string, size int64) io.Reader {
+	e := &exactReader{r: r, objID: objID, size: size, remaining: size}
+	if seeker, ok := r.(io.Seeker); ok {
+		if start, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			return &exactSeekReader{e, seeker, start}
+		}
+	}
+	return e
+}
+
+// exactReader fails reading if r doesn't hold exactly size bytes.
+type exactReader struct {
+	r         io.Reader
+	objID     string
+	size      int64
+	remaining int64
+}
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	// Read one byte beyond the size to detect longer content.
+	if len(p) > 0 && int64(len(p)) > e.remaining+1 {
+		p = p[:e.remaining+1]
+	}
+	n, err := e.r.Read(p)
+	e.remaining -= int64(n)
+	if e.remaining < 0 {
+		return n, fmt.Errorf("%w: object %s is longer than %d bytes", ErrSizeMismatch, e.objID, e.size)
+	}
+	if err == io.EOF && e.remaining > 0 {
+		return n, fmt.Errorf("%w: object %s is shorter than %d bytes", ErrSizeMismatch, e.objID, e.size)
+	}
+	return n, err
+}
+
+// exactSeekReader is an exactReader which can be rewound. The content
+// starts at offset start of the underlying reader, so remaining is reset
+// from the position seeked to.
+type exactSeekReader struct {
+	*exactReader
+	seeker io.Seeker
+	start  int64
+}
+
+func (e *exactSeekReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := e.seeker.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	e.remaining = e.size - (pos - e.start)
+	return pos, nil
+}
@@ -0,0 +1,96 @@
+package objstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// defaultTempFileMaxAge is the default age after which temp files are stale.
+const defaultTempFileMaxAge = 24 * time.Hour
+
+// tempCleaner is implemented by backends writing objects through temp files.
+type tempCleaner interface {
+	// cleanupTempFiles removes temp files of a repo last modified before
+	// olderThan, and returns their number.
+	cleanupTempFiles(repoID string, olderThan time.Time) (int, error)
+}
+
+// CleanupTempFiles removes temp files of a repo left behind by writes
+// interrupted by a crash. Only temp files older than temp_file_max_age of the
+// store section, 24h by default, are removed, since younger ones may belong
+// to writes in progress in another process. It returns the number of removed
+// files, and is a no-op for object-store backends.
+func (s *ObjectStore) CleanupTempFiles(repoID string) (removed int, err error) {
+	if s.IsReadOnly() {
+		return 0, ErrReadOnly
+	}
+	maxAge := s.tempFileMaxAge
+	if maxAge <= 0 {
+		maxAge = defaultTempFileMaxAge
+	}
+	return cleanupBackend(s.backend, repoID, time.Now().Add(-maxAge))
+}
+
+// cleanupBackend removes temp files of every backend in the tree rooted at b.
+func cleanupBackend(b storageBackend, repoID string, olderThan time.Time) (int, error) {
+	if c, ok := b.(tempCleaner); ok {
+		return c.cleanupTempFiles(repoID, olderThan)
+	}
+	removed := 0
+	if u, ok := b.(unwrapper); ok {
+		for _, inner := range u.unwrap() {
+			n, err := cleanupBackend(inner, repoID, olderThan)
+			removed += n
+			if err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
+
+// isTempFile reports whether name is a temp file created by writeFile.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, ".tmp.")
+}
+
+func (b *fsBackend) cleanupTempFiles(repoID string, olderThan time.Time) (int, error) {
+	if err := checkRepoID(repoID); err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, repoDir := range []string{path.Join(b.objDir, repoID), path.Join(b.objDir, ttlDirName, repoID)} {
+		dirs, err := b.layout.objectDirs(repoDir)
+		if err != nil {
+			return removed, fsError(err)
+		}
+		for _, dir := range dirs {
+			shardDir := dir.path
+			entries, err := ioutil.ReadDir(shardDir)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return removed, fsError(err)
+			}
+			for _, entry := range entries {
+				if entry.IsDir() || !isTempFile(entry.Name()) || !entry.ModTime().Before(olderThan) {
+					continue
+				}
+				err := os.Remove(path.Join(shardDir, entry.Name()))
+				if err != nil {
+					if os.IsNotExist(err) {
+						continue
+					}
+					return removed, fsError(err)
+				}
+				removed++
+			}
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,156 @@
+package objstore
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the OpenTelemetry tracer of object stores.
+const tracerName = "github.com/haiwen/seafile-server/fileserver/objstore"
+
+// opSpan is the span of an object store operation, which is traced and
+// passed to the Logger of the store. A nil *opSpan is valid and does
+// nothing.
+type opSpan struct {
+	span trace.Span
+	cw   *countingWriter
+	cr   *countingReader
+	// bytes is the size of the content transferred without streaming it.
+	bytes int64
+	// event is logged when the span ends if logger is set.
+	logger  Logger
+	verbose bool
+	event   OpEvent
+	start   time.Time
+}
+
+// startSpan starts a span of the operation op as a child of the span in
+// ctx. Untraced requests, whose context has no recording span, get a nil
+// span without touching the tracer unless the store has a Logger, so
+// tracing and logging cost nothing when they aren't configured.
+func (s *ObjectStore) startSpan(ctx context.Context, op string, repoID string, objID string) (context.Context, *opSpan) {
+	recording := trace.SpanFromContext(ctx).IsRecording()
+	if !recording && s.logger == nil {
+		return ctx, nil
+	}
+	o := &opSpan{logger: s.logger, verbose: s.logVerbose}
+	if s.logger != nil {
+		o.event = OpEvent{ObjType: s.ObjType, Op: op, RepoID: repoID, ObjID: objID}
+		o.start = time.Now()
+	}
+	if recording {
+		ctx, o.span = otel.Tracer(tracerName).Start(ctx, "objstore."+op, trace.WithAttributes(
+			attribute.String("objstore.obj_type", s.ObjType),
+			attribute.String("objstore.repo_id", repoID),
+			attribute.Int("objstore.obj_id_length", len(objID)),
+		))
+	}
+	return ctx, o
+}
+
+// writer returns w counting the bytes written through it into the span.
+func (o *opSpan) writer(w io.Writer) io.Writer {
+	if o == nil {
+		return w
+	}
+	o.cw = &countingWriter{w: w}
+	return o.cw
+}
+
+// reader returns r counting the bytes read through it into the span. It
+// stays seekable if r is, so retried writes can still rewind it.
+func (o *opSpan) reader(r io.Reader) io.Reader {
+	if o == nil {
+		return r
+	}
+	var counted io.Reader
+	o.cr, counted = countReader(r)
+	return counted
+}
+
+// add records n bytes transferred without streaming them through the span.
+func (o *opSpan) add(n int64) {
+	if o != nil {
+		o.bytes += n
+	}
+}
+
+// firstError returns the first non-nil error of errs, to end the span of
+// an operation on many objects with.
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// end records the bytes transferred and err, then ends the span and logs
+// the operation if it failed or the logger is verbose.
+func (o *opSpan) end(err error) {
+	if o == nil {
+		return
+	}
+	bytes := o.bytes
+	if o.cw != nil {
+		bytes = o.cw.n
+	} else if o.cr != nil {
+		bytes = o.cr.n
+	}
+	if o.logger != nil && (err != nil || o.verbose) {
+		o.event.Duration = time.Since(o.start)
+		o.event.Bytes = bytes
+		o.event.Err = err
+		o.logger.Log(o.event)
+	}
+	if o.span == nil {
+		return
+	}
+	o.span.SetAttributes(attribute.Int64("objstore.bytes", bytes))
+	if err != nil {
+		o.span.RecordError(err)
+		o.span.SetStatus(codes.Error, err.Error())
+	}
+	o.span.End()
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+var countingWriters = sync.Pool{New: func() interface{} { return new(countingWriter) }}
+
+// getCountingWriter returns a pooled countingWriter of w, which must be
+// returned with putCountingWriter once nothing writes to it anymore.
+func getCountingWriter(w io.Writer) *countingWriter {
+	cw := countingWriters.Get().(*countingWriter)
+	cw.w = w
+	cw.n = 0
+	return cw
+}
+
+func putCountingWriter(cw *countingWriter) {
+	cw.w = nil
+	countingWriters.Put(cw)
+}
+
+type countingReadSeeker struct {
+	*countingReader
+	io.Seeker
+}
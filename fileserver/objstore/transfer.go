@@ -0,0 +1,33 @@
+package objstore
+
+import (
+	"context"
+	"io"
+)
+
+// ReadN reads an object to w like Read and returns the number of bytes
+// written to w, which is also set when the read fails part way.
+func (s *ObjectStore) ReadN(repoID string, objID string, w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	err := s.ReadCtx(context.Background(), repoID, objID, cw)
+	return cw.n, err
+}
+
+// WriteN writes an object from r like Write and returns the number of bytes
+// read from r. If a backend retries the write after rewinding r, the bytes
+// sent again are counted too.
+func (s *ObjectStore) WriteN(repoID string, objID string, r io.Reader, sync bool) (int64, error) {
+	cr, counted := countReader(r)
+	err := s.Write(repoID, objID, counted, sync)
+	return cr.n, err
+}
+
+// countReader wraps r to count the bytes read from it. The returned reader
+// stays seekable if r is, so retried writes can still rewind it.
+func countReader(r io.Reader) (*countingReader, io.Reader) {
+	cr := &countingReader{r: r}
+	if seeker, ok := r.(io.Seeker); ok {
+		return cr, &countingReadSeeker{cr, seeker}
+	}
+	return cr, cr
+}
@@ -0,0 +1,151 @@
+package objstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// ttlDirName is the directory under the object directory of fs backend
+// holding objects written with a TTL. Their modification time is set to
+// the time they expire.
+const ttlDirName = ".ttl"
+
+// ttlWriter is implemented by backends that can store objects which
+// expire after some time.
+type ttlWriter interface {
+	writeWithTTL(ctx context.Context, repoID string, objID string, r io.Reader, expires time.Time) error
+	// purgeExpired deletes expired objects of a repo and returns their number.
+	purgeExpired(repoID string, now time.Time) (int, error)
+}
+
+// WriteWithTTL writes a temporary object, e.g. a block of an upload in
+// progress, which expires after ttl. An expired object is reported as not
+// existing and is deleted by PurgeExpired. Writing the object again with
+// Write makes it permanent. Objects with TTL aren't returned by List.
+func (s *ObjectStore) WriteWithTTL(repoID string, objID string, r io.Reader, ttl time.Duration) error {
+	if s.IsReadOnly() {
+		return ErrReadOnly
+	}
+	b := ttlBackend(s.backend)
+	if b == nil {
+		return fmt.Errorf("%s object store doesn't support objects with TTL: %w", s.ObjType, ErrNotSupported)
+	}
+	return b.writeWithTTL(context.Background(), repoID, objID, r, time.Now().Add(ttl))
+}
+
+// PurgeExpired deletes the expired objects of a repo written with
+// WriteWithTTL, and returns the number of deleted objects.
+func (s *ObjectStore) PurgeExpired(repoID string) (int, error) {
+	if s.IsReadOnly() {
+		return 0, ErrReadOnly
+	}
+	b := ttlBackend(s.backend)
+	if b == nil {
+		return 0, nil
+	}
+	return b.purgeExpired(repoID, time.Now())
+}
+
+// ttlBackend returns the ttlWriter of b, looking through transparent
+// decorators, or nil if there's none.
+func ttlBackend(b storageBackend) ttlWriter {
+	found := findCapability(b, "ttl", func(b storageBackend) bool {
+		_, ok := b.(ttlWriter)
+		return ok
+	})
+	if found == nil {
+		return nil
+	}
+	return found.(ttlWriter)
+}
+
+func (b *fsBackend) ttlPath(repoID string, objID string) string {
+	return b.layout.objectPath(path.Join(b.objDir, ttlDirName, repoID), objID)
+}
+
+// openObject opens an object, falling back to an unexpired object with TTL.
+// Like os.Open, a missing object is reported with an error matching
+// os.ErrNotExist.
+func (b *fsBackend) openObject(repoID string, objID string) (*os.File, error) {
+	fd, err := os.Open(b.objectPath(repoID, objID))
+	if err == nil || !os.IsNotExist(err) {
+		return fd, err
+	}
+
+	fd, err = os.Open(b.ttlPath(repoID, objID))
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	if isExpired(fileInfo, time.Now()) {
+		fd.Close()
+		return nil, os.ErrNotExist
+	}
+	return fd, nil
+}
+
+// statObject is like openObject, but only returns the object's file info.
+func (b *fsBackend) statObject(repoID string, objID string) (os.FileInfo, error) {
+	fileInfo, err := os.Stat(b.objectPath(repoID, objID))
+	if err == nil || !os.IsNotExist(err) {
+		return fileInfo, err
+	}
+
+	fileInfo, err = os.Stat(b.ttlPath(repoID, objID))
+	if err != nil {
+		return nil, err
+	}
+	if isExpired(fileInfo, time.Now()) {
+		return nil, os.ErrNotExist
+	}
+	return fileInfo, nil
+}
+
+func isExpired(fileInfo os.FileInfo, now time.Time) bool {
+	return !fileInfo.ModTime().After(now)
+}
+
+func (b *fsBackend) writeWithTTL(ctx context.Context, repoID string, objID string, r io.Reader, expires time.Time) error {
+	if err := checkIDs(repoID, objID); err != nil {
+		return err
+	}
+	return b.writeFile(ctx, b.ttlPath(repoID, objID), objID, r, false, expires)
+}
+
+func (b *fsBackend) purgeExpired(repoID string, now time.Time) (int, error) {
+	if err := checkRepoID(repoID); err != nil {
+		return 0, err
+	}
+	dirs, err := b.layout.objectDirs(path.Join(b.objDir, ttlDirName, repoID))
+	if err != nil {
+		return 0, fsError(err)
+	}
+
+	purged := 0
+	for _, dir := range dirs {
+		shardDir := dir.path
+		entries, err := readObjectDir(shardDir)
+		if err != nil {
+			return purged, fsError(err)
+		}
+		for _, entry := range entries {
+			if !isExpired(entry, now) {
+				continue
+			}
+			err := os.Remove(path.Join(shardDir, entry.Name()))
+			if err != nil && !os.IsNotExist(err) {
+				return purged, fsError(err)
+			}
+			purged++
+		}
+	}
+	return purged, nil
+}
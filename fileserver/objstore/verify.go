@@ -0,0 +1,171 @@
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+)
+
+// verifyWorkers is the number of objects Verify hashes concurrently.
+const verifyWorkers = 8
+
+// ReadVerified reads an object like Read, but checks that its content
+// hashes to objID with the HashAlgo of its ID, told by its length, or the
+// configured one. The content is buffered and only written into w after
+// verification, so nothing is written if a *ChecksumError is returned.
+// Only blocks are stored under the hash of their content, so it returns
+// ErrNotSupported for commit and fs objects.
+func (s *ObjectStore) ReadVerified(repoID string, objID string, w io.Writer) error {
+	if !isBlockType(s.ObjType) {
+		return ErrNotSupported
+	}
+
+	var buf bytes.Buffer
+	h := hashForID(objID).New()
+	err := s.backend.read(context.Background(), repoID, objID, io.MultiWriter(&buf, h))
+	if err != nil {
+		return err
+	}
+
+	actual := hex.EncodeToString(h.Sum(nil))
+	if actual != objID {
+		return &ChecksumError{Expected: objID, Actual: actual}
+	}
+
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// Verify re-hashes every object of a repo with the HashAlgo of its ID and
+// checks it matches the ID, e.g. to detect bit-rot. fn is called, never
+// concurrently, with a *ChecksumError for each corrupt object and with the
+// error of each object that can't be read; objects deleted during the
+// check are skipped. The check continues past failed objects, and err is
+// only set if the repo can't be listed, or is ErrNotSupported for object
+// types other than blocks, like ReadVerified.
+func (s *ObjectStore) Verify(repoID string, fn func(objID string, err error)) (checked, corrupt int, err error) {
+	if !isBlockType(s.ObjType) {
+		return 0, 0, ErrNotSupported
+	}
+	var mu sync.Mutex
+	report := func(objID string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		checked++
+		if err == nil {
+			return
+		}
+		if errors.Is(err, ErrChecksumMismatch) {
+			corrupt++
+		}
+		fn(objID, err)
+	}
+
+	var wg sync.WaitGroup
+	objIDs := make(chan string)
+	for i := 0; i < verifyWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for objID := range objIDs {
+				err := s.verifyObject(repoID, objID)
+				if errors.Is(err, ErrObjectNotExist) {
+					continue
+				}
+				report(objID, err)
+			}
+		}()
+	}
+	err = s.backend.list(repoID, func(objID string) error {
+		objIDs <- objID
+		return nil
+	})
+	close(objIDs)
+	wg.Wait()
+
+	return checked, corrupt, err
+}
+
+// verifyObject hashes an object without buffering it.
+func (s *ObjectStore) verifyObject(repoID string, objID string) error {
+	h := hashForID(objID).New()
+	err := s.backend.read(context.Background(), repoID, objID, h)
+	if err != nil {
+		return err
+	}
+	actual := hex.EncodeToString(h.Sum(nil))
+	if actual != objID {
+		return &ChecksumError{Expected: objID, Actual: actual}
+	}
+	return nil
+}
+
+// isBlockType reports whether objType is the type of blocks, the only
+// objects whose ID is the hash of their stored content: fs objects are
+// stored compressed and commit IDs hash the commit's fields.
+func isBlockType(objType string) bool {
+	return objType == "blocks" || objType == "block"
+}
+
+// verifyingReader wraps r to check the content written to objID hashes to
+// it, if verify_on_write is set and objID is a hash. Backends only commit
+// an object once they read r to its end, so a mismatch fails the write
+// before anything is stored.
+func (s *ObjectStore) verifyingReader(objID string, r io.Reader) io.Reader {
+	if !s.verifyOnWrite || !isHashID(objID) {
+		return r
+	}
+	vr := &hashingReader{r: r, h: hashForID(objID).New(), objID: objID}
+	if seeker, ok := r.(io.Seeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err == nil {
+			return &hashingReadSeeker{vr, seeker, start}
+		}
+	}
+	return vr
+}
+
+// hashingReader hashes the content read from r, and returns a
+// *ChecksumError instead of io.EOF if it doesn't hash to objID.
+type hashingReader struct {
+	r     io.Reader
+	h     hash.Hash
+	objID string
+}
+
+func (v *hashingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF {
+		if actual := hex.EncodeToString(v.h.Sum(nil)); actual != v.objID {
+			return n, &ChecksumError{Expected: v.objID, Actual: actual}
+		}
+	}
+	return n, err
+}
+
+// hashingReadSeeker keeps a hashingReader seekable, so retried writes can
+// rewind it. The hash restarts when rewound to where hashing started, and
+// seeking anywhere else fails since the hash couldn't be checked.
+type hashingReadSeeker struct {
+	*hashingReader
+	seeker io.Seeker
+	start  int64
+}
+
+func (v *hashingReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := v.seeker.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	if pos != v.start {
+		return pos, fmt.Errorf("can't verify object %s after seeking", v.objID)
+	}
+	v.h.Reset()
+	return pos, nil
+}
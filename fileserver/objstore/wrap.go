@@ -0,0 +1,94 @@
+package objstore
+
+// unwrapper is implemented by backends wrapping other backends.
+type unwrapper interface {
+	unwrap() []storageBackend
+}
+
+// findBackend returns the first backend in the tree rooted at b for which match returns true.
+func findBackend(b storageBackend, match func(storageBackend) bool) storageBackend {
+	if match(b) {
+		return b
+	}
+	if u, ok := b.(unwrapper); ok {
+		for _, inner := range u.unwrap() {
+			if found := findBackend(inner, match); found != nil {
+				return found
+			}
+		}
+	}
+	return nil
+}
+
+// transparentBackend is implemented by decorators which can be looked
+// through for an operation they don't implement themselves, because
+// passing it straight to the backend they wrap leaves their own state
+// consistent. op is one of "copy", "move", "list_page", "ttl",
+// "exists_many" or "repo_stats". Decorators that only retry, bound or
+// throttle requests are transparent for all of them, at the cost of not
+// retrying, bounding or throttling those.
+type transparentBackend interface {
+	transparentFor(op string) bool
+}
+
+// findCapability returns b if match accepts it, or the first backend match
+// accepts below the decorators of b transparent for op. It returns nil if
+// a decorator which isn't transparent for op is reached first.
+func findCapability(b storageBackend, op string, match func(storageBackend) bool) storageBackend {
+	for !match(b) {
+		t, ok := b.(transparentBackend)
+		if !ok || !t.transparentFor(op) {
+			return nil
+		}
+		inner := b.(unwrapper).unwrap()
+		if len(inner) != 1 {
+			return nil
+		}
+		b = inner[0]
+	}
+	return b
+}
+
+// closer is implemented by backends holding resources, such as connection
+// pools, that should be released on shutdown.
+type closer interface {
+	close() error
+}
+
+// closeBackend closes every backend in the tree rooted at b, returning the
+// first error. A closer is responsible for closing the backends it wraps.
+func closeBackend(b storageBackend) error {
+	if c, ok := b.(closer); ok {
+		return c.close()
+	}
+	var firstErr error
+	if u, ok := b.(unwrapper); ok {
+		for _, inner := range u.unwrap() {
+			if err := closeBackend(inner); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// syncer is implemented by backends buffering writes made with sync=false.
+type syncer interface {
+	sync() error
+}
+
+// syncBackend flushes every backend in the tree rooted at b.
+// A syncer is responsible for flushing the backends it wraps.
+func syncBackend(b storageBackend) error {
+	if s, ok := b.(syncer); ok {
+		return s.sync()
+	}
+	if u, ok := b.(unwrapper); ok {
+		for _, inner := range u.unwrap() {
+			if err := syncBackend(inner); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
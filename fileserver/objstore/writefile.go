@@ -0,0 +1,116 @@
+package objstore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"syscall"
+	"time"
+)
+
+// fileWriter is implemented by backends that can take an object from a
+// file without copying it.
+type fileWriter interface {
+	// writeFromFile returns errCrossDevice if the file can't be linked,
+	// so the caller copies it instead.
+	writeFromFile(repoID string, objID string, srcPath string, sync bool) error
+}
+
+// errCrossDevice means a file is on another file system than the objects.
+var errCrossDevice = errors.New("file is on another file system")
+
+// WriteFromFile writes the content of the file at srcPath to an object,
+// e.g. an upload staged on disk. The fs backend hard links the file into
+// place when it's on the same file system, so it must not be modified
+// afterwards, but it can be removed. Otherwise the file is streamed to the
+// backend with its size known, like WriteSized. It's always streamed if
+// verify_on_write is set, so the content is hashed.
+func (s *ObjectStore) WriteFromFile(repoID string, objID string, srcPath string, sync bool) (err error) {
+	ctx, span := s.startSpan(context.Background(), "write_from_file", repoID, objID)
+	defer func() {
+		span.end(err)
+	}()
+	if b, ok := s.backend.(fileWriter); ok && !s.IsReadOnly() && !s.verifyOnWrite {
+		start := time.Now()
+		info, err := os.Stat(srcPath)
+		if err != nil {
+			return err
+		}
+		if s.quota != nil {
+			allowed, err := s.quota.Allow(repoID, info.Size())
+			if err != nil {
+				return err
+			}
+			if !allowed {
+				return ErrQuotaExceeded
+			}
+		}
+		err = b.writeFromFile(repoID, objID, srcPath, sync)
+		if err != errCrossDevice {
+			s.metrics.write.observe(start, err)
+			if err == nil {
+				s.metrics.bytesIn.Add(info.Size())
+				span.add(info.Size())
+			}
+			return err
+		}
+	}
+
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// The streamed write is traced and logged as a write of its own.
+	err = s.write(ctx, repoID, objID, f, info.Size(), WriteOptions{Sync: sync})
+	if err == nil {
+		span.add(info.Size())
+	}
+	return err
+}
+
+// writeFromFile hard links the file as the object. An existing object is
+// kept, as it has the same content.
+func (b *fsBackend) writeFromFile(repoID string, objID string, srcPath string, sync bool) error {
+	if err := checkIDs(repoID, objID); err != nil {
+		return err
+	}
+	p := b.objectPath(repoID, objID)
+	if err := b.mkdirAll(path.Dir(p)); err != nil {
+		return fsError(err)
+	}
+	err := os.Link(srcPath, p)
+	if errors.Is(err, syscall.EXDEV) {
+		return errCrossDevice
+	}
+	if os.IsExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fsError(err)
+	}
+	if b.fileMode != 0 {
+		if err := os.Chmod(p, b.fileMode); err != nil {
+			return fsError(err)
+		}
+	}
+
+	if sync {
+		f, err := os.Open(p)
+		if err != nil {
+			return fsError(err)
+		}
+		err = f.Sync()
+		f.Close()
+		if err != nil {
+			return fsError(err)
+		}
+		return fsError(syncDir(path.Dir(p)))
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package objstore
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// absentWriter is implemented by backends that can create an object only
+// if it doesn't exist in a single atomic step.
+type absentWriter interface {
+	writeIfAbsent(ctx context.Context, repoID string, objID string, r io.Reader, sync bool) (written bool, err error)
+}
+
+// WriteIfAbsent writes an object unless it already exists, and reports
+// whether it was written. With the fs and s3 backends the check and the
+// write are atomic, so of concurrent writers of the same object exactly one
+// gets written=true. Other backends check whether the object exists before
+// writing it, so concurrent writers may all write it.
+//
+// Whether r is read when the object exists depends on the backend.
+func (s *ObjectStore) WriteIfAbsent(repoID string, objID string, r io.Reader, sync bool) (written bool, err error) {
+	start := time.Now()
+	ctx, span := s.startSpan(context.Background(), "write_if_absent", repoID, objID)
+	defer func() {
+		span.end(err)
+		s.metrics.write.observe(start, err)
+	}()
+	r = span.reader(r)
+	if s.IsReadOnly() {
+		return false, ErrReadOnly
+	}
+	if s.quota != nil {
+		r, err = checkQuota(s.quota, repoID, r)
+		if err != nil {
+			return false, err
+		}
+	}
+	r = s.verifyingReader(objID, r)
+
+	if b, ok := s.backend.(absentWriter); ok {
+		return b.writeIfAbsent(ctx, repoID, objID, r, sync)
+	}
+
+	exists, err := s.backend.exists(repoID, objID)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+	err = s.backend.write(ctx, repoID, objID, r, sync)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,132 @@
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+)
+
+// writeManyWorkers is the number of objects WriteMany writes concurrently
+// to backends without a batch write.
+const writeManyWorkers = 16
+
+// Object is the content of an object written by WriteMany.
+type Object struct {
+	ObjID string
+	Data  []byte
+}
+
+// manyWriter is implemented by backends that write a batch of objects more
+// efficiently than one by one.
+type manyWriter interface {
+	writeMany(ctx context.Context, repoID string, objs []Object, sync bool) []error
+}
+
+// WriteMany writes small objects of a repo in a batch, for bulk imports
+// where the cost of each Write dominates. Objects are written concurrently
+// to object-store backends, while the fs backend writes them in turn and
+// syncs once at the end if sync is set. The fs backend is only used
+// directly when it isn't wrapped, e.g. by compression or a cache. errs is aligned with objs and
+// holds the error of each object, nil for the written ones. Writing the
+// same objects again is harmless, so failed ones can simply be retried.
+func (s *ObjectStore) WriteMany(repoID string, objs []Object, sync bool) (written int, errs []error) {
+	ctx, span := s.startSpan(context.Background(), "write_many", repoID, "")
+	defer func() {
+		span.end(firstError(errs))
+	}()
+	errs = make([]error, len(objs))
+	if s.IsReadOnly() {
+		for i := range errs {
+			errs[i] = ErrReadOnly
+		}
+		return 0, errs
+	}
+
+	start := time.Now()
+	pending := make([]Object, 0, len(objs))
+	// index maps pending objects to their position in objs.
+	index := make([]int, 0, len(objs))
+	for i, obj := range objs {
+		if s.verifyOnWrite && isHashID(obj.ObjID) {
+			if actual := hashForID(obj.ObjID).computeID(obj.Data); actual != obj.ObjID {
+				errs[i] = &ChecksumError{Expected: obj.ObjID, Actual: actual}
+				continue
+			}
+		}
+		if s.quota != nil {
+			if _, err := checkQuota(s.quota, repoID, bytes.NewReader(obj.Data)); err != nil {
+				errs[i] = err
+				continue
+			}
+		}
+		pending = append(pending, obj)
+		index = append(index, i)
+	}
+
+	var pendingErrs []error
+	if b, ok := s.backend.(manyWriter); ok {
+		pendingErrs = b.writeMany(ctx, repoID, pending, sync)
+	} else {
+		pendingErrs = writeConcurrently(ctx, s.backend, repoID, pending, sync)
+	}
+	for j, err := range pendingErrs {
+		errs[index[j]] = err
+	}
+
+	for i, err := range errs {
+		s.metrics.write.observe(start, err)
+		if err == nil {
+			written++
+			s.metrics.bytesIn.Add(int64(len(objs[i].Data)))
+			span.add(int64(len(objs[i].Data)))
+		}
+	}
+	return written, errs
+}
+
+// writeConcurrently writes objects with writeManyWorkers concurrent writes.
+func writeConcurrently(ctx context.Context, backend storageBackend, repoID string, objs []Object, syncWrites bool) []error {
+	errs := make([]error, len(objs))
+	var wg sync.WaitGroup
+	indexes := make(chan int)
+	for i := 0; i < writeManyWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				errs[i] = backend.write(ctx, repoID, objs[i].ObjID, bytes.NewReader(objs[i].Data), syncWrites)
+			}
+		}()
+	}
+	for i := range objs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return errs
+}
+
+// writeMany writes the objects without syncing each of them, and then
+// syncs the file system once if sync is set. If that fails, none of the
+// objects is known to be durable, so they all fail. Only the sync is
+// batched: each object is still written through its own temp file and
+// renamed into place as by write.
+func (b *fsBackend) writeMany(ctx context.Context, repoID string, objs []Object, sync bool) []error {
+	errs := make([]error, len(objs))
+	for i, obj := range objs {
+		errs[i] = b.write(ctx, repoID, obj.ObjID, bytes.NewReader(obj.Data), false)
+	}
+	if !sync {
+		return errs
+	}
+	if err := b.sync(); err != nil {
+		err = fsError(err)
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,69 @@
+package objstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// errWriteAborted is passed to the backend when an ObjectWriter is aborted.
+var errWriteAborted = errors.New("write aborted")
+
+// ObjectWriter writes an object incrementally. The object is only committed
+// by Close; Abort discards it. Either Close or Abort must be called.
+type ObjectWriter interface {
+	io.Writer
+	// Close commits the object and returns the error of the write.
+	Close() error
+	// Abort discards the object. It's a no-op after Close.
+	Abort()
+}
+
+// NewWriter returns a writer streaming to an object, so content assembled
+// incrementally doesn't have to be buffered. Until Close returns, the
+// object isn't visible, and an aborted or failed write leaves no partial
+// object behind.
+func (s *ObjectStore) NewWriter(repoID string, objID string, sync bool) (ObjectWriter, error) {
+	if s.IsReadOnly() {
+		return nil, ErrReadOnly
+	}
+
+	pr, pw := io.Pipe()
+	w := &objectWriter{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		w.err = s.WriteCtx(context.Background(), repoID, objID, pr, sync)
+		// Fail further writes once the backend stops reading.
+		pr.CloseWithError(w.err)
+	}()
+	return w, nil
+}
+
+type objectWriter struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	// err is the result of the backend write, set before done is closed.
+	err  error
+	once sync.Once
+}
+
+// Write fails with the error of the backend if the write has failed.
+func (w *objectWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *objectWriter) Close() error {
+	w.once.Do(func() {
+		w.pw.Close()
+	})
+	<-w.done
+	return w.err
+}
+
+func (w *objectWriter) Abort() {
+	w.once.Do(func() {
+		w.pw.CloseWithError(errWriteAborted)
+	})
+	<-w.done
+}
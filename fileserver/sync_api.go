@@ -765,9 +765,9 @@ func putSendBlockCB(rsp http.ResponseWriter, r *http.Request) *appError {
 		return &appError{err, "", http.StatusInternalServerError}
 	}
 
-	if err := blockmgr.Write(storeID, blockID, r.Body); err != nil {
-		err := fmt.Errorf("Failed to close block %.8s:%s", storeID, blockID)
-		return &appError{err, "", http.StatusInternalServerError}
+	if err := blockmgr.WriteSized(storeID, blockID, r.Body, r.ContentLength); err != nil {
+		err := fmt.Errorf("Failed to close block %.8s:%s: %w", storeID, blockID, err)
+		return storageError(err)
 	}
 
 	sendStatisticMsg(storeID, user, "sync-file-upload", uint64(r.ContentLength))
@@ -903,8 +903,8 @@ func putCommitCB(rsp http.ResponseWriter, r *http.Request) *appError {
 	}
 
 	if err := commitmgr.Save(commit); err != nil {
-		err := fmt.Errorf("Failed to add commit %s: %v", commitID, err)
-		return &appError{err, "", http.StatusInternalServerError}
+		err := fmt.Errorf("Failed to add commit %s: %w", commitID, err)
+		return storageError(err)
 	}
 
 	return nil